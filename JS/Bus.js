@@ -8,6 +8,7 @@ class Bus {
      * @param {boolean} options.Secure "default: false"
      * @param {boolean} options.Autorestart "default: false"
      * @param {number} options.RestartEvery "default: 10"
+     * @param {string} options.Token "default: none, sent as token query param to the server Authenticator, the auth cookie is sent by the browser"
      */
     constructor(options) {
         if (options === undefined) {
@@ -18,6 +19,9 @@ class Bus {
         this.Address = options.Address || window.location.host;
         this.Path = options.Path || "/ws/bus";
         this.fullAddress = this.scheme + this.Address + this.Path;
+        if (options.Token) {
+            this.fullAddress += "?token=" + encodeURIComponent(options.Token);
+        }
         this.TopicHandlers = {};
         this.Autorestart = options.Autorestart || false;
         this.RestartEvery = options.RestartEvery || 10;
@@ -25,6 +29,10 @@ class Bus {
         this.OnClose = () => { };
         this.OnDataWs = (data, ws) => { };
         this.OnId = (data) => { };
+        // OnError receive the BusError of messages rejected by the server, err.code is one of Bus.Codes
+        this.OnError = (err) => {
+            console.error("Bus error: " + err.code, err.message);
+        };
         this.Id = options.Id || this.makeid();
         this.conn = this.connect(this.fullAddress, this.callback);
     }
@@ -45,7 +53,14 @@ class Bus {
 
         $this.conn.onmessage = (e) => {
             let obj = JSON.parse(e.data);
+            if (obj.data === "pong" && obj.id) {
+                // the server may bind the connection to the id of an authenticated principal
+                $this.Id = obj.id;
+            }
             $this.subscription = {};
+            if (obj.code !== undefined && obj.error !== undefined && obj.topic === undefined) {
+                $this.OnError(new BusError(obj));
+            }
             $this.OnDataWs(obj, $this.conn);
             if (obj.event_id !== undefined) {
                 $this.Publish(obj.event_id, {
@@ -58,12 +73,18 @@ class Bus {
                 $this.OnId(obj);
             }
             if (obj.topic !== undefined) {
-                // on publish
-                if ($this.TopicHandlers[obj.topic] !== undefined) {
-                    let subs = new busSubscription($this, obj.topic);
-                    $this.TopicHandlers[obj.topic](obj, subs);
+                // on publish, handlers subscribed with a matching wildcard are called too
+                let found = false;
+                for (const pattern in $this.TopicHandlers) {
+                    if ($this.MatchTopic(pattern, obj.topic)) {
+                        let subs = new busSubscription($this, pattern, obj.ack_id);
+                        $this.TopicHandlers[pattern](obj, subs);
+                        found = true;
+                    }
+                }
+                if (found) {
                     return;
-                } 
+                }
             }
         };
 
@@ -102,6 +123,41 @@ class Bus {
         return subs;
     }
 
+    /**
+     * QueueSubscribe subscribe to a topic as a member of a queue group, each message is received by only one member of the group
+     * @param {string} topic 
+     * @param {string} queue 
+     * @param {function handler(data: string,subscription: busSubscription) {}} handler 
+     */
+    QueueSubscribe(topic, queue, handler) {
+        this.conn.send(JSON.stringify({
+            "action": "sub",
+            "topic": topic,
+            "queue": queue,
+            "from": this.Id
+        }));
+        let subs = new busSubscription(this, topic);
+        this.TopicHandlers[topic] = handler;
+        return subs;
+    }
+
+    /**
+     * SubscribeAck subscribe to a topic in at-least-once mode, messages not acked with subscription.Ack() are redelivered by the server
+     * @param {string} topic 
+     * @param {function handler(data: string,subscription: busSubscription) {}} handler 
+     */
+    SubscribeAck(topic, handler) {
+        this.conn.send(JSON.stringify({
+            "action": "sub",
+            "topic": topic,
+            "ack": true,
+            "from": this.Id
+        }));
+        let subs = new busSubscription(this, topic);
+        this.TopicHandlers[topic] = handler;
+        return subs;
+    }
+
     /**
      * Unsubscribe unsubscribe from topic
      * @param {string} topic 
@@ -122,13 +178,81 @@ class Bus {
      * Publish publish to topic
      * @param {string} topic 
      * @param {object} data 
+     * @param {boolean} retain "default: false, keep data as the last value of topic, sent to new subscribers"
      */
-    Publish(topic, data) {
-        this.conn.send(JSON.stringify({
+    Publish(topic, data, retain) {
+        let msg = {
             "action": "pub",
             "topic": topic,
             "data": data,
             "from": this.Id
+        };
+        if (retain) {
+            msg.retain = true;
+        }
+        this.conn.send(JSON.stringify(msg));
+    }
+
+    /**
+     * PublishWith publish to topic with delivery options, the server schedule it
+     * @param {string} topic 
+     * @param {object} data 
+     * @param {object} options
+     * @param {number} options.delay "milliseconds before publishing"
+     * @param {Date} options.deliverAt "publish at this date, used if delay is not set"
+     * @param {number} options.ttl "milliseconds after which the message expire if not delivered"
+     * @param {boolean} options.retain "keep data as the last value of topic"
+     */
+    PublishWith(topic, data, options) {
+        this.conn.send(JSON.stringify(this.withOptions({
+            "action": "pub",
+            "topic": topic,
+            "data": data,
+            "from": this.Id
+        }, options)));
+    }
+
+    /**
+     * PublishToIDWith publish to an id with delivery options, the server schedule it
+     * @param {string} id 
+     * @param {object} data 
+     * @param {object} options "same as PublishWith, without retain"
+     */
+    PublishToIDWith(id, data, options) {
+        this.conn.send(JSON.stringify(this.withOptions({
+            "action": "pub_id",
+            "id": id,
+            "data": data,
+            "from": this.Id
+        }, options)));
+    }
+
+    withOptions(msg, options) {
+        options = options || {};
+        if (options.delay) {
+            msg.delay = options.delay;
+        }
+        if (options.deliverAt) {
+            msg.deliver_at = options.deliverAt.getTime();
+        }
+        if (options.ttl) {
+            msg.ttl = options.ttl;
+        }
+        if (options.retain) {
+            msg.retain = true;
+        }
+        return msg;
+    }
+
+    /**
+     * ClearRetained remove the last value retained on topic, subscribers are kept
+     * @param {string} topic 
+     */
+    ClearRetained(topic) {
+        this.conn.send(JSON.stringify({
+            "action": "clear_retained",
+            "topic": topic,
+            "from": this.Id
         }));
     }
 
@@ -200,6 +324,87 @@ class Bus {
 
 
 
+    /**
+     * Request publish data on topic and resolve with the response of a handler registered using HandleRequest
+     * @param {string} topic 
+     * @param {object} data 
+     * @param {number} timeout "default: 10000 ms"
+     * @returns {Promise<object>} rejected with the error returned by the handler or on timeout
+     */
+    Request(topic, data, timeout) {
+        data = data || {};
+        // the inbox is owned by the id of the client, only this connection can subscribe to it
+        let inbox = "_INBOX." + Bus.escapeTopicLevel(this.Id) + "." + this.makeid();
+        data.reply_to = inbox;
+        return new Promise((resolve, reject) => {
+            let timer = setTimeout(() => {
+                this.Unsubscribe(inbox);
+                reject(new Error("request timeout on " + topic));
+            }, timeout || 10000);
+            this.Subscribe(inbox, (reply, sub) => {
+                clearTimeout(timer);
+                sub.Unsubscribe();
+                if (reply.error) {
+                    reject(new Error(reply.error));
+                } else {
+                    resolve(reply.data);
+                }
+            });
+            this.Publish(topic, data);
+        });
+    }
+
+    /**
+     * HandleRequest subscribe to topic and answer requests sent using Request
+     * @param {string} topic 
+     * @param {function(req: object): object|Promise<object>} handler throw to send an error back
+     * @returns {busSubscription}
+     */
+    HandleRequest(topic, handler) {
+        return this.Subscribe(topic, async (req) => {
+            let replyTo = req.reply_to;
+            if (!replyTo) {
+                return;
+            }
+            delete req.reply_to;
+            try {
+                let resp = await handler(req);
+                this.Publish(replyTo, { "data": resp || {} });
+            } catch (err) {
+                this.Publish(replyTo, { "error": err.message || String(err) });
+            }
+        });
+    }
+
+    /**
+     * Presence resolve with the ids subscribed to topic
+     * @param {string} topic 
+     * @param {number} timeout "default: 10000 ms"
+     * @returns {Promise<string[]>}
+     */
+    Presence(topic, timeout) {
+        return this.Request("$sys.query.presence", { "of": topic }, timeout).then((resp) => resp.ids || []);
+    }
+
+    /**
+     * SubscribePresence call handler with "join" or "leave" when subscribers of topic change, an empty topic follow ids connecting to the server
+     * @param {string} topic 
+     * @param {function(event: string, id: string)} handler 
+     * @returns {busSubscription}
+     */
+    SubscribePresence(topic, handler) {
+        let t = topic ? "$sys.subscribers." + topic : "$sys.presence.*";
+        return this.Subscribe(t, (data) => {
+            if (data.event) {
+                handler(data.event, data.id);
+            } else if (data.topic === "$sys.presence.join") {
+                handler("join", data.id);
+            } else if (data.topic === "$sys.presence.leave") {
+                handler("leave", data.id);
+            }
+        });
+    }
+
     /**
      * PublishToServer publish to a server using addr like localhost:4444 or domain name https
      * @param {string} addr 
@@ -248,6 +453,50 @@ class Bus {
         }
     }
 
+    /**
+     * MatchTopic return true if topic is matched by pattern, levels are separated by '.' or '/'
+     * '*' or '+' match one level, '>' match one or more levels, '#' match zero or more levels
+     * _INBOX topics are only matched by patterns starting with _INBOX, like ksbus.MatchTopic
+     * @param {string} pattern 
+     * @param {string} topic 
+     * @returns {boolean}
+     */
+    MatchTopic(pattern, topic) {
+        if (pattern === topic) {
+            return true;
+        }
+        let p = pattern.split(/[./]/).filter(l => l !== "");
+        let t = topic.split(/[./]/).filter(l => l !== "");
+        if (t[0] === "_INBOX" && p[0] !== "_INBOX") {
+            // replies are only received by their requester
+            return false;
+        }
+        for (let i = 0; i < p.length; i++) {
+            if (p[i] === "#") {
+                return true;
+            }
+            if (p[i] === ">") {
+                return t.length > i;
+            }
+            if (i >= t.length) {
+                return false;
+            }
+            if (p[i] !== "*" && p[i] !== "+" && p[i] !== t[i]) {
+                return false;
+            }
+        }
+        return p.length === t.length;
+    }
+
+    /**
+     * escapeTopicLevel escape separators and wildcards of s so it can be used as one topic level, like ksbus.EscapeTopicLevel
+     * @param {string} s
+     * @returns {string}
+     */
+    static escapeTopicLevel(s) {
+        return s.replace(/[%.\/*+>#]/g, c => "%" + c.charCodeAt(0).toString(16).toUpperCase().padStart(2, "0"));
+    }
+
     makeid() {
         return "10000000-1000-4000-8000-100000000000".replace(/[018]/g, c =>
             (c ^ crypto.getRandomValues(new Uint8Array(1))[0] & 15 >> c / 4).toString(16)
@@ -255,13 +504,73 @@ class Bus {
     }
 }
 
+/**
+ * Codes of the errors sent back by the server
+ */
+Bus.Codes = Object.freeze({
+    BAD_FRAME: "E_BAD_FRAME",
+    BAD_TYPE: "E_BAD_TYPE",
+    ACTION_MISSING: "E_ACTION_MISSING",
+    UNKNOWN_ACTION: "E_UNKNOWN_ACTION",
+    TOPIC_MISSING: "E_TOPIC_MISSING",
+    BAD_TOPIC: "E_BAD_TOPIC",
+    ID_MISSING: "E_ID_MISSING",
+    ADDR_MISSING: "E_ADDR_MISSING",
+    DATA_MISSING: "E_DATA_MISSING",
+    ACK_ID_MISSING: "E_ACK_ID_MISSING",
+    ID_TAKEN: "E_ID_TAKEN",
+    FORBIDDEN: "E_FORBIDDEN",
+    REJECTED: "E_REJECTED",
+    HANDLER_PANIC: "E_HANDLER_PANIC",
+    PUBLISH_FAILED: "E_PUBLISH_FAILED",
+    REPLAY_FAILED: "E_REPLAY_FAILED",
+    SCHEDULE_FULL: "E_SCHEDULE_FULL",
+});
+
+/**
+ * BusError is a message rejected by the server
+ */
+class BusError extends Error {
+    constructor(obj) {
+        super(obj.error);
+        this.name = "BusError";
+        this.code = obj.code;
+        this.action = obj.action;
+        this.field = obj.field;
+        this.target = obj.target;
+    }
+}
+
 /**
  * busSubscription is a class with one method allowing unsubscribing from a topic
  */
 class busSubscription {
-    constructor(cl, topic) {
+    constructor(cl, topic, ackId) {
         this.topic = topic;
         this.parent = cl;
+        this.ackId = ackId;
+    }
+    /**
+     * Ack acknowledge the message received by an ack subscription, it is not redelivered
+     */
+    Ack() {
+        this.send("ack");
+    }
+    /**
+     * Nack reject the message received by an ack subscription, the server redeliver it now
+     */
+    Nack() {
+        this.send("nack");
+    }
+    send(action) {
+        if (this.ackId === undefined) {
+            return;
+        }
+        this.parent.conn.send(JSON.stringify({
+            "action": action,
+            "ack_id": this.ackId,
+            "from": this.parent.Id
+        }));
     }
     /**
      * Unsubscribe take no params, unsubscribe from the topic
@@ -9,10 +9,42 @@ Link: https://kamalshkeir.dev
 import asyncio
 import json
 import random
+import re
 import string
+import urllib.parse
 
 import websockets
 
+# codes of the errors sent back by the server
+E_BAD_FRAME = "E_BAD_FRAME"
+E_BAD_TYPE = "E_BAD_TYPE"
+E_ACTION_MISSING = "E_ACTION_MISSING"
+E_UNKNOWN_ACTION = "E_UNKNOWN_ACTION"
+E_TOPIC_MISSING = "E_TOPIC_MISSING"
+E_BAD_TOPIC = "E_BAD_TOPIC"
+E_ID_MISSING = "E_ID_MISSING"
+E_ADDR_MISSING = "E_ADDR_MISSING"
+E_DATA_MISSING = "E_DATA_MISSING"
+E_ACK_ID_MISSING = "E_ACK_ID_MISSING"
+E_ID_TAKEN = "E_ID_TAKEN"
+E_FORBIDDEN = "E_FORBIDDEN"
+E_REJECTED = "E_REJECTED"
+E_HANDLER_PANIC = "E_HANDLER_PANIC"
+E_PUBLISH_FAILED = "E_PUBLISH_FAILED"
+E_REPLAY_FAILED = "E_REPLAY_FAILED"
+E_SCHEDULE_FULL = "E_SCHEDULE_FULL"
+
+
+class ProtocolError(Exception):
+    """a message rejected by the server, code is one of the E_ constants"""
+
+    def __init__(self, obj):
+        super().__init__(obj.get("error"))
+        self.code = obj.get("code")
+        self.action = obj.get("action")
+        self.field = obj.get("field")
+        self.target = obj.get("target")
+
 
 class Bus:
     def __init__(self, options, block=False):
@@ -22,6 +54,9 @@ class Bus:
         if options.get('Secure', False):
             self.scheme = 'wss://'
         self.full_address = self.scheme + self.Address + self.Path
+        if options.get('Token'):
+            # sent to the server Authenticator
+            self.full_address += '?token=' + urllib.parse.quote(options.get('Token'))
         self.conn = None
         self.topic_handlers = {}
         self.AutoRestart = options.get('AutoRestart', False)
@@ -30,6 +65,7 @@ class Bus:
         self.OnClose = options.get('OnClose', lambda: None)
         self.OnDataWs = options.get('OnDataWs', None)
         self.OnId = options.get('OnId', lambda data: None)
+        self.OnError = options.get('OnError', lambda err: print(f"bus error {err.code}: {err}"))
         self.Id = options.get('Id') or self.makeId(12)
         try:
             if block :
@@ -45,6 +81,12 @@ class Bus:
             await self.sendMessage({"action": "ping", "from": self.Id})
             async for message in self.conn:
                 obj = json.loads(message)
+                if obj.get("data") == "pong" and obj.get("id"):
+                    # the server may bind the connection to the id of an authenticated principal
+                    self.Id = obj["id"]
+                if "code" in obj and "error" in obj and "topic" not in obj:
+                    if self.OnError is not None:
+                        self.OnError(ProtocolError(obj))
                 if self.OnDataWs is not None:
                     self.OnDataWs(obj,self.conn)
                 if "event_id" in obj:
@@ -53,9 +95,10 @@ class Bus:
                     if self.OnId is not None:
                         self.OnId(obj)
                 elif "topic" in obj:
-                    if obj["topic"] in self.topic_handlers:
-                        subs = BusSubscription(self, obj["topic"])
-                        self.topic_handlers[obj["topic"]](obj, subs)
+                    for pattern, handler in list(self.topic_handlers.items()):
+                        if self.MatchTopic(pattern, obj["topic"]):
+                            subs = BusSubscription(self, pattern)
+                            handler(obj, subs)
                 elif "data" in obj and obj["data"] == "pong":
                     if self.OnOpen is not None:
                         self.OnOpen(self)
@@ -78,6 +121,16 @@ class Bus:
             asyncio.create_task(self.sendMessage(payload))
         return subs
 
+    def QueueSubscribe(self, topic, queue, handler):
+        """subscribe as a member of queue group, each message is received by only one member of the group"""
+        payload = {"action": "sub", "topic": topic, "queue": queue, "from": self.Id}
+        subs = BusSubscription(self, topic)
+        self.topic_handlers[topic] = handler
+
+        if self.conn is not None:
+            asyncio.create_task(self.sendMessage(payload))
+        return subs
+
     def Unsubscribe(self, topic):
         payload = {"action": "unsub", "topic": topic, "from": self.Id}
         del self.topic_handlers[topic]
@@ -91,12 +144,19 @@ class Bus:
         except Exception as e:
             print("error sending message:", e)
 
-    def Publish(self, topic, data):
+    def Publish(self, topic, data, retain=False):
         if self.conn is not None:
-            asyncio.create_task(self.sendMessage({"action": "pub", "topic": topic, "data": data, "from": self.Id}))
+            payload = {"action": "pub", "topic": topic, "data": data, "from": self.Id}
+            if retain:
+                payload["retain"] = True
+            asyncio.create_task(self.sendMessage(payload))
         else:
             print("Publish: Not connected to server. Please check the connection.")
 
+    def ClearRetained(self, topic):
+        if self.conn is not None:
+            asyncio.create_task(self.sendMessage({"action": "clear_retained", "topic": topic, "from": self.Id}))
+
     def PublishToID(self, id, data):
         if self.conn is not None:
             asyncio.create_task(self.sendMessage({"action": "pub_id", "id": id, "data": data, "from": self.Id}))
@@ -105,9 +165,29 @@ class Bus:
 
     def RemoveTopic(self, topic):
         if self.conn is not None:
-            asyncio.create_task(self.sendMessage({"action": "remove", "topic": topic, "from": self.Id}))
+            asyncio.create_task(self.sendMessage({"action": "remove_topic", "topic": topic, "from": self.Id}))
             del self.topic_handlers[topic]
 
+    def MatchTopic(self, pattern, topic):
+        """return True if topic is matched by pattern, '*' or '+' match one level, '>' one or more, '#' zero or more"""
+        if pattern == topic:
+            return True
+        p = [l for l in re.split(r"[./]", pattern) if l]
+        t = [l for l in re.split(r"[./]", topic) if l]
+        if t and t[0] == "_INBOX" and (not p or p[0] != "_INBOX"):
+            # replies are only received by their requester
+            return False
+        for i, lvl in enumerate(p):
+            if lvl == "#":
+                return True
+            if lvl == ">":
+                return len(t) > i
+            if i >= len(t):
+                return False
+            if lvl not in ("*", "+") and lvl != t[i]:
+                return False
+        return len(p) == len(t)
+
     def makeId(self, length):
         return "".join(random.choices(string.ascii_letters + string.digits, k=length))
 
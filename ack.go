@@ -0,0 +1,333 @@
+package ksbus
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/kamalshkeir/lg"
+)
+
+var (
+	// DefaultAckTimeout is how long a message sent to an ack subscriber wait for its Ack before being redelivered
+	DefaultAckTimeout = 30 * time.Second
+	// DefaultMaxDeliveries is the number of deliveries of a message not acked before it is dropped to the dead letter topic
+	DefaultMaxDeliveries = 5
+)
+
+// pendingAck is a message sent to an ack subscriber and not acked yet
+type pendingAck struct {
+	id       string
+	sub      Subscriber
+	topic    string
+	data     map[string]any
+	attempts int
+	due      time.Time
+}
+
+// acks track the messages sent to ack subscribers of a bus
+type acks struct {
+	pending       map[string]*pendingAck
+	timeout       time.Duration
+	maxDeliveries int
+	once          sync.Once
+	changed       chan struct{} // signal a new timeout to the redelivery loop
+	mu            sync.Mutex
+}
+
+func (b *Bus) ackTracker() *acks {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.acks == nil {
+		b.acks = &acks{
+			pending:       map[string]*pendingAck{},
+			timeout:       DefaultAckTimeout,
+			maxDeliveries: DefaultMaxDeliveries,
+			changed:       make(chan struct{}, 1),
+		}
+	}
+	return b.acks
+}
+
+// WithAcks set the redelivery timeout and the max deliveries of messages sent to ack subscribers
+func (b *Bus) WithAcks(timeout time.Duration, maxDeliveries int) {
+	a := b.ackTracker()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if timeout > 0 {
+		a.timeout = timeout
+		select {
+		case a.changed <- struct{}{}:
+		default:
+		}
+	}
+	if maxDeliveries > 0 {
+		a.maxDeliveries = maxDeliveries
+	}
+}
+
+// interval return how often due messages are checked, a.mu must be held
+func (a *acks) interval() time.Duration {
+	return max(a.timeout/4, 10*time.Millisecond)
+}
+
+// redeliverLoop check due messages until the bus is closed, the interval follow the timeout set by WithAcks
+func (b *Bus) redeliverLoop(a *acks) {
+	a.mu.Lock()
+	t := time.NewTimer(a.interval())
+	a.mu.Unlock()
+	defer t.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-t.C:
+			b.redeliverDue()
+		case <-a.changed:
+			t.Stop()
+		}
+		a.mu.Lock()
+		t.Reset(a.interval())
+		a.mu.Unlock()
+	}
+}
+
+// next count a delivery of p and return the message to send, a.mu must be held
+func (a *acks) next(p *pendingAck) map[string]any {
+	p.attempts++
+	p.due = time.Now().Add(a.timeout)
+	msg := maps.Clone(p.data)
+	msg["ack_id"] = p.id
+	msg["attempt"] = p.attempts
+	return msg
+}
+
+// trackAck deliver data to the ack subscriber s and keep it until acked
+func (b *Bus) trackAck(s Subscriber, topic string, data map[string]any) error {
+	a := b.ackTracker()
+	a.once.Do(func() {
+		go b.redeliverLoop(a)
+	})
+	p := &pendingAck{
+		id:    GenerateUUID(),
+		sub:   s,
+		topic: topic,
+		// channel subscribers may modify the map they receive
+		data: maps.Clone(data),
+	}
+	a.mu.Lock()
+	a.pending[p.id] = p
+	msg := a.next(p)
+	a.mu.Unlock()
+	return b.sendAck(p, s, msg)
+}
+
+// sendAck send msg, the delivery of p, to s
+func (b *Bus) sendAck(p *pendingAck, s Subscriber, msg map[string]any) error {
+	if s.Ch != nil {
+		select {
+		case s.Ch <- msg:
+		case <-time.After(10 * time.Millisecond):
+			// the subscriber is busy, the message is sent again at the next check without counting this attempt
+			a := b.acks
+			a.mu.Lock()
+			p.attempts--
+			p.due = time.Now()
+			a.mu.Unlock()
+		}
+		return nil
+	}
+	return b.writeTo(s.Conn, msg)
+}
+
+// redeliverDue send again messages not acked in time
+func (b *Bus) redeliverDue() {
+	a := b.acks
+	now := time.Now()
+	var due []*pendingAck
+	a.mu.Lock()
+	for _, p := range a.pending {
+		if now.After(p.due) {
+			due = append(due, p)
+		}
+	}
+	a.mu.Unlock()
+	for _, p := range due {
+		b.redeliver(p)
+	}
+}
+
+// redeliver send p again, to the same id or another member of its queue group, or drop it after maxDeliveries
+func (b *Bus) redeliver(p *pendingAck) {
+	a := b.acks
+	a.mu.Lock()
+	if _, ok := a.pending[p.id]; !ok {
+		// acked meanwhile
+		a.mu.Unlock()
+		return
+	}
+	if p.attempts >= a.maxDeliveries {
+		delete(a.pending, p.id)
+		a.mu.Unlock()
+		b.drop(DropMaxDeliveries, p.topic, p.sub.Id, p.data, p.attempts, nil)
+		return
+	}
+	if expired(p.data) {
+		delete(a.pending, p.id)
+		a.mu.Unlock()
+		b.drop(DropExpired, p.topic, p.sub.Id, p.data, p.attempts, nil)
+		return
+	}
+	s, ok := b.ackTarget(p.sub)
+	if !ok {
+		// nobody to deliver to, the attempt still count so the message end in dead letter
+		p.attempts++
+		p.due = time.Now().Add(a.timeout)
+		a.mu.Unlock()
+		return
+	}
+	p.sub = s
+	msg := a.next(p)
+	a.mu.Unlock()
+	if err := b.sendAck(p, s, msg); err != nil {
+		lg.DebugC("redelivery failed", "topic", p.topic, "id", s.Id, "err", err)
+	}
+}
+
+// ackTarget return the current subscription of sub, it may be on a new connection after a reconnect, or another member of its queue group
+func (b *Bus) ackTarget(sub Subscriber) (Subscriber, bool) {
+	subs, _ := b.topicSubscribers.Get(normalizeTopic(sub.Topic))
+	var member *Subscriber
+	for i, s := range subs {
+		if !s.ack || s.Queue != sub.Queue {
+			continue
+		}
+		if s.Id == sub.Id && s.Conn == sub.Conn && s.Ch == sub.Ch {
+			return s, true
+		}
+		if member == nil && ((s.Id == sub.Id && sub.Conn != nil) || s.Queue != "") {
+			member = &subs[i]
+		}
+	}
+	if member != nil {
+		return *member, true
+	}
+	return sub, false
+}
+
+// ack remove, or with ok false redeliver now, the message ackID sent to the subscriber id
+func (b *Bus) ack(ackID, id string, ok bool) {
+	if b.acks == nil || ackID == "" {
+		return
+	}
+	a := b.acks
+	a.mu.Lock()
+	p, found := a.pending[ackID]
+	if !found || p.sub.Id != id {
+		a.mu.Unlock()
+		return
+	}
+	if ok {
+		delete(a.pending, ackID)
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+	// a channel subscriber calling Nack from its handler is not receiving yet
+	go b.redeliver(p)
+}
+
+// Ack acknowledge the message received by an ack subscriber, it is not redelivered
+func (subs Subscriber) Ack() {
+	subs.bus.ack(subs.ackID, subs.Id, true)
+}
+
+// Nack reject the message received by an ack subscriber, it is redelivered now
+func (subs Subscriber) Nack() {
+	subs.bus.ack(subs.ackID, subs.Id, false)
+}
+
+// SubscribeAck subscribe to topic in at-least-once mode, a message not acked with unsub.Ack is redelivered
+func (b *Bus) SubscribeAck(topic string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return b.subscribeAck(topic, "", fn)
+}
+
+// QueueSubscribeAck is like SubscribeAck for a member of queue group, a message not acked may be redelivered to another member
+func (b *Bus) QueueSubscribeAck(topic, queue string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return b.subscribeAck(topic, queue, fn)
+}
+
+func (b *Bus) subscribeAck(topic, queue string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	sub := Subscriber{
+		Id:    "INTERNAL",
+		Topic: topic,
+		Queue: queue,
+		Ch:    make(chan map[string]any),
+		bus:   b,
+		ack:   true,
+	}
+	b.addSubscriber(sub)
+	go func() {
+		for v := range sub.Ch {
+			s := sub
+			s.ackID, _ = v["ack_id"].(string)
+			b.callHandler(topic, v, s, func() {
+				fn(v, s)
+			})
+		}
+	}()
+	return sub
+}
+
+// SubscribeAck subscribe to topic in at-least-once mode, a message not acked with unsub.Ack is redelivered
+func (s *Server) SubscribeAck(topic string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return s.Bus.SubscribeAck(topic, fn)
+}
+
+// QueueSubscribeAck is like SubscribeAck for a member of queue group, a message not acked may be redelivered to another member
+func (s *Server) QueueSubscribeAck(topic, queue string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return s.Bus.QueueSubscribeAck(topic, queue, fn)
+}
+
+// Ack acknowledge the message received by an ack subscription, it is not redelivered
+func (subs ClientSubscriber) Ack() {
+	subs.client.ack("ack", subs.ackID)
+}
+
+// Nack reject the message received by an ack subscription, the server redeliver it now
+func (subs ClientSubscriber) Nack() {
+	subs.client.ack("nack", subs.ackID)
+}
+
+func (client *Client) ack(action, ackID string) {
+	if ackID == "" {
+		return
+	}
+	err := client.writeJSON(context.Background(), map[string]any{
+		"action": action,
+		"ack_id": ackID,
+		"from":   client.currentID(),
+	})
+	if err != nil {
+		lg.Error("error "+action, "ack_id", ackID, "err", err)
+	}
+}
+
+// SubscribeAck subscribe to topic in at-least-once mode, a message not acked with unsub.Ack is redelivered by the server
+func (client *Client) SubscribeAck(topic string, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
+	return client.subscribeAck(topic, "", handler)
+}
+
+// QueueSubscribeAck is like SubscribeAck for a member of queue group, a message not acked may be redelivered to another member
+func (client *Client) QueueSubscribeAck(topic, queue string, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
+	return client.subscribeAck(topic, queue, handler)
+}
+
+func (client *Client) subscribeAck(topic, queue string, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
+	sub, err := client.subscribeCtx(context.Background(), topic, queue, Replay{}, true, handler)
+	if err != nil {
+		lg.Error("error subscribing", "topic", topic, "err", err)
+	}
+	return sub
+}
@@ -0,0 +1,81 @@
+package ksbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcker(t *testing.T) {
+	tests := []struct {
+		name  string
+		unsub any
+		want  bool
+	}{
+		{"bus subscriber", Subscriber{}, true},
+		{"client subscriber", ClientSubscriber{}, true},
+		{"rpc subscriber", RPCSubscriber{}, false},
+	}
+	for _, tt := range tests {
+		if _, ok := tt.unsub.(Acker); ok != tt.want {
+			t.Errorf("%s: Acker %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestAckBusySubscriberNotCounted(t *testing.T) {
+	bus := New()
+	bus.WithAcks(100*time.Millisecond, 1)
+	got := make(chan map[string]any, 10)
+	first := true
+	bus.SubscribeAck("jobs", func(data map[string]any, unsub Unsub) {
+		if first {
+			// busy while the second message is sent
+			first = false
+			time.Sleep(60 * time.Millisecond)
+		}
+		unsub.(Acker).Ack()
+		got <- data
+	})
+	bus.Publish("jobs", map[string]any{"n": 1})
+	bus.Publish("jobs", map[string]any{"n": 2})
+	for n := 1; n <= 2; n++ {
+		data := receive(t, got)
+		if data["n"] != n || data["attempt"] != 1 {
+			t.Fatalf("got %v, want n %d at attempt 1", data, n)
+		}
+	}
+	if n := bus.Drops()[DropMaxDeliveries]; n != 0 {
+		t.Fatalf("%d messages dropped", n)
+	}
+}
+
+func TestAckTimeoutChangedAfterStart(t *testing.T) {
+	bus := New()
+	got := make(chan map[string]any, 10)
+	bus.SubscribeAck("jobs", func(data map[string]any, unsub Unsub) {
+		got <- data
+	})
+	// the redelivery loop start with the default timeout
+	bus.Publish("jobs", map[string]any{"n": 1})
+	receive(t, got)
+	bus.WithAcks(40*time.Millisecond, 5)
+	bus.Publish("jobs", map[string]any{"n": 2})
+	for {
+		data := receive(t, got)
+		if data["n"] == 2 && data["attempt"] == 2 {
+			return
+		}
+	}
+}
+
+func TestRedeliverLoopStopOnClose(t *testing.T) {
+	bus := New()
+	bus.WithAcks(time.Hour, 1)
+	stopped := make(chan struct{})
+	go func() {
+		bus.redeliverLoop(bus.ackTracker())
+		close(stopped)
+	}()
+	_ = bus.Close()
+	receive(t, stopped)
+}
@@ -0,0 +1,298 @@
+package ksbus
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+// Action is an operation checked by the Authorizer
+type Action string
+
+const (
+	ActionPublish         Action = "pub"
+	ActionSubscribe       Action = "sub"
+	ActionPublishToID     Action = "pub_id"
+	ActionRemoveTopic     Action = "remove_topic"
+	ActionClearRetained   Action = "clear_retained"
+	ActionPublishToServer Action = "pub_server"
+	ActionServerMessage   Action = "server_message"
+)
+
+// ErrForbidden is wrapped by AccessError
+var ErrForbidden = errors.New("forbidden")
+
+// AccessError is returned when a principal is not allowed to do an action on a target
+type AccessError struct {
+	Principal string // empty for anonymous connections
+	Action    Action
+	Target    string // topic, id or server address
+}
+
+func (e *AccessError) Error() string {
+	who := e.Principal
+	if who == "" {
+		who = "anonymous"
+	}
+	return fmt.Sprintf("%s not allowed to %s on %q", who, e.Action, e.Target)
+}
+
+func (e *AccessError) Unwrap() error {
+	return ErrForbidden
+}
+
+// Authorizer return nil if principal, nil for anonymous connections, can do action on target
+type Authorizer func(p *Principal, action Action, target string) error
+
+// ACLRule grant actions to the principals it match, a rule without IDs and Roles match everyone
+//
+// Topic and id patterns accept wildcards and the {id} placeholder replaced by the principal id escaped using EscapeTopicLevel, ex: users.{id}.>
+type ACLRule struct {
+	IDs             []string
+	Roles           []string
+	Publish         []string // topic patterns
+	Subscribe       []string // topic patterns, a wildcard subscription must be covered by one of them
+	PublishToID     []string // id patterns
+	RemoveTopic     []string // topic patterns, also used for ClearRetained
+	PublishToServer []string // server addresses, "*" for all
+}
+
+// ACL is a list of rules, an action is allowed if one rule grant it
+type ACL struct {
+	Rules []ACLRule
+}
+
+// Authorize can be used as ServerOpts.Authorizer
+func (acl *ACL) Authorize(p *Principal, action Action, target string) error {
+	for _, rule := range acl.Rules {
+		if rule.match(p) && rule.allow(p, action, target) {
+			return nil
+		}
+	}
+	return &AccessError{Principal: principalID(p), Action: action, Target: target}
+}
+
+func (r ACLRule) match(p *Principal) bool {
+	if len(r.IDs) == 0 && len(r.Roles) == 0 {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if slices.Contains(r.IDs, p.ID) {
+		return true
+	}
+	for _, role := range p.Roles {
+		if slices.Contains(r.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ACLRule) allow(p *Principal, action Action, target string) bool {
+	var patterns []string
+	switch action {
+	case ActionPublish:
+		patterns = r.Publish
+	case ActionSubscribe:
+		patterns = r.Subscribe
+	case ActionPublishToID:
+		patterns = r.PublishToID
+	case ActionRemoveTopic, ActionClearRetained:
+		patterns = r.RemoveTopic
+	case ActionPublishToServer, ActionServerMessage:
+		return slices.Contains(r.PublishToServer, "*") || slices.Contains(r.PublishToServer, target)
+	}
+	for _, pattern := range patterns {
+		if p != nil {
+			pattern = strings.ReplaceAll(pattern, "{id}", EscapeTopicLevel(p.ID))
+		}
+		if CoversTopic(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// CoversTopic return true if every topic matched by sub is also matched by pattern, sub can be a topic or a wildcard subscription
+func CoversTopic(pattern, sub string) bool {
+	if pattern == sub {
+		return true
+	}
+	p, s := splitTopic(pattern), splitTopic(sub)
+	if !validLevels(p) || !validLevels(s) {
+		return false
+	}
+	for i, lvl := range p {
+		switch lvl {
+		case wildcardAll:
+			return true
+		case wildcardTail:
+			// '#' also match the parent level, '>' does not
+			return len(s) > i && s[i] != wildcardAll
+		}
+		if i >= len(s) {
+			return false
+		}
+		switch s[i] {
+		case wildcardAll, wildcardTail:
+			return false
+		case wildcardOne, wildcardOneMQTT:
+			if lvl != wildcardOne && lvl != wildcardOneMQTT {
+				return false
+			}
+			continue
+		}
+		if lvl != wildcardOne && lvl != wildcardOneMQTT && lvl != s[i] {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func principalID(p *Principal) string {
+	if p == nil {
+		return ""
+	}
+	return p.ID
+}
+
+// authorize check action on target for p using the connection id, request inboxes can be published to and subscribed by the id owning them only
+func (s *Server) authorize(p *Principal, id string, action Action, target string) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	if strings.HasPrefix(normalizeTopic(target), inboxPrefix) && (action == ActionPublish || action == ActionSubscribe) {
+		if IsWildcardTopic(target) {
+			return &AccessError{Principal: principalID(p), Action: action, Target: target}
+		}
+		if action == ActionSubscribe && (id == "" || inboxOwner(normalizeTopic(target)) != EscapeTopicLevel(id)) {
+			return &AccessError{Principal: principalID(p), Action: action, Target: target}
+		}
+		return nil
+	}
+	return s.authorizer(p, action, target)
+}
+
+// authorizeWS check a websocket action of p on conn, target is read from the topic, id or addr field of m
+func (s *Server) authorizeWS(p *Principal, conn *ws.Conn, m map[string]any) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	act, target, ok := wsAction(m)
+	if !ok {
+		return nil
+	}
+	id, _ := s.Bus.allWS.Get(conn)
+	return s.authorize(p, id, act, target)
+}
+
+// wsAction return the checked action of a websocket message and its target, ok is false for actions not checked
+func wsAction(m map[string]any) (act Action, target string, ok bool) {
+	action, _ := m["action"].(string)
+	switch action {
+	case "pub", "publish":
+		act, target = ActionPublish, stringField(m, "topic")
+	case "sub", "subscribe":
+		act, target = ActionSubscribe, stringField(m, "topic")
+	case "remove_topic", "removeTopic":
+		act, target = ActionRemoveTopic, stringField(m, "topic")
+	case "clear_retained", "clearRetained":
+		act, target = ActionClearRetained, stringField(m, "topic")
+	case "pub_id":
+		act, target = ActionPublishToID, stringField(m, "id")
+	case "pub_server":
+		act, target = ActionPublishToServer, stringField(m, "addr")
+	case "server_message", "serverMessage":
+		act, target = ActionServerMessage, stringField(m, "addr")
+	default:
+		return "", "", false
+	}
+	return act, target, true
+}
+
+// senderTopics are the fields of a message holding a topic its receivers publish on, they are chosen by the sender
+var senderTopics = []string{"event_id", "reply_to"}
+
+// authorizeSenderTopics remove from data the sender topics p cannot publish on, receivers would else publish there for p
+func (s *Server) authorizeSenderTopics(p *Principal, id string, data map[string]any) {
+	if s.authorizer == nil {
+		return
+	}
+	for _, k := range senderTopics {
+		v, ok := data[k]
+		if !ok {
+			continue
+		}
+		topic, _ := v.(string)
+		if topic == "" {
+			delete(data, k)
+			continue
+		}
+		if err := s.authorize(p, id, ActionPublish, topic); err != nil {
+			delete(data, k)
+			s.dropDenied(ActionPublish, topic, nil, err)
+		}
+	}
+}
+
+func stringField(m map[string]any, key string) string {
+	v, _ := m[key].(string)
+	return v
+}
+
+// deniedRPC check action on target for the principal of req, a denial is written to resp as a structured error
+func (b *BusRPC) deniedRPC(req *RPCRequest, resp *RPCResponse, action Action, target string) bool {
+	p, id := b.principalRPC(req)
+	err := b.server.authorize(p, id, action, target)
+	if err == nil {
+		return false
+	}
+	b.server.dropDenied(action, target, req.Data, err)
+	resp.Error = err.Error()
+	resp.Code = CodeForbidden
+	resp.Data = map[string]any{
+		"action": string(action),
+		"target": target,
+	}
+	return true
+}
+
+// authorizeSenderTopics remove from the data of req the sender topics its principal cannot publish on
+func (b *BusRPC) authorizeSenderTopics(req *RPCRequest) {
+	p, id := b.principalRPC(req)
+	b.server.authorizeSenderTopics(p, id, req.Data)
+}
+
+// principalRPC return the principal and the id of the client calling with req
+func (b *BusRPC) principalRPC(req *RPCRequest) (*Principal, string) {
+	if rpcConn, ok := b.server.idConnRPC.Get(req.From); ok {
+		return rpcConn.principal, rpcConn.Id
+	}
+	return nil, ""
+}
+
+// accessErrorFromRPC rebuild the AccessError of a denied RPC call
+func accessErrorFromRPC(principal string, resp RPCResponse) error {
+	action, _ := resp.Data["action"].(string)
+	target, _ := resp.Data["target"].(string)
+	return &AccessError{Principal: principal, Action: Action(action), Target: target}
+}
+
+// accessErrorMessage build the structured error sent back to a websocket client
+func accessErrorMessage(err error) map[string]any {
+	msg := map[string]any{
+		"error": err.Error(),
+		"code":  CodeForbidden,
+	}
+	var ae *AccessError
+	if errors.As(err, &ae) {
+		msg["action"] = string(ae.Action)
+		msg["target"] = ae.Target
+	}
+	return msg
+}
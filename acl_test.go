@@ -0,0 +1,235 @@
+package ksbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+func TestCoversTopic(t *testing.T) {
+	tests := []struct {
+		pattern, sub string
+		want         bool
+	}{
+		{"orders.>", "orders.42", true},
+		{"orders.>", "orders.*", true},
+		{"orders.>", "orders.>", true},
+		{"orders.>", "orders.#", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.#", true},
+		{"orders.*", "orders.42", true},
+		{"orders.*", "orders.+", true},
+		{"orders.*", "orders.>", false},
+		{"orders.42", "orders.*", false},
+		{"#", "anything.at.all", true},
+		{"orders.#.x", "orders.1.x", false},
+		{"orders.>", "orders.#.x", false},
+	}
+	for _, tt := range tests {
+		if got := CoversTopic(tt.pattern, tt.sub); got != tt.want {
+			t.Errorf("CoversTopic(%q, %q) = %v, want %v", tt.pattern, tt.sub, got, tt.want)
+		}
+	}
+}
+
+func TestACLAuthorize(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Subscribe: []string{"public.>"}},
+		{Roles: []string{"user"}, Publish: []string{"users.{id}.>"}, Subscribe: []string{"users.{id}.>"}, PublishToID: []string{"support"}},
+		{IDs: []string{"root"}, Publish: []string{"#"}, RemoveTopic: []string{"#"}, PublishToServer: []string{"*"}},
+	}}
+	alice := &Principal{ID: "alice", Roles: []string{"user"}}
+	dotted := &Principal{ID: "a.b", Roles: []string{"user"}}
+	hash := &Principal{ID: "#", Roles: []string{"user"}}
+	root := &Principal{ID: "root"}
+	tests := []struct {
+		name   string
+		p      *Principal
+		action Action
+		target string
+		want   bool
+	}{
+		{"anonymous public", nil, ActionSubscribe, "public.news", true},
+		{"anonymous wildcard public", nil, ActionSubscribe, "public.*", true},
+		{"anonymous private", nil, ActionSubscribe, "users.alice.x", false},
+		{"anonymous publish", nil, ActionPublish, "public.news", false},
+		{"own topic", alice, ActionPublish, "users.alice.x", true},
+		{"other user topic", alice, ActionPublish, "users.bob.x", false},
+		{"own wildcard", alice, ActionSubscribe, "users.alice.*", true},
+		{"own wildcard with parent", alice, ActionSubscribe, "users.alice.#", false},
+		{"too wide wildcard", alice, ActionSubscribe, "users.>", false},
+		{"pub id", alice, ActionPublishToID, "support", true},
+		{"pub id other", alice, ActionPublishToID, "bob", false},
+		{"dotted id own escaped", dotted, ActionPublish, "users.a%2Eb.x", true},
+		{"dotted id other user", dotted, ActionPublish, "users.a.b", false},
+		{"hash id", hash, ActionSubscribe, "users.bob.x", false},
+		{"hash id own", hash, ActionSubscribe, "users.%23.x", true},
+		{"root remove", root, ActionRemoveTopic, "users.alice.x", true},
+		{"root server", root, ActionPublishToServer, "localhost:9313", true},
+		{"user server", alice, ActionPublishToServer, "localhost:9313", false},
+	}
+	for _, tt := range tests {
+		err := acl.Authorize(tt.p, tt.action, tt.target)
+		if (err == nil) != tt.want {
+			t.Errorf("%s: Authorize(%s, %q) = %v, want allowed %v", tt.name, tt.action, tt.target, err, tt.want)
+		}
+		if err != nil && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: err %v is not ErrForbidden", tt.name, err)
+		}
+	}
+}
+
+func TestAuthorizeInbox(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Publish: []string{"#"}, Subscribe: []string{"#"}},
+	}}
+	s := &Server{authorizer: acl.Authorize}
+	alice := &Principal{ID: "alice"}
+	aliceInbox := newInbox("alice")
+	tests := []struct {
+		name   string
+		p      *Principal
+		id     string
+		action Action
+		target string
+		want   bool
+	}{
+		{"owner subscribe", alice, "alice", ActionSubscribe, aliceInbox, true},
+		{"other subscribe", &Principal{ID: "bob"}, "bob", ActionSubscribe, aliceInbox, false},
+		{"anonymous without id", nil, "", ActionSubscribe, aliceInbox, false},
+		{"anonymous owner", nil, "anon1", ActionSubscribe, newInbox("anon1"), true},
+		{"anyone publish", &Principal{ID: "bob"}, "bob", ActionPublish, aliceInbox, true},
+		{"wildcard", alice, "alice", ActionSubscribe, "_INBOX.alice.*", false},
+		{"all inboxes", alice, "alice", ActionSubscribe, "_INBOX.>", false},
+		{"slash separator", &Principal{ID: "bob"}, "bob", ActionSubscribe, "_INBOX/alice/x", false},
+		{"escaped id", &Principal{ID: "a.b"}, "a.b", ActionSubscribe, newInbox("a.b"), true},
+		{"escaped id prefix", &Principal{ID: "a"}, "a", ActionSubscribe, newInbox("a.b"), false},
+	}
+	for _, tt := range tests {
+		err := s.authorize(tt.p, tt.id, tt.action, tt.target)
+		if (err == nil) != tt.want {
+			t.Errorf("%s: authorize(%s, %q) = %v, want allowed %v", tt.name, tt.action, tt.target, err, tt.want)
+		}
+	}
+}
+
+func TestEscapeTopicLevel(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"alice", "alice"},
+		{"a.b", "a%2Eb"},
+		{"a/b", "a%2Fb"},
+		{"*+>#", "%2A%2B%3E%23"},
+		{"50%", "50%25"},
+	}
+	for _, tt := range tests {
+		if got := EscapeTopicLevel(tt.in); got != tt.want {
+			t.Errorf("EscapeTopicLevel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if len(splitTopic(EscapeTopicLevel(tt.in))) != 1 {
+			t.Errorf("EscapeTopicLevel(%q) is not one level", tt.in)
+		}
+	}
+}
+
+func TestRequestWithACL(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Publish: []string{"svc.>"}, Subscribe: []string{"svc.>"}},
+	}}
+	s, addr := newTestServer(t, ServerOpts{
+		Authenticator: func(cred Credentials) (*Principal, error) {
+			return &Principal{ID: cred.Token}, nil
+		},
+		Authorizer: acl.Authorize,
+	})
+	s.HandleRequest("svc.echo", func(req map[string]any) (map[string]any, error) {
+		return map[string]any{"v": req["v"]}, nil
+	})
+	alice := newTestClient(t, addr, ClientConnectOptions{Token: "alice"})
+	eventually(t, func() bool { return alice.currentID() == "alice" })
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := alice.Request(ctx, "svc.echo", map[string]any{"v": "x"})
+	if err != nil || resp["v"] != "x" {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+
+	// another user cannot read alice inboxes
+	errs := make(chan error, 1)
+	bob := newTestClient(t, addr, ClientConnectOptions{Token: "bob", OnError: func(err error) {
+		errs <- err
+	}})
+	eventually(t, func() bool { return bob.currentID() == "bob" })
+	bob.Subscribe(newInbox("alice"), func(data map[string]any, _ ClientSubscriber) {})
+	if err := receive(t, errs); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("err = %v, want ErrForbidden", err)
+	}
+}
+
+func TestAuthorizeSenderTopics(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Publish: []string{"public.>"}, Subscribe: []string{"#"}},
+	}}
+	s, addr := newTestServer(t, ServerOpts{
+		Authenticator: func(cred Credentials) (*Principal, error) {
+			return &Principal{ID: cred.Token}, nil
+		},
+		Authorizer: acl.Authorize,
+	})
+	acks := make(chan map[string]any, 10)
+	for _, topic := range []string{"private.x", "public.ack"} {
+		s.Subscribe(topic, func(data map[string]any, _ Unsub) {
+			acks <- data
+		})
+	}
+	got := make(chan map[string]any, 10)
+	s.Subscribe("public.news", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	// kept is true when the receivers can publish on the topic: an event is acked, a reply_to is delivered
+	tests := []struct {
+		name  string
+		field string
+		topic string
+		kept  bool
+	}{
+		{"event on private topic", "event_id", "private.x", false},
+		{"reply on private topic", "reply_to", "private.x", false},
+		{"event on public topic", "event_id", "public.ack", true},
+		{"reply on inbox", "reply_to", newInbox("bob"), true},
+	}
+	conn := dialRaw(t, addr, http.Header{"Authorization": []string{"Bearer alice"}})
+	for _, tt := range tests {
+		frame, _ := json.Marshal(map[string]any{
+			"action": "pub",
+			"topic":  "public.news",
+			"data":   map[string]any{tt.field: tt.topic},
+		})
+		if err := conn.WriteMessage(ws.TextMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+		data := receive(t, got)
+		kept := false
+		if tt.field == "reply_to" {
+			_, kept = data[tt.field]
+		} else {
+			select {
+			case ack := <-acks:
+				kept = ack["topic"] == tt.topic
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		if kept != tt.kept {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+	select {
+	case data := <-acks:
+		t.Fatalf("message published for the sender: %v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
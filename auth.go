@@ -0,0 +1,119 @@
+package ksbus
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+// DefaultAuthCookie is the cookie read for a token when the request has no bearer token
+var DefaultAuthCookie = "ksbus_token"
+
+// Principal is the identity of an authenticated connection
+type Principal struct {
+	ID     string         // connection id, replace any id sent by the client
+	Roles  []string       // free form, can be used by access control
+	Claims map[string]any // free form
+}
+
+// Credentials are extracted from a websocket upgrade request or sent by a RPC client
+type Credentials struct {
+	Token   string        // bearer token, 'token' query param or auth cookie
+	Request *http.Request // upgrade request, nil for RPC clients
+}
+
+// Authenticator return the principal of a connection, an error refuse the connection
+type Authenticator func(cred Credentials) (*Principal, error)
+
+// credentialsFromRequest read the token from the Authorization bearer header, the 'token' query param or the auth cookie
+func credentialsFromRequest(r *http.Request, cookie string) Credentials {
+	cred := Credentials{Request: r}
+	if h := r.Header.Get("Authorization"); h != "" {
+		if after, ok := strings.CutPrefix(h, "Bearer "); ok {
+			cred.Token = strings.TrimSpace(after)
+			return cred
+		}
+	}
+	if t := r.URL.Query().Get("token"); t != "" {
+		cred.Token = t
+		return cred
+	}
+	if cookie == "" {
+		cookie = DefaultAuthCookie
+	}
+	if c, err := r.Cookie(cookie); err == nil {
+		cred.Token = c.Value
+	}
+	return cred
+}
+
+// authenticate run the authenticator, a nil principal without error mean auth is disabled
+func (s *Server) authenticate(cred Credentials) (*Principal, error) {
+	if s.authenticator == nil {
+		return nil, nil
+	}
+	p, err := s.authenticator(cred)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || p.ID == "" {
+		return nil, ErrUnauthenticated
+	}
+	if p.ID == s.ID {
+		return nil, errors.New("id reserved by the server")
+	}
+	return p, nil
+}
+
+// bindWS bind conn to the id of its principal
+func (s *Server) bindWS(conn *ws.Conn, p *Principal) error {
+	if s.idTaken(p.ID) {
+		return errors.New("ID already exist, should be unique")
+	}
+	s.principals.Set(conn, p)
+	s.Bus.allWS.Set(conn, p.ID)
+	s.Bus.idConn.Set(p.ID, conn)
+	s.announceID(p.ID, true)
+	return nil
+}
+
+// PrincipalOf return the principal bound to a websocket connection
+func (s *Server) PrincipalOf(conn *ws.Conn) (*Principal, bool) {
+	return s.principals.Get(conn)
+}
+
+// principalOfID return the principal bound to the websocket or RPC client using id, nil for anonymous clients
+func (s *Server) principalOfID(id string) *Principal {
+	if conn, ok := s.Bus.idConn.Get(id); ok {
+		p, _ := s.principals.Get(conn)
+		return p
+	}
+	p, _ := s.RPCPrincipalOf(id)
+	return p
+}
+
+// RPCPrincipalOf return the principal bound to a RPC client id
+func (s *Server) RPCPrincipalOf(id string) (*Principal, bool) {
+	if rpcConn, ok := s.idConnRPC.Get(id); ok && rpcConn.principal != nil {
+		return rpcConn.principal, true
+	}
+	return nil, false
+}
+
+// authorizeRPC check the session of req when authentication is enabled and refresh it, req.From is trusted after it
+func (b *BusRPC) authorizeRPC(req *RPCRequest) error {
+	rpcConn, ok := b.server.idConnRPC.Get(req.From)
+	if b.server.authenticator == nil {
+		if ok {
+			rpcConn.touch()
+		}
+		return nil
+	}
+	if !ok || rpcConn.session == "" || rpcConn.session != req.Session {
+		return ErrUnauthenticated
+	}
+	rpcConn.touch()
+	return nil
+}
@@ -0,0 +1,133 @@
+package ksbus
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+func TestCredentialsFromRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		cookie string
+		want   string
+	}{
+		{"bearer", "Bearer abc", "", "", "abc"},
+		{"query", "", "q", "", "q"},
+		{"cookie", "", "", "c", "c"},
+		{"bearer first", "Bearer abc", "q", "c", "abc"},
+		{"not bearer", "Basic abc", "", "", ""},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/ws/bus?token="+tt.query, nil)
+		if tt.query == "" {
+			r.URL.RawQuery = ""
+		}
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: DefaultAuthCookie, Value: tt.cookie})
+		}
+		if got := credentialsFromRequest(r, "").Token; got != tt.want {
+			t.Errorf("%s: token = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       *Principal
+		err     error
+		wantErr bool
+	}{
+		{"principal", &Principal{ID: "alice"}, nil, false},
+		{"refused", nil, errors.New("bad token"), true},
+		{"no principal", nil, nil, true},
+		{"empty id", &Principal{}, nil, true},
+		{"server id", &Principal{ID: "server"}, nil, true},
+	}
+	for _, tt := range tests {
+		s := &Server{ID: "server", authenticator: func(Credentials) (*Principal, error) { return tt.p, tt.err }}
+		p, err := s.authenticate(Credentials{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && p.ID != tt.p.ID {
+			t.Errorf("%s: principal %v", tt.name, p)
+		}
+	}
+}
+
+func TestClientIdBoundByServer(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{
+		Authenticator: func(cred Credentials) (*Principal, error) {
+			if cred.Token != "secret" {
+				return nil, ErrUnauthenticated
+			}
+			return &Principal{ID: "alice"}, nil
+		},
+	})
+	if _, err := NewClient(ClientConnectOptions{Address: addr, Token: "wrong"}); err == nil {
+		t.Fatal("client with a wrong token connected")
+	}
+	// room for every publish, a blocked handler would drop the next ones
+	got := make(chan map[string]any, 20)
+	s.Subscribe("hello", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	c := newTestClient(t, addr, ClientConnectOptions{Id: "mallory", Token: "secret"})
+	// publishes read the id while the pong replace it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			c.Publish("hello", map[string]any{})
+		}
+	}()
+	<-done
+	eventually(t, func() bool { return c.currentID() == "alice" })
+	for range 20 {
+		if data := receive(t, got); data["from"] != "alice" {
+			t.Fatalf("from = %v, want the principal id", data["from"])
+		}
+	}
+}
+
+func TestRejectWSFlushed(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	// like the websocket handler when the principal id is taken while upgrading
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := ws.DefaultUpgraderKSMUX
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.Bus.registerWriter(conn)
+		defer s.Bus.unregisterWriter(conn)
+		s.rejectWS(conn, errorMessage(CodeIDTaken, errors.New("ID already exist, should be unique")))
+	}))
+	defer ts.Close()
+	for range 20 {
+		conn, _, err := ws.DefaultDialer.Dial("ws://"+strings.TrimPrefix(ts.URL, "http://"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var m map[string]any
+		err = conn.ReadJSON(&m)
+		_ = conn.Close()
+		if err != nil || m["code"] != CodeIDTaken {
+			t.Fatalf("got %v, %v, want %s", m, err, CodeIDTaken)
+		}
+	}
+}
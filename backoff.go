@@ -0,0 +1,90 @@
+package ksbus
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// DefaultBackoff is the reconnect policy of clients not setting one, Initial is replaced by RestartEvery when set
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Backoff is a retry policy, the delay start at Initial and is multiplied after each failed attempt up to Max
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64         // 1 keep the delay constant, default 2
+	Jitter      float64         // randomize each delay by +/- this fraction, 0.2 for 20%, spread clients reconnecting together
+	MaxAttempts int             // 0 retry forever
+	Ctx         context.Context // stop retrying when done
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoff.Initial
+	}
+	if b.Multiplier <= 0 {
+		b.Multiplier = 2
+	}
+	if b.Max < b.Initial {
+		b.Max = max(b.Initial, DefaultBackoff.Max)
+	}
+	if b.Jitter < 0 {
+		b.Jitter = 0
+	} else if b.Jitter > 1 {
+		b.Jitter = 1
+	}
+	if b.Ctx == nil {
+		b.Ctx = context.Background()
+	}
+	return b
+}
+
+// Delay return the wait before the attempt following the failed attempt n, starting at 0
+func (b Backoff) Delay(n int) time.Duration {
+	b = b.withDefaults()
+	d := float64(b.Initial)
+	for i := 0; i < n && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	d = min(d, float64(b.Max))
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// wait sleep Delay(n), it return false if Ctx is done before
+func (b Backoff) wait(n int) bool {
+	b = b.withDefaults()
+	t := time.NewTimer(b.Delay(n))
+	defer t.Stop()
+	select {
+	case <-b.Ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Retry call fn until it succeed, it return the last error of fn once MaxAttempts is reached, or the error of Ctx
+func (b Backoff) Retry(fn func() error) error {
+	b = b.withDefaults()
+	for n := 0; ; n++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if b.MaxAttempts > 0 && n+1 >= b.MaxAttempts {
+			return err
+		}
+		if !b.wait(n) {
+			return b.Ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ksbus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 20 * time.Millisecond},
+		{2, 40 * time.Millisecond},
+		{3, 50 * time.Millisecond},
+		{10, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := b.Delay(tt.n); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRetryEvery(t *testing.T) {
+	fail := errors.New("fail")
+	tests := []struct {
+		name      string
+		every     time.Duration
+		maxRetry  []int
+		failures  int
+		wantCalls int
+		maxTime   time.Duration
+	}{
+		{"no wait", 0, nil, 3, 4, 100 * time.Millisecond},
+		{"no wait max", 0, []int{2}, 5, 2, 100 * time.Millisecond},
+		{"every", 10 * time.Millisecond, nil, 2, 3, time.Second},
+		{"every max", 10 * time.Millisecond, []int{3}, 5, 3, time.Second},
+		{"first call", time.Hour, nil, 0, 1, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		calls := 0
+		start := time.Now()
+		RetryEvery(tt.every, func() error {
+			calls++
+			if calls <= tt.failures {
+				return fail
+			}
+			return nil
+		}, tt.maxRetry...)
+		if calls != tt.wantCalls {
+			t.Errorf("%s: %d calls, want %d", tt.name, calls, tt.wantCalls)
+		}
+		if elapsed := time.Since(start); elapsed > tt.maxTime {
+			t.Errorf("%s: took %v", tt.name, elapsed)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	fail := errors.New("fail")
+	calls := 0
+	err := RetryBackoff(Backoff{Initial: time.Millisecond, MaxAttempts: 3}, func() error {
+		calls++
+		return fail
+	})
+	if !errors.Is(err, fail) || calls != 3 {
+		t.Fatalf("err %v after %d calls, want fail after 3", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RetryBackoff(Backoff{Initial: time.Hour, Ctx: ctx}, func() error { return fail })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err %v, want context.Canceled", err)
+	}
+}
@@ -16,11 +16,20 @@
 package ksbus
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kamalshkeir/kmap"
 	"github.com/kamalshkeir/ksmux/ws"
+	"github.com/kamalshkeir/lg"
 )
 
 // Bus type handle all subscriptions, websockets and channels
@@ -28,6 +37,23 @@ type Bus struct {
 	topicSubscribers *kmap.SafeMap[string, []Subscriber]
 	allWS            *kmap.SafeMap[*ws.Conn, string]
 	idConn           *kmap.SafeMap[string, *ws.Conn]
+	patterns         *topicTrie
+	queueCursors     map[string]uint64 // next member of each queue group, by queue@topic
+	cursorsMu        sync.Mutex        // guard queueCursors
+	log              *msgLog
+	retainedMsgs     *kmap.SafeMap[string, map[string]any]
+	writers          *kmap.SafeMap[*ws.Conn, *connWriter]
+	outboundSize     int
+	overflow         OverflowPolicy
+	onOverflow       func(connID string, policy OverflowPolicy, dropped []byte)
+	relay            relay
+	onSubscription   func(topic, id string, joined bool)
+	acks             *acks
+	drops            *kmap.SafeMap[DropReason, *atomic.Uint64]
+	deadLetter       string
+	onHandlerError   HandlerErrorFunc
+	done             chan struct{} // closed by Close, stop the background loops
+	closeOnce        sync.Once
 	mu               sync.RWMutex
 }
 
@@ -37,47 +63,175 @@ func New() *Bus {
 		topicSubscribers: kmap.New[string, []Subscriber](25),
 		allWS:            kmap.New[*ws.Conn, string](25),
 		idConn:           kmap.New[string, *ws.Conn](20),
+		patterns:         newTopicTrie(),
+		queueCursors:     map[string]uint64{},
+		retainedMsgs:     kmap.New[string, map[string]any](10),
+		writers:          kmap.New[*ws.Conn, *connWriter](25),
+		drops:            kmap.New[DropReason, *atomic.Uint64](7),
+		done:             make(chan struct{}),
 	}
 }
 
+// addSubscriber register sub on its topic, wildcard topics are indexed for matching on publish
+func (b *Bus) addSubscriber(sub Subscriber) {
+	sub.Topic = normalizeTopic(sub.Topic)
+	if subs, found := b.topicSubscribers.Get(sub.Topic); found {
+		joined := !slices.ContainsFunc(subs, func(s Subscriber) bool { return s.Id == sub.Id })
+		subs = append(subs, sub)
+		b.topicSubscribers.Set(sub.Topic, subs)
+		if joined && b.onSubscription != nil {
+			b.onSubscription(sub.Topic, sub.Id, true)
+		}
+	} else {
+		b.topicSubscribers.Set(sub.Topic, []Subscriber{sub})
+		if IsWildcardTopic(sub.Topic) {
+			b.patterns.add(sub.Topic)
+		}
+		if b.relay != nil {
+			b.relay.interest(sub.Topic, true)
+		}
+		if b.onSubscription != nil {
+			b.onSubscription(sub.Topic, sub.Id, true)
+		}
+	}
+}
+
+// setSubscribers replace subscribers of topic, the topic is removed when no subscriber left
+func (b *Bus) setSubscribers(topic string, subs []Subscriber) {
+	topic = normalizeTopic(topic)
+	old, _ := b.topicSubscribers.Get(topic)
+	defer b.dropCursors(topic, old, subs)
+	if b.onSubscription != nil {
+		defer b.leftSubscribers(topic, old, subs)
+	}
+	if len(subs) > 0 {
+		b.topicSubscribers.Set(topic, subs)
+		return
+	}
+	b.topicSubscribers.Delete(topic)
+	if IsWildcardTopic(topic) {
+		b.patterns.remove(topic)
+	}
+	if b.relay != nil {
+		b.relay.interest(topic, false)
+	}
+}
+
+// leftSubscribers call onSubscription for ids of old that are not in subs anymore
+func (b *Bus) leftSubscribers(topic string, old, subs []Subscriber) {
+	var left []string
+	for _, o := range old {
+		if slices.Contains(left, o.Id) || slices.ContainsFunc(subs, func(s Subscriber) bool { return s.Id == o.Id }) {
+			continue
+		}
+		left = append(left, o.Id)
+		b.onSubscription(topic, o.Id, false)
+	}
+}
+
+// removeSubscribers remove the subscribers matched by fn from all topics and return their ids
+func (b *Bus) removeSubscribers(fn func(sub Subscriber) bool) []string {
+	var ids []string
+	changed := map[string][]Subscriber{}
+	b.topicSubscribers.Range(func(topic string, subs []Subscriber) bool {
+		kept := make([]Subscriber, 0, len(subs))
+		for _, sub := range subs {
+			if fn(sub) {
+				ids = append(ids, sub.Id)
+				continue
+			}
+			kept = append(kept, sub)
+		}
+		if len(kept) != len(subs) {
+			changed[topic] = kept
+		}
+		return true
+	})
+	for topic, kept := range changed {
+		b.setSubscribers(topic, kept)
+	}
+	return ids
+}
+
+// hasSubscribers return true if a subscriber of this bus or of a cluster peer match topic
+func (b *Bus) hasSubscribers(topic string) bool {
+	return len(b.subscribersFor(topic)) > 0 || (b.relay != nil && b.relay.interested(topic))
+}
+
+// subscribersFor return subscribers of topic, including those subscribed using a matching wildcard
+func (b *Bus) subscribersFor(topic string) []Subscriber {
+	topic = normalizeTopic(topic)
+	subs, _ := b.topicSubscribers.Get(topic)
+	patterns := b.patterns.match(topic)
+	if len(patterns) == 0 {
+		return subs
+	}
+	// keep patterns ordered, so queue groups rotate over members in a stable order
+	sort.Strings(patterns)
+	all := make([]Subscriber, 0, len(subs))
+	all = append(all, subs...)
+	for _, p := range patterns {
+		if p == topic {
+			continue
+		}
+		if psubs, ok := b.topicSubscribers.Get(p); ok {
+			all = append(all, psubs...)
+		}
+	}
+	return all
+}
+
 func (b *Bus) Subscribe(topic string, fn func(data map[string]any, unsub Unsub), onData ...func(data map[string]any)) Unsub {
+	return b.subscribe(topic, "", fn, onData...)
+}
+
+func (b *Bus) subscribe(topic, queue string, fn func(data map[string]any, unsub Unsub), onData ...func(data map[string]any)) Unsub {
 	sub := Subscriber{
 		Id:    "INTERNAL",
 		Topic: topic,
+		Queue: queue,
 		Ch:    make(chan map[string]any),
 		bus:   b,
 	}
 
-	if subs, found := b.topicSubscribers.Get(topic); found {
-		subs = append(subs, sub)
-		b.topicSubscribers.Set(topic, subs)
-	} else {
-		b.topicSubscribers.Set(topic, []Subscriber{sub})
-	}
+	b.addSubscriber(sub)
 
+	var retained []map[string]any
+	if queue == "" {
+		retained = b.retainedFor(topic)
+	}
 	go func() {
+		for _, v := range retained {
+			b.callHandler(topic, v, sub, func() {
+				fn(v, sub)
+			})
+		}
 		for v := range sub.Ch {
-			if len(onData) > 0 {
-				for _, fnData := range onData {
-					if fnData != nil {
-						fnData(v)
+			// a panic of fn must not stop the subscription
+			b.callHandler(topic, v, sub, func() {
+				if len(onData) > 0 {
+					for _, fnData := range onData {
+						if fnData != nil {
+							fnData(v)
+						}
 					}
 				}
-			}
-			if eventID, ok := v["event_id"]; ok {
-				b.Publish(eventID.(string), map[string]any{
-					"ok":   "done",
-					"from": "INTERNAL",
-				})
-				delete(v, "event_id")
-			}
-			fn(v, sub)
+				if eventID, ok := v["event_id"]; ok {
+					b.Publish(eventID.(string), map[string]any{
+						"ok":   "done",
+						"from": "INTERNAL",
+					})
+					delete(v, "event_id")
+				}
+				fn(v, sub)
+			})
 		}
 	}()
 	return sub
 }
 
 func (b *Bus) Unsubscribe(topic string) {
+	topic = normalizeTopic(topic)
 	if subs, ok := b.topicSubscribers.Get(topic); ok {
 		for i, sub := range subs {
 			if sub.Id == "INTERNAL" {
@@ -85,58 +239,170 @@ func (b *Bus) Unsubscribe(topic string) {
 					close(sub.Ch)
 				}
 				subs = append(subs[:i], subs[i+1:]...)
-				b.topicSubscribers.Set(topic, subs)
+				b.setSubscribers(topic, subs)
 			}
 		}
 	}
 }
 
-func (b *Bus) Publish(topic string, data map[string]any) {
+// Publish send data to subscribers of topic, if retain is true data is kept as the last value of topic and sent to new subscribers
+func (b *Bus) Publish(topic string, data map[string]any, retain ...bool) {
+	_ = b.PublishCtx(context.Background(), topic, data, retain...)
+}
+
+// PublishCtx is like Publish but return write errors of websocket subscribers and ctx errors
+func (b *Bus) PublishCtx(ctx context.Context, topic string, data map[string]any, retain ...bool) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	topic = normalizeTopic(topic)
 	if _, ok := data["from"]; !ok {
 		data["from"] = "INTERNAL"
 	}
 	data["topic"] = topic
+	// the replay gate and resuming clients trust the sequence, it is set by the durable log only
+	delete(data, SeqKey)
+	if expired(data) {
+		b.drop(DropExpired, topic, "", data, 0, nil)
+		return nil
+	}
+	if len(retain) > 0 && retain[0] {
+		b.retain(topic, data)
+	}
+	if b.log != nil && b.log.records(topic) {
+		if _, err := b.log.append(topic, data); err != nil {
+			lg.Error("durable log append", "topic", topic, "err", err)
+		}
+	}
 
-	if subs, found := b.topicSubscribers.Get(topic); found {
-		for _, s := range subs {
+	// peers get the message before channel subscribers can modify it, messages from a peer are not forwarded again
+	if _, via := data["via_server"]; !via && b.relay != nil {
+		b.relay.forward(topic, data, len(retain) > 0 && retain[0])
+	}
+
+	var errs []error
+	// a connection or channel subscribed to several matching patterns receive the message once
+	sentConn := map[*ws.Conn]struct{}{}
+	sentCh := map[chan map[string]any]struct{}{}
+	if subs := b.subscribersFor(topic); len(subs) > 0 {
+		deliveries := b.deliveries(topic, subs)
+		// encode once before channel subscribers get the map, connections share the payload
+		// data that is not json is still delivered to channel subscribers, the error is recorded for each connection
+		var payload []byte
+		var encErr error
+		for _, s := range deliveries {
+			if s.Conn != nil {
+				payload, encErr = json.Marshal(data)
+				break
+			}
+		}
+		seq, hasSeq := toUint64(data[SeqKey])
+		for _, s := range deliveries {
+			if err := ctx.Err(); err != nil {
+				errs = append(errs, err)
+				break
+			}
 			if s.Ch != nil {
-				select {
-				case s.Ch <- data:
-				case <-time.After(10 * time.Millisecond):
+				if _, ok := sentCh[s.Ch]; ok {
+					continue
 				}
+				sentCh[s.Ch] = struct{}{}
 			} else if s.Conn != nil {
-				b.mu.Lock()
-				select {
-				case <-time.After(100 * time.Millisecond):
-					b.mu.Unlock()
-					return
-				default:
-					_ = s.Conn.WriteJSON(data)
-					b.mu.Unlock()
+				if _, ok := sentConn[s.Conn]; ok {
+					continue
+				}
+				sentConn[s.Conn] = struct{}{}
+			} else {
+				continue
+			}
+			if s.gate != nil {
+				held, full := s.gate.hold(seq, hasSeq, func() {
+					_ = b.deliver(context.Background(), s, topic, data, payload, encErr)
+				})
+				if full {
+					b.drop(DropSlowConsumer, topic, s.Id, data, 1, nil)
+				}
+				if held {
+					continue
 				}
 			}
+			if err := b.deliver(ctx, s, topic, data, payload, encErr); err != nil {
+				errs = append(errs, fmt.Errorf("subscriber %s: %w", s.Id, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver send data published on topic to the channel or the connection of s, payload is data encoded for connections or encErr if it could not be
+func (b *Bus) deliver(ctx context.Context, s Subscriber, topic string, data map[string]any, payload []byte, encErr error) error {
+	if s.ack {
+		err := b.trackAck(s, topic, data)
+		if s.Ch != nil {
+			return nil
+		}
+		return err
+	}
+	if s.Ch != nil {
+		// each channel subscriber get its own map, handlers modify it while others read it
+		select {
+		case s.Ch <- maps.Clone(data):
+		case <-time.After(10 * time.Millisecond):
+			b.drop(DropFullChannel, topic, s.Id, data, 1, nil)
+		case <-ctx.Done():
 		}
+		return nil
+	}
+	if encErr != nil {
+		b.drop(DropWriteError, topic, s.Id, data, 1, encErr)
+		return encErr
 	}
+	if err := b.writeRaw(s.Conn, payload, false); err != nil {
+		b.drop(writeDropReason(err), topic, s.Id, data, 1, err)
+		return err
+	}
+	return nil
 }
 
 func (b *Bus) PublishToID(id string, data map[string]any) {
+	_ = b.PublishToIDCtx(context.Background(), id, data)
+}
+
+// PublishToIDCtx is like PublishToID but return ErrUnknownID, write errors and ctx errors
+func (b *Bus) PublishToIDCtx(ctx context.Context, id string, data map[string]any) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if _, ok := data["from"]; !ok {
 		data["from"] = "INTERNAL"
 	}
 	data["to_id"] = id
+	delete(data, SeqKey)
+	if expired(data) {
+		b.drop(DropExpired, "", id, data, 0, nil)
+		return nil
+	}
 
-	if conn, ok := b.idConn.Get(id); ok {
-		b.mu.Lock()
-		select {
-		case <-time.After(100 * time.Millisecond):
-			b.mu.Unlock()
-			return
-		default:
-			_ = conn.WriteJSON(data)
-			b.mu.Unlock()
+	conn, ok := b.idConn.Get(id)
+	if !ok {
+		if _, via := data["via_server"]; !via && b.relay != nil && b.relay.forwardToID(id, data) {
+			return nil
 		}
-
+		err := fmt.Errorf("%w: %s", ErrUnknownID, id)
+		b.drop(DropUnknownID, "", id, data, 0, err)
+		return err
+	}
+	if err := b.writeTo(conn, data); err != nil {
+		b.drop(writeDropReason(err), "", id, data, 1, err)
+		return err
 	}
+	return nil
 }
 
 func (b *Bus) PublishWaitRecv(topic string, data map[string]any, onRecv func(data map[string]any), onExpire func(eventId string, topic string)) error {
@@ -204,6 +470,51 @@ free:
 	return nil
 }
 
+// WithDurableLog record messages published on the topics of opts in an append only log on disk
+func (b *Bus) WithDurableLog(opts LogOpts) error {
+	l, err := openMsgLog(opts)
+	if err != nil {
+		return err
+	}
+	b.log = l
+	return nil
+}
+
+// Close stop the redelivery of ack subscribers and close the durable log
+func (b *Bus) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	if b.log == nil {
+		return nil
+	}
+	return b.log.close()
+}
+
+// Replay call fn for each message of topic recorded in the durable log starting at from, until fn return false
+func (b *Bus) Replay(topic string, from Replay, fn func(rec LogRecord) bool) error {
+	if b.log == nil {
+		return fmt.Errorf("durable log not enabled")
+	}
+	return b.log.replay(topic, from, func(rec *LogRecord) bool {
+		return fn(*rec)
+	})
+}
+
 func (b *Bus) RemoveTopic(topic string) {
-	go b.topicSubscribers.Delete(topic)
+	topic = normalizeTopic(topic)
+	if IsWildcardTopic(topic) {
+		b.patterns.remove(topic)
+	}
+	if b.relay != nil {
+		b.relay.interest(topic, false)
+	}
+	old, _ := b.topicSubscribers.Get(topic)
+	if b.onSubscription != nil {
+		b.leftSubscribers(topic, old, nil)
+	}
+	go func() {
+		b.topicSubscribers.Delete(topic)
+		b.dropCursors(topic, old, nil)
+	}()
 }
@@ -0,0 +1,50 @@
+package ksbus
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPublishNotJSONToChannelSubscriber(t *testing.T) {
+	bus := New()
+	got := make(chan map[string]any, 1)
+	bus.Subscribe("funcs", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	fn := func() {}
+	if err := bus.PublishCtx(context.Background(), "funcs", map[string]any{"fn": fn}); err != nil {
+		t.Fatal(err)
+	}
+	if data := receive(t, got); data["fn"] == nil {
+		t.Fatalf("got %v", data)
+	}
+}
+
+func TestPublishCtxCanceled(t *testing.T) {
+	bus := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bus.PublishCtx(ctx, "a", map[string]any{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestPublishNotJSONToConnection(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	c := newTestClient(t, addr)
+	c.Subscribe("funcs", func(data map[string]any, _ ClientSubscriber) {})
+	got := make(chan map[string]any, 1)
+	s.Subscribe("funcs", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	eventually(t, func() bool { return len(s.Bus.subscribersFor("funcs")) == 2 })
+	err := s.PublishCtx(context.Background(), "funcs", map[string]any{"fn": func() {}})
+	if err == nil {
+		t.Fatal("want the encoding error of the connection")
+	}
+	receive(t, got)
+	if s.Bus.Drops()[DropWriteError] != 1 {
+		t.Fatalf("write_error drops = %d, want 1", s.Bus.Drops()[DropWriteError])
+	}
+}
@@ -1,40 +1,75 @@
 package ksbus
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kamalshkeir/kmap"
+	"github.com/kamalshkeir/ksmux/jsonencdec"
 	"github.com/kamalshkeir/ksmux/ws"
 	"github.com/kamalshkeir/lg"
 )
 
 type Client struct {
-	Id            string
-	ServerAddr    string
-	onDataWS      func(data map[string]any, conn *ws.Conn) error
-	onId          func(data map[string]any, unsub ClientSubscriber)
-	onClose       func()
-	RestartEvery  time.Duration
-	Conn          *ws.Conn
-	Autorestart   bool
-	Done          chan struct{}
-	topicHandlers *kmap.SafeMap[string, func(map[string]any, ClientSubscriber)]
+	Id             string
+	ServerAddr     string
+	onDataWS       func(data map[string]any, conn *ws.Conn) error
+	onId           func(data map[string]any, unsub ClientSubscriber)
+	onClose        func()
+	RestartEvery   time.Duration
+	Conn           *ws.Conn
+	Autorestart    bool
+	Done           chan struct{}
+	topicHandlers  *kmap.SafeMap[string, func(map[string]any, ClientSubscriber)]
+	topicQueues    *kmap.SafeMap[string, string]
+	ackTopics      *kmap.SafeMap[string, struct{}]
+	lastSeq        atomic.Uint64
+	wmu            sync.Mutex
+	idMu           sync.RWMutex // guard Id, the server may bind the connection to another id
+	opts           ClientConnectOptions
+	onReconnect    func()
+	onDisconnect   func(err error)
+	closing        atomic.Bool
+	backoff        Backoff
+	cancel         context.CancelFunc
+	outbox         *outbox
+	onHandlerError HandlerErrorFunc
+	onError        func(err error)
 }
 
 type ClientConnectOptions struct {
-	Id           string
-	Address      string
-	Secure       bool
-	Path         string // default ksbus.ServerPath
-	Autorestart  bool
-	RestartEvery time.Duration
-	OnDataWs     func(data map[string]any, conn *ws.Conn) error
-	OnId         func(data map[string]any, unsub ClientSubscriber)
-	OnClose      func()
+	Id             string
+	Address        string
+	Secure         bool
+	Path           string // default ksbus.ServerPath
+	Autorestart    bool
+	RestartEvery   time.Duration
+	Reconnect      *Backoff // reconnect policy when Autorestart, default DefaultBackoff starting at RestartEvery
+	OnDataWs       func(data map[string]any, conn *ws.Conn) error
+	OnId           func(data map[string]any, unsub ClientSubscriber)
+	OnClose        func()
+	Token          string      // sent as Authorization bearer header to the server Authenticator
+	Header         http.Header // extra headers of the websocket upgrade request, cookies for example
+	OnDisconnect   func(err error)
+	OnReconnect    func()           // called once subscriptions are restored
+	OnHandlerError HandlerErrorFunc // receive the panics of handlers, they are logged by default
+	// OnError receive the errors sent back by the server, a *ProtocolError or a *AccessError for E_FORBIDDEN, they are logged by default
+	OnError func(err error)
+	// ResumeFromLastSeq replay, after a reconnect, the durable log messages published since LastSeq
+	ResumeFromLastSeq bool
+	// OfflineBuffer is the max number of publishes queued while reconnecting, 0 disable the buffer
+	OfflineBuffer int
+	// OfflineSpool is a file where queued publishes are kept instead of memory, they survive a restart of the client
+	OfflineSpool string
 }
 
 type ClientSubscriber struct {
@@ -43,6 +78,7 @@ type ClientSubscriber struct {
 	Topic  string
 	Ch     chan map[string]any
 	Conn   *ws.Conn
+	ackID  string // ack_id of the message given to the handler
 }
 
 func (subs ClientSubscriber) Unsubscribe() {
@@ -50,33 +86,75 @@ func (subs ClientSubscriber) Unsubscribe() {
 }
 
 func NewClient(opts ClientConnectOptions) (*Client, error) {
+	backoff := reconnectPolicy(opts.Reconnect, opts.RestartEvery)
 	if opts.Autorestart && opts.RestartEvery == 0 {
-		opts.RestartEvery = 10 * time.Second
+		opts.RestartEvery = backoff.Initial
 	}
 	if opts.OnDataWs == nil {
 		opts.OnDataWs = func(data map[string]any, conn *ws.Conn) error { return nil }
 	}
 	cl := &Client{
-		Id:            opts.Id,
-		Autorestart:   opts.Autorestart,
-		RestartEvery:  opts.RestartEvery,
-		topicHandlers: kmap.New[string, func(map[string]any, ClientSubscriber)](20),
-		onDataWS:      opts.OnDataWs,
-		onId:          opts.OnId,
-		onClose:       opts.OnClose,
-		Done:          make(chan struct{}),
+		Id:             opts.Id,
+		Autorestart:    opts.Autorestart,
+		RestartEvery:   opts.RestartEvery,
+		topicHandlers:  kmap.New[string, func(map[string]any, ClientSubscriber)](20),
+		topicQueues:    kmap.New[string, string](5),
+		ackTopics:      kmap.New[string, struct{}](5),
+		onDataWS:       opts.OnDataWs,
+		onId:           opts.OnId,
+		onClose:        opts.OnClose,
+		onReconnect:    opts.OnReconnect,
+		onDisconnect:   opts.OnDisconnect,
+		onHandlerError: opts.OnHandlerError,
+		onError:        opts.OnError,
+		Done:           make(chan struct{}),
 	}
 	if cl.Id == "" {
 		cl.Id = GenerateUUID()
 	}
+	cl.opts = opts
+	if opts.OfflineBuffer > 0 {
+		cl.outbox = newOutbox(opts.OfflineBuffer, opts.OfflineSpool)
+	}
+	backoff.Ctx, cl.cancel = context.WithCancel(backoff.Ctx)
+	cl.backoff = backoff
 	err := cl.connect(opts)
 	if lg.CheckError(err) {
+		cl.cancel()
 		return nil, err
 	}
+	cl.flushOutbox()
+	cl.handle()
 	return cl, nil
 }
 
+// reconnectPolicy return the policy used to retry connecting, based on DefaultBackoff when b is nil
+func reconnectPolicy(b *Backoff, restartEvery time.Duration) Backoff {
+	if b != nil {
+		return b.withDefaults()
+	}
+	policy := DefaultBackoff
+	if restartEvery > 0 {
+		policy.Initial = restartEvery
+	}
+	return policy.withDefaults()
+}
+
+// connect dial the server, retrying with the reconnect policy when Autorestart
 func (client *Client) connect(opts ClientConnectOptions) error {
+	if !client.Autorestart {
+		return client.dial(opts)
+	}
+	return client.backoff.Retry(func() error {
+		err := client.dial(opts)
+		if err != nil {
+			lg.Info("Connection failed", "addr", opts.Address, "err", err)
+		}
+		return err
+	})
+}
+
+func (client *Client) dial(opts ClientConnectOptions) error {
 	sch := "ws"
 	if opts.Secure {
 		sch = "wss"
@@ -89,13 +167,15 @@ func (client *Client) connect(opts ClientConnectOptions) error {
 	}
 	u := url.URL{Scheme: sch, Host: opts.Address, Path: spath}
 	client.ServerAddr = u.String()
-	c, resp, err := ws.DefaultDialer.Dial(u.String(), nil)
+	header := http.Header{}
+	for k, v := range opts.Header {
+		header[k] = v
+	}
+	if opts.Token != "" {
+		header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	c, resp, err := ws.DefaultDialer.DialContext(client.backoff.Ctx, u.String(), header)
 	if err != nil {
-		if client.Autorestart {
-			lg.Info("Connection failed, retrying in", "seconds", client.RestartEvery.Seconds())
-			time.Sleep(client.RestartEvery)
-			return client.connect(opts)
-		}
 		if err == ws.ErrBadHandshake {
 			lg.DebugC("handshake failed with status", "status", resp.StatusCode)
 			return err
@@ -108,48 +188,143 @@ func (client *Client) connect(opts ClientConnectOptions) error {
 			return err
 		}
 	}
+	client.wmu.Lock()
+	// Close ran while dialing, the new connection is not used
+	if client.closing.Load() {
+		client.wmu.Unlock()
+		_ = c.Close()
+		return ErrClosed
+	}
 	client.Conn = c
+	client.wmu.Unlock()
 
-	_ = c.WriteJSON(map[string]any{
+	_ = client.writeJSON(context.Background(), map[string]any{
 		"action": "ping",
-		"from":   client.Id,
+		"from":   client.currentID(),
 	})
-	client.handle()
 	lg.Printfs("client connected to %s\n", u.String())
 	return nil
 }
 
+// reconnect dial the server again keeping the options and the id of the client, then restore its subscriptions
+func (client *Client) reconnect(cause error) bool {
+	if client.onDisconnect != nil {
+		client.onDisconnect(cause)
+	}
+	lg.Info("Connection lost, attempting to reconnect", "err", cause)
+	// writes fail fast with ErrClosed until the new connection is set
+	client.wmu.Lock()
+	if client.Conn != nil {
+		_ = client.Conn.Close()
+		client.Conn = nil
+	}
+	client.wmu.Unlock()
+	// jitter the first attempt too, clients of a restarting server would else reconnect together
+	if !client.backoff.wait(0) {
+		return false
+	}
+	opts := client.opts
+	opts.Id = client.currentID()
+	if err := client.connect(opts); err != nil {
+		lg.Error("Failed to reconnect", "err", err)
+		return false
+	}
+	client.resubscribe()
+	client.flushOutbox()
+	lg.Info("Successfully reconnected")
+	if client.onReconnect != nil {
+		client.onReconnect()
+	}
+	return true
+}
+
+// resubscribe send again a sub for every topic having a handler, resuming from LastSeq if ResumeFromLastSeq is set
+func (client *Client) resubscribe() {
+	for _, topic := range client.topicHandlers.Keys() {
+		data := map[string]any{
+			"action": "sub",
+			"topic":  topic,
+			"from":   client.currentID(),
+		}
+		queue, isQueue := client.topicQueues.Get(topic)
+		if isQueue {
+			data["queue"] = queue
+		}
+		if _, ok := client.ackTopics.Get(topic); ok {
+			data["ack"] = true
+		}
+		// queue members would all get the replay
+		if seq := client.lastSeq.Load(); client.opts.ResumeFromLastSeq && seq > 0 && !isQueue {
+			data["from_seq"] = seq + 1
+		}
+		if err := client.writeJSON(context.Background(), data); err != nil {
+			lg.Error("error resubscribing", "topic", topic, "err", err)
+		}
+	}
+}
+
+// OnReconnect set the callback called after a reconnect, once subscriptions are restored
+func (client *Client) OnReconnect(fn func()) {
+	client.onReconnect = fn
+}
+
+// OnDisconnect set the callback called when the connection is lost
+func (client *Client) OnDisconnect(fn func(err error)) {
+	client.onDisconnect = fn
+}
+
+// OnError set the function receiving the errors sent back by the server, a *ProtocolError or a *AccessError for E_FORBIDDEN
+func (client *Client) OnError(fn func(err error)) {
+	client.onError = fn
+}
+
 func (client *Client) handle() {
 	client.handleData(func(data map[string]any, sub ClientSubscriber) {
-		if v, ok := data["to_id"]; ok && client.onId != nil && v.(string) == client.Id {
+		if err, ok := protocolErrorFromMessage(client.currentID(), data); ok {
+			if client.onError != nil {
+				client.onError(err)
+			} else {
+				lg.Error("bus error", "err", err)
+			}
+		}
+		if v, ok := data["to_id"]; ok && client.onId != nil && v.(string) == client.currentID() {
 			delete(data, "to_id")
 			client.onId(data, sub)
 		}
+		trackSeq(&client.lastSeq, data)
 		v1, okTopic := data["topic"]
 		eventId, okEvent := data["event_id"]
 		if okEvent {
 			client.Publish(eventId.(string), map[string]any{
 				"ok":   "done",
-				"from": client.Id,
+				"from": client.currentID(),
 			})
 		}
 		found := false
 		if okTopic {
 			if vv, ok := v1.(string); ok {
-				if fn, ok := client.topicHandlers.Get(vv); ok {
+				for _, fn := range client.handlersFor(vv) {
 					found = true
-					fn(data, sub)
+					client.callHandler(vv, data, sub, func() {
+						fn(data, sub)
+					})
 				}
 			}
 		}
 		if dd, ok := data["data"]; ok {
 			if dd == "pong" {
+				// the server may bind the connection to another id, the one of an authenticated principal
+				if id, ok := data["id"].(string); ok && id != "" {
+					client.idMu.Lock()
+					client.Id = id
+					client.idMu.Unlock()
+				}
 				lg.Info("connected to server bus with success")
 				return
 			}
 		}
 		if !found {
-			err := client.onDataWS(data, client.Conn)
+			err := client.onDataWS(data, sub.Conn)
 			if lg.CheckError(err) {
 				return
 			}
@@ -157,54 +332,157 @@ func (client *Client) handle() {
 	})
 }
 
+// currentID return the id of the client, the one bound by the server once connected
+func (client *Client) currentID() string {
+	client.idMu.RLock()
+	defer client.idMu.RUnlock()
+	return client.Id
+}
+
+// conn return the current connection, replaced on reconnect and set to nil once closed
+func (client *Client) conn() *ws.Conn {
+	client.wmu.Lock()
+	defer client.wmu.Unlock()
+	return client.Conn
+}
+
+// handlersFor return handlers of topic, including those subscribed using a matching wildcard
+func (client *Client) handlersFor(topic string) []func(map[string]any, ClientSubscriber) {
+	var fns []func(map[string]any, ClientSubscriber)
+	client.topicHandlers.Range(func(pattern string, fn func(map[string]any, ClientSubscriber)) bool {
+		if MatchTopic(pattern, topic) {
+			fns = append(fns, fn)
+		}
+		return true
+	})
+	return fns
+}
+
 func (client *Client) Subscribe(topic string, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
-	id := client.Id
+	return client.subscribe(topic, "", Replay{}, handler)
+}
+
+// QueueSubscribe subscribe to topic as a member of queue group, each message is received by only one member of the group
+func (client *Client) QueueSubscribe(topic, queue string, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
+	return client.subscribe(topic, queue, Replay{}, handler)
+}
+
+// SubscribeReplay subscribe to topic and receive first the messages recorded in the server durable log starting at from
+func (client *Client) SubscribeReplay(topic string, from Replay, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
+	return client.subscribe(topic, "", from, handler)
+}
+
+// LastSeq return the last durable log sequence received, can be used to resume using SubscribeReplay after a restart
+func (client *Client) LastSeq() uint64 {
+	return client.lastSeq.Load()
+}
+
+// SubscribeCtx is like Subscribe but return the error if the subscription could not be sent
+func (client *Client) SubscribeCtx(ctx context.Context, topic string, handler func(data map[string]any, unsub ClientSubscriber)) (ClientSubscriber, error) {
+	return client.subscribeCtx(ctx, topic, "", Replay{}, false, handler)
+}
+
+func (client *Client) subscribe(topic, queue string, from Replay, handler func(data map[string]any, unsub ClientSubscriber)) ClientSubscriber {
+	sub, err := client.subscribeCtx(context.Background(), topic, queue, from, false, handler)
+	if err != nil {
+		lg.Error("error subscribing", "topic", topic, "err", err)
+	}
+	return sub
+}
+
+func (client *Client) subscribeCtx(ctx context.Context, topic, queue string, from Replay, ack bool, handler func(data map[string]any, unsub ClientSubscriber)) (ClientSubscriber, error) {
+	id := client.currentID()
 	data := map[string]any{
 		"action": "sub",
 		"topic":  topic,
 		"from":   id,
 	}
-
-	err := client.Conn.WriteJSON(data)
-	if err != nil {
-		lg.Error("error subscribing", "topic", topic, "err", err)
-		return ClientSubscriber{
-			client: client,
-			Id:     id,
-			Topic:  topic,
-			Conn:   client.Conn,
-		}
+	if queue != "" {
+		data["queue"] = queue
+	}
+	if ack {
+		data["ack"] = true
 	}
+	if from.Seq > 0 {
+		data["from_seq"] = from.Seq
+	} else if !from.Since.IsZero() {
+		data["since"] = from.Since.UnixMilli()
+	}
+	// handler must be set before replayed messages arrive
 	client.topicHandlers.Set(topic, handler)
-	return ClientSubscriber{
+	if queue != "" {
+		client.topicQueues.Set(topic, queue)
+	} else {
+		client.topicQueues.Delete(topic)
+	}
+	if ack {
+		client.ackTopics.Set(topic, struct{}{})
+	} else {
+		client.ackTopics.Delete(topic)
+	}
+
+	sub := ClientSubscriber{
 		client: client,
 		Id:     id,
 		Topic:  topic,
-		Conn:   client.Conn,
+		Conn:   client.conn(),
+	}
+	err := client.writeJSON(ctx, data)
+	if err != nil {
+		client.topicHandlers.Delete(topic)
+		client.topicQueues.Delete(topic)
+		client.ackTopics.Delete(topic)
+		return sub, err
 	}
+	return sub, nil
 }
 
 func (client *Client) Unsubscribe(topic string) {
 	data := map[string]any{
 		"action": "unsub",
 		"topic":  topic,
-		"from":   client.Id,
+		"from":   client.currentID(),
 	}
-	err := client.Conn.WriteJSON(data)
+	client.topicHandlers.Delete(topic)
+	client.topicQueues.Delete(topic)
+	client.ackTopics.Delete(topic)
+	err := client.writeJSON(context.Background(), data)
 	if err != nil {
 		lg.Error("error unsub", "topic", topic, "err", err, "data", data)
 		return
 	}
 }
 
-func (client *Client) Publish(topic string, data map[string]any) {
+// Publish send data to subscribers of topic, if retain is true data is kept as the last value of topic and sent to new subscribers
+func (client *Client) Publish(topic string, data map[string]any, retain ...bool) {
+	_ = client.PublishCtx(context.Background(), topic, data, retain...)
+}
+
+// PublishCtx is like Publish but return write errors, ErrClosed and ctx errors, ctx deadline is used as write deadline
+func (client *Client) PublishCtx(ctx context.Context, topic string, data map[string]any, retain ...bool) error {
 	data = map[string]any{
 		"data":   data,
 		"action": "pub",
 		"topic":  topic,
-		"from":   client.Id,
+		"from":   client.currentID(),
+	}
+	if len(retain) > 0 && retain[0] {
+		data["retain"] = true
+	}
+	return client.publishFrame(ctx, data)
+}
+
+// ClearRetained remove the last value retained on topic, subscribers are kept
+func (client *Client) ClearRetained(topic string) {
+	data := map[string]any{
+		"action": "clear_retained",
+		"topic":  topic,
+		"from":   client.currentID(),
+	}
+	err := client.writeJSON(context.Background(), data)
+	if err != nil {
+		lg.ErrorC("error ClearRetained", "err", err, "data", data)
 	}
-	_ = client.Conn.WriteJSON(data)
 }
 
 func (client *Client) PublishToServer(addr string, data map[string]any, secure ...bool) {
@@ -212,28 +490,33 @@ func (client *Client) PublishToServer(addr string, data map[string]any, secure .
 		"action": "pub_server",
 		"data":   data,
 		"addr":   addr,
-		"from":   client.Id,
+		"from":   client.currentID(),
 	}
 	if len(secure) > 0 && secure[0] {
 		data["secure"] = true
 	}
 
-	_ = client.Conn.WriteJSON(data)
+	_ = client.writeJSON(context.Background(), data)
 }
 
 func (client *Client) PublishToID(id string, data map[string]any) {
+	_ = client.PublishToIDCtx(context.Background(), id, data)
+}
+
+// PublishToIDCtx is like PublishToID but return write errors, ErrClosed and ctx errors, ctx deadline is used as write deadline
+func (client *Client) PublishToIDCtx(ctx context.Context, id string, data map[string]any) error {
 	data = map[string]any{
 		"data":   data,
 		"action": "pub_id",
 		"id":     id,
-		"from":   client.Id,
+		"from":   client.currentID(),
 	}
-	_ = client.Conn.WriteJSON(data)
+	return client.publishFrame(ctx, data)
 }
 
 func (client *Client) PublishWaitRecv(topic string, data map[string]any, onRecv func(data map[string]any), onExpire func(eventId string, topic string)) {
 	eventId := GenerateUUID()
-	data["from"] = client.Id
+	data["from"] = client.currentID()
 	data["event_id"] = eventId
 	data["topic"] = topic
 	done := make(chan struct{})
@@ -263,7 +546,7 @@ free:
 
 func (client *Client) PublishToIDWaitRecv(id string, data map[string]any, onRecv func(data map[string]any), onExpire func(eventId string, id string)) {
 	eventId := GenerateUUID()
-	data["from"] = client.Id
+	data["from"] = client.currentID()
 	data["event_id"] = eventId
 	data["id"] = id
 	done := make(chan struct{})
@@ -295,9 +578,9 @@ func (client *Client) RemoveTopic(topic string) {
 	data := map[string]any{
 		"action": "removeTopic",
 		"topic":  topic,
-		"from":   client.Id,
+		"from":   client.currentID(),
 	}
-	err := client.Conn.WriteJSON(data)
+	err := client.writeJSON(context.Background(), data)
 	if err != nil {
 		lg.ErrorC("error RemoveTopic", "err", err, "data", data)
 		return
@@ -306,18 +589,28 @@ func (client *Client) RemoveTopic(topic string) {
 }
 
 func (client *Client) Close() error {
+	client.closing.Store(true)
+	client.cancel()
 	if client.onClose != nil {
 		client.onClose()
 	}
+	client.wmu.Lock()
+	if client.Conn == nil {
+		client.wmu.Unlock()
+		return ErrClosed
+	}
 	err := client.Conn.WriteMessage(ws.CloseMessage, ws.FormatCloseMessage(ws.CloseNormalClosure, ""))
 	if err != nil {
+		client.wmu.Unlock()
 		return err
 	}
 	err = client.Conn.Close()
 	if err != nil {
+		client.wmu.Unlock()
 		return err
 	}
 	client.Conn = nil
+	client.wmu.Unlock()
 	<-client.Done
 	return nil
 }
@@ -337,51 +630,87 @@ func (client *Client) Run() {
 	}
 }
 
+// writeJSON serialize writes on the connection, ctx deadline is used as write deadline
+func (client *Client) writeJSON(ctx context.Context, v any) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client.wmu.Lock()
+	defer client.wmu.Unlock()
+	conn := client.Conn
+	if conn == nil {
+		return ErrClosed
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	if err := conn.WriteJSON(v); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if errors.Is(err, ws.ErrCloseSent) || errors.Is(err, net.ErrClosed) {
+			return fmt.Errorf("%w: %v", ErrClosed, err)
+		}
+		return err
+	}
+	return nil
+}
+
 func (client *Client) handleData(fn func(data map[string]any, sub ClientSubscriber)) {
 	go func() {
-		defer close(client.Done)
-		for {
-			message := map[string]any{}
+		defer func() {
+			// writes fail with ErrClosed once the connection is not read anymore
+			client.wmu.Lock()
 			if client.Conn != nil {
-				err := client.Conn.ReadJSON(&message)
-				if err != nil && (err == ws.ErrCloseSent || strings.Contains(err.Error(), "forcibly closed")) {
-					if client.Autorestart {
-						lg.Info("Connection lost, attempting to reconnect in", "seconds", client.RestartEvery.Seconds())
-						time.Sleep(client.RestartEvery)
-						opts := ClientConnectOptions{
-							Address:      client.ServerAddr,
-							Autorestart:  client.Autorestart,
-							RestartEvery: client.RestartEvery,
-							OnDataWs:     client.onDataWS,
-							OnId:         client.onId,
-							OnClose:      client.onClose,
-						}
-						if err := client.connect(opts); err != nil {
-							lg.Error("Failed to reconnect", "err", err)
-							continue
-						}
-						lg.Info("Successfully reconnected")
-						continue
-					} else {
-						lg.Printfs("rdClosed connection error:%v\n", err)
-						return
-					}
-				}
-				err = client.onDataWS(message, client.Conn)
-				if err == nil {
-					sub := ClientSubscriber{
-						client: client,
-						Conn:   client.Conn,
-					}
-					if v, ok := message["topic"]; ok {
-						sub.Topic = v.(string)
-					}
-					fn(message, sub)
-				}
-			} else {
+				_ = client.Conn.Close()
+				client.Conn = nil
+			}
+			client.wmu.Unlock()
+			close(client.Done)
+		}()
+		for {
+			conn := client.conn()
+			if conn == nil {
 				lg.Printfs("rdhandleData error: no connection\n")
 				return
 			}
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				if client.outbox != nil {
+					client.outbox.disconnected()
+				}
+				// a failed connection cannot be read again
+				if client.closing.Load() || !client.Autorestart {
+					lg.Printfs("rdClosed connection error:%v\n", err)
+					return
+				}
+				if !client.reconnect(err) {
+					return
+				}
+				continue
+			}
+			// a frame that is not a json object does not break the connection
+			message := map[string]any{}
+			if err := jsonencdec.DefaultUnmarshal(raw, &message); err != nil {
+				lg.Error("bus malformed frame", "err", err)
+				continue
+			}
+			sub := ClientSubscriber{
+				client: client,
+				Conn:   conn,
+			}
+			sub.Topic, _ = message["topic"].(string)
+			sub.ackID, _ = message["ack_id"].(string)
+			// a panic of OnDataWs or OnId must not stop the read loop
+			client.callHandler(sub.Topic, message, sub, func() {
+				if err := client.onDataWS(message, conn); err == nil {
+					fn(message, sub)
+				}
+			})
 		}
 	}()
 }
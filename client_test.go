@@ -0,0 +1,136 @@
+package ksbus
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastReconnect retry every 10ms
+var fastReconnect = &Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 1}
+
+func TestClientMalformedFrame(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	var disconnects atomic.Int32
+	c := newTestClient(t, addr, ClientConnectOptions{
+		Id:           "alice",
+		Autorestart:  true,
+		Reconnect:    fastReconnect,
+		OnDisconnect: func(error) { disconnects.Add(1) },
+	})
+	got := make(chan map[string]any, 1)
+	c.Subscribe("news", func(data map[string]any, _ ClientSubscriber) {
+		got <- data
+	})
+	eventually(t, func() bool { return s.Bus.hasSubscribers("news") })
+	conn, _ := s.Bus.idConn.Get("alice")
+	for _, frame := range []string{"not json", "[1, 2]", `"pong"`, ""} {
+		if err := s.Bus.writeRaw(conn, []byte(frame), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Publish("news", map[string]any{"n": 1})
+	if data := receive(t, got); data["n"] != float64(1) {
+		t.Fatalf("got %v", data)
+	}
+	if n := disconnects.Load(); n != 0 {
+		t.Fatalf("malformed frames reconnected the client %d times", n)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	reconnected := make(chan struct{}, 1)
+	c := newTestClient(t, addr, ClientConnectOptions{
+		Id:          "alice",
+		Autorestart: true,
+		Reconnect:   fastReconnect,
+		OnReconnect: func() { reconnected <- struct{}{} },
+	})
+	got := make(chan map[string]any, 1)
+	c.Subscribe("news", func(data map[string]any, _ ClientSubscriber) {
+		got <- data
+	})
+	eventually(t, func() bool { return s.Bus.hasSubscribers("news") })
+	old, _ := s.Bus.idConn.Get("alice")
+	_ = old.Close()
+	receive(t, reconnected)
+	eventually(t, func() bool {
+		conn, ok := s.Bus.idConn.Get("alice")
+		return ok && conn != old && s.Bus.hasSubscribers("news")
+	})
+	s.Publish("news", map[string]any{"n": 1})
+	if data := receive(t, got); data["n"] != float64(1) {
+		t.Fatalf("got %v", data)
+	}
+}
+
+func TestClientCloseWhileReconnecting(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	disconnected := make(chan struct{}, 1)
+	c := newTestClient(t, addr, ClientConnectOptions{
+		Id:           "alice",
+		Autorestart:  true,
+		Reconnect:    &Backoff{Initial: time.Second, Max: time.Second, Multiplier: 1},
+		OnDisconnect: func(error) { disconnected <- struct{}{} },
+	})
+	eventually(t, func() bool { _, ok := s.Bus.idConn.Get("alice"); return ok })
+	conn, _ := s.Bus.idConn.Get("alice")
+	_ = conn.Close()
+	receive(t, disconnected)
+	_ = c.Close()
+	receive(t, c.Done)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.Conn != nil {
+		t.Fatal("closed client kept a connection")
+	}
+}
+
+func TestClientPublishAfterLost(t *testing.T) {
+	tests := []struct {
+		name        string
+		autorestart bool
+	}{
+		{"no autorestart", false},
+		{"gave up reconnecting", true},
+	}
+	for _, tt := range tests {
+		s, addr := newTestServer(t, ServerOpts{})
+		ctx, stop := context.WithCancel(context.Background())
+		c := newTestClient(t, addr, ClientConnectOptions{
+			Id:            "alice",
+			Autorestart:   tt.autorestart,
+			Reconnect:     &Backoff{Initial: 10 * time.Millisecond, Ctx: ctx},
+			OfflineBuffer: 10,
+		})
+		eventually(t, func() bool { _, ok := s.Bus.idConn.Get("alice"); return ok })
+		conn, _ := s.Bus.idConn.Get("alice")
+		// reconnecting is given up at once
+		stop()
+		_ = conn.Close()
+		receive(t, c.Done)
+		if err := c.PublishCtx(context.Background(), "news", map[string]any{}); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: err %v, want ErrClosed", tt.name, err)
+		}
+		if n := c.Buffered(); n != 0 {
+			t.Errorf("%s: %d publishes buffered", tt.name, n)
+		}
+	}
+}
+
+func TestClientSubscribeWhileClosing(t *testing.T) {
+	_, addr := newTestServer(t, ServerOpts{})
+	c := newTestClient(t, addr)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			c.Subscribe("news", func(map[string]any, ClientSubscriber) {})
+		}
+	}()
+	_ = c.Close()
+	<-done
+}
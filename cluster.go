@@ -0,0 +1,483 @@
+package ksbus
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kamalshkeir/kmap"
+	"github.com/kamalshkeir/ksmux"
+	"github.com/kamalshkeir/ksmux/ws"
+	"github.com/kamalshkeir/lg"
+)
+
+// ClusterRetryEvery is the delay before dialing a peer again after its link failed
+var ClusterRetryEvery = 2 * time.Second
+
+// ClusterGossipEvery is the interval of the full id lists sent to peers, repairing missed id announces
+var ClusterGossipEvery = 10 * time.Second
+
+const (
+	peerHeader       = "X-Ksbus-Peer"
+	peerSecretHeader = "X-Ksbus-Cluster-Secret"
+)
+
+// relay forward the traffic of a Bus to the other servers of a cluster
+type relay interface {
+	// interest is called when topic get its first subscriber or lose its last one
+	interest(topic string, active bool)
+	// interested return true if a peer has subscribers for topic
+	interested(topic string) bool
+	forward(topic string, data map[string]any, retain bool)
+	// forwardToID return false if no peer can receive messages for id
+	forwardToID(id string, data map[string]any) bool
+}
+
+// peer is another server of the cluster, the subscriptions it announced are kept in interest
+type peer struct {
+	id       string
+	addr     string
+	out      *ws.Conn // link dialed by this server
+	in       *ws.Conn // link dialed by the peer
+	interest atomic.Pointer[topicTrie]
+	ids      atomic.Pointer[kmap.SafeMap[string, struct{}]] // connection ids owned by the peer
+}
+
+func (p *peer) owns(id string) bool {
+	ids := p.ids.Load()
+	if ids == nil {
+		return false
+	}
+	_, ok := ids.Get(id)
+	return ok
+}
+
+func (p *peer) setIDs(list []any) {
+	ids := kmap.New[string, struct{}](len(list) + 1)
+	for _, v := range list {
+		if id, ok := v.(string); ok {
+			ids.Set(id, struct{}{})
+		}
+	}
+	p.ids.Store(ids)
+}
+
+func (p *peer) wants(topic string) bool {
+	t := p.interest.Load()
+	return t != nil && len(t.match(topic)) > 0
+}
+
+// cluster keep a persistent link to each peer, peers exchange the topics they have subscribers for and forward publishes
+type cluster struct {
+	server *Server
+	addrs  []string
+	secure bool
+	secret string
+	peers  *kmap.SafeMap[string, *peer]
+	mu     sync.Mutex
+}
+
+func newCluster(s *Server, opts ServerOpts) *cluster {
+	return &cluster{
+		server: s,
+		addrs:  opts.Peers,
+		secure: opts.PeersSecure,
+		secret: opts.ClusterSecret,
+		peers:  kmap.New[string, *peer](10),
+	}
+}
+
+func (c *cluster) start() {
+	for _, addr := range c.addrs {
+		if addr == c.server.Address {
+			continue
+		}
+		go c.dialLoop(addr)
+	}
+	go RunEvery(ClusterGossipEvery, func() bool {
+		if c.stopped() {
+			return true
+		}
+		c.broadcast(func(*peer) bool { return true }, map[string]any{
+			"action": "peer_ids",
+			"ids":    c.localIDs(),
+		})
+		return false
+	})
+}
+
+// dialLoop keep a link to addr, dialing again when it fail
+func (c *cluster) dialLoop(addr string) {
+	sch := "ws"
+	if c.secure {
+		sch = "wss"
+	}
+	u := url.URL{Scheme: sch, Host: addr, Path: c.server.Path}
+	header := http.Header{}
+	header.Set(peerHeader, c.server.ID)
+	if c.secret != "" {
+		header.Set(peerSecretHeader, c.secret)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.server.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		conn, _, err := ws.DefaultDialer.DialContext(ctx, u.String(), header)
+		if err == nil {
+			c.server.Bus.registerWriter(conn)
+			_ = c.server.Bus.writeTo(conn, c.hello())
+			// the link is closed on shutdown so serve return
+			stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+			c.serve(conn, true)
+			stop()
+		} else {
+			lg.DebugC("cluster dial", "addr", addr, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ClusterRetryEvery):
+		}
+	}
+}
+
+// stopped return true once the server is closed
+func (c *cluster) stopped() bool {
+	select {
+	case <-c.server.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// accept upgrade a link dialed by a peer
+func (c *cluster) accept(ctx *ksmux.Context) {
+	if c.secret == "" {
+		// peer links skip authentication and access control
+		if c.server.authenticator != nil || c.server.authorizer != nil {
+			ctx.Status(http.StatusUnauthorized).Error("cluster secret required when access control is enabled")
+			return
+		}
+	} else if subtle.ConstantTimeCompare([]byte(ctx.Request.Header.Get(peerSecretHeader)), []byte(c.secret)) != 1 {
+		ctx.Status(http.StatusUnauthorized).Error("bad cluster secret")
+		return
+	}
+	conn, err := ctx.UpgradeConnection()
+	if lg.CheckError(err) {
+		return
+	}
+	c.server.Bus.registerWriter(conn)
+	c.serve(conn, false)
+}
+
+func (c *cluster) hello() map[string]any {
+	return map[string]any{
+		"action": "peer_hello",
+		"id":     c.server.ID,
+		"addr":   c.server.Address,
+		"topics": c.server.Bus.topicSubscribers.Keys(),
+		"ids":    c.localIDs(),
+	}
+}
+
+// localIDs return the ids of the websocket and RPC clients connected to this server
+func (c *cluster) localIDs() []string {
+	return append(c.server.Bus.idConn.Keys(), c.server.idConnRPC.Keys()...)
+}
+
+// owner return the peer owning id, the id of a peer server is owned by itself
+func (c *cluster) owner(id string) (*peer, bool) {
+	if p, ok := c.peers.Get(id); ok {
+		return p, true
+	}
+	var owner *peer
+	c.peers.Range(func(_ string, p *peer) bool {
+		if p.owns(id) {
+			owner = p
+			return false
+		}
+		return true
+	})
+	return owner, owner != nil
+}
+
+func (c *cluster) announceID(id string, active bool) {
+	action := "peer_id_del"
+	if active {
+		action = "peer_id_add"
+	}
+	c.broadcast(func(*peer) bool { return true }, map[string]any{
+		"action": action,
+		"id":     id,
+	})
+}
+
+// serve read the frames of a peer link until it fail
+func (c *cluster) serve(conn *ws.Conn, dialed bool) {
+	var p *peer
+	defer func() {
+		c.server.Bus.unregisterWriter(conn)
+		_ = conn.Close()
+		if p != nil {
+			c.removeLink(p, conn)
+		}
+	}()
+	for {
+		var m map[string]any
+		if err := conn.ReadJSON(&m); err != nil {
+			lg.DebugC("cluster link closed", "err", err)
+			return
+		}
+		action, _ := m["action"].(string)
+		if action == "peer_hello" {
+			id, _ := m["id"].(string)
+			if id == "" || id == c.server.ID {
+				return
+			}
+			addr, _ := m["addr"].(string)
+			topics, _ := m["topics"].([]any)
+			var replyHello bool
+			p, replyHello = c.addLink(id, addr, conn, dialed, topics)
+			ids, _ := m["ids"].([]any)
+			p.setIDs(ids)
+			if replyHello {
+				_ = c.server.Bus.writeTo(conn, c.hello())
+			}
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		c.handle(p, action, m)
+	}
+}
+
+// addLink register conn as a link of peer id and reset its interest, it return true if the hello must be answered
+func (c *cluster) addLink(id, addr string, conn *ws.Conn, dialed bool, topics []any) (*peer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.peers.Get(id)
+	if !ok {
+		p = &peer{id: id}
+	}
+	p.addr = addr
+	if dialed {
+		p.out = conn
+	} else {
+		p.in = conn
+	}
+	interest := newTopicTrie()
+	for _, t := range topics {
+		if topic, ok := t.(string); ok {
+			interest.add(topic)
+		}
+	}
+	p.interest.Store(interest)
+	c.peers.Set(id, p)
+	return p, !dialed && p.out == nil
+}
+
+func (c *cluster) removeLink(p *peer, conn *ws.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.out == conn {
+		p.out = nil
+	}
+	if p.in == conn {
+		p.in = nil
+	}
+	if p.out == nil && p.in == nil {
+		c.peers.Delete(p.id)
+	}
+}
+
+func (c *cluster) handle(p *peer, action string, m map[string]any) {
+	switch action {
+	case "peer_sub":
+		if topic, ok := m["topic"].(string); ok {
+			p.interest.Load().add(topic)
+		}
+	case "peer_unsub":
+		if topic, ok := m["topic"].(string); ok {
+			p.interest.Load().remove(topic)
+		}
+	case "peer_ids":
+		ids, _ := m["ids"].([]any)
+		p.setIDs(ids)
+	case "peer_id_add":
+		if id, ok := m["id"].(string); ok {
+			if ids := p.ids.Load(); ids != nil {
+				ids.Set(id, struct{}{})
+			}
+		}
+	case "peer_id_del":
+		if id, ok := m["id"].(string); ok {
+			if ids := p.ids.Load(); ids != nil {
+				ids.Delete(id)
+			}
+		}
+	case "peer_pub":
+		topic, _ := m["topic"].(string)
+		data, ok := m["data"].(map[string]any)
+		if topic == "" || !ok {
+			return
+		}
+		data["via_server"] = p.id
+		retain, _ := m["retain"].(bool)
+		_ = c.server.Bus.PublishCtx(context.Background(), topic, data, retain)
+	case "peer_pub_id":
+		id, _ := m["id"].(string)
+		data, ok := m["data"].(map[string]any)
+		if id == "" || !ok {
+			return
+		}
+		data["via_server"] = p.id
+		if id == c.server.ID {
+			if c.server.onId != nil {
+				c.server.onId(data)
+			}
+			return
+		}
+		_ = c.server.PublishToIDCtx(context.Background(), id, data)
+	}
+}
+
+func (c *cluster) interest(topic string, active bool) {
+	action := "peer_unsub"
+	if active {
+		action = "peer_sub"
+	}
+	c.broadcast(func(*peer) bool { return true }, map[string]any{
+		"action": action,
+		"topic":  topic,
+	})
+}
+
+func (c *cluster) interested(topic string) bool {
+	found := false
+	c.peers.Range(func(_ string, p *peer) bool {
+		found = p.wants(topic)
+		return !found
+	})
+	return found
+}
+
+func (c *cluster) forward(topic string, data map[string]any, retain bool) {
+	c.broadcast(func(p *peer) bool { return p.wants(topic) }, map[string]any{
+		"action":     "peer_pub",
+		"topic":      topic,
+		"data":       data,
+		"retain":     retain,
+		"via_server": c.server.ID,
+	})
+}
+
+func (c *cluster) forwardToID(id string, data map[string]any) bool {
+	msg := map[string]any{
+		"action":     "peer_pub_id",
+		"id":         id,
+		"data":       data,
+		"via_server": c.server.ID,
+	}
+	p, ok := c.owner(id)
+	if !ok {
+		return false
+	}
+	return c.send(p, msg)
+}
+
+// broadcast send msg to the peers selected by filter, it return true if at least one peer got it
+func (c *cluster) broadcast(filter func(p *peer) bool, msg map[string]any) bool {
+	var payload []byte
+	sent := false
+	c.peers.Range(func(_ string, p *peer) bool {
+		if !filter(p) {
+			return true
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(msg); err != nil {
+				lg.Error("cluster encode", "err", err)
+				return false
+			}
+		}
+		if conn := c.connOf(p); conn != nil && c.server.Bus.writeRaw(conn, payload, false) == nil {
+			sent = true
+		}
+		return true
+	})
+	return sent
+}
+
+// connOf return the link used to send to p, messages always use the same one so they stay ordered
+func (c *cluster) connOf(p *peer) *ws.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.out != nil {
+		return p.out
+	}
+	return p.in
+}
+
+func (c *cluster) send(p *peer, msg map[string]any) bool {
+	conn := c.connOf(p)
+	if conn == nil {
+		return false
+	}
+	return c.server.Bus.writeTo(conn, msg) == nil
+}
+
+// idTaken return true if id is used by this server, one of its clients or a client of a peer
+func (s *Server) idTaken(id string) bool {
+	if id == s.ID {
+		return true
+	}
+	if _, ok := s.Bus.idConn.Get(id); ok {
+		return true
+	}
+	if _, ok := s.idConnRPC.Get(id); ok {
+		return true
+	}
+	if s.cluster != nil {
+		if _, ok := s.cluster.owner(id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OwnerOf return the id of the server where id is connected, this server id for local clients
+func (s *Server) OwnerOf(id string) (string, bool) {
+	if _, ok := s.Bus.idConn.Get(id); ok {
+		return s.ID, true
+	}
+	if _, ok := s.idConnRPC.Get(id); ok {
+		return s.ID, true
+	}
+	if s.cluster != nil {
+		if p, ok := s.cluster.owner(id); ok {
+			return p.id, true
+		}
+	}
+	return "", false
+}
+
+// Peers return the ids of the servers linked to this one
+func (s *Server) Peers() []string {
+	if s.cluster == nil {
+		return nil
+	}
+	return s.cluster.peers.Keys()
+}
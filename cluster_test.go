@@ -0,0 +1,81 @@
+package ksbus
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kamalshkeir/ksmux"
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+func TestClusterAccept(t *testing.T) {
+	authenticator := func(cred Credentials) (*Principal, error) { return &Principal{ID: cred.Token}, nil }
+	authorizer := func(*Principal, Action, string) error { return nil }
+	tests := []struct {
+		name   string
+		opts   ServerOpts
+		secret string
+		want   int
+	}{
+		{"open", ServerOpts{Peers: []string{"x"}}, "", http.StatusSwitchingProtocols},
+		{"good secret", ServerOpts{ClusterSecret: "s3cret"}, "s3cret", http.StatusSwitchingProtocols},
+		{"bad secret", ServerOpts{ClusterSecret: "s3cret"}, "other", http.StatusUnauthorized},
+		{"missing secret", ServerOpts{ClusterSecret: "s3cret"}, "", http.StatusUnauthorized},
+		{"authenticator without secret", ServerOpts{Peers: []string{"x"}, Authenticator: authenticator}, "", http.StatusUnauthorized},
+		{"authorizer without secret", ServerOpts{Peers: []string{"x"}, Authorizer: authorizer}, "", http.StatusUnauthorized},
+		{"authorizer with secret", ServerOpts{ClusterSecret: "s3cret", Authorizer: authorizer}, "s3cret", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		s, addr := newTestServer(t, tt.opts)
+		header := http.Header{}
+		header.Set(peerHeader, "peer1")
+		if tt.secret != "" {
+			header.Set(peerSecretHeader, tt.secret)
+		}
+		conn, resp, err := ws.DefaultDialer.Dial("ws://"+addr+s.Path, header)
+		if conn != nil {
+			_ = conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestClusterCloseStopsLinks(t *testing.T) {
+	b, addrB := newTestServer(t, ServerOpts{ClusterSecret: "s3cret"})
+	// a only dial b, it is not served
+	a := NewServer(ServerOpts{ClusterSecret: "s3cret", Peers: []string{addrB}, WithOtherRouter: ksmux.New()})
+	defer a.Close()
+	eventually(t, func() bool { return len(b.Peers()) == 1 })
+	_ = a.Close()
+	eventually(t, func() bool { return len(b.Peers()) == 0 })
+}
+
+func TestIDTaken(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{ClusterSecret: "s3cret"})
+	s.Bus.idConn.Set("ws1", nil)
+	s.idConnRPC.Set("rpc1", &RPCConn{Id: "rpc1"})
+	p := &peer{id: "peer1"}
+	p.setIDs([]any{"remote1"})
+	s.cluster.peers.Set(p.id, p)
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{s.ID, true},
+		{"ws1", true},
+		{"rpc1", true},
+		{"peer1", true},
+		{"remote1", true},
+		{"free", false},
+	}
+	for _, tt := range tests {
+		if got := s.idTaken(tt.id); got != tt.want {
+			t.Errorf("idTaken(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
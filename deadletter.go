@@ -0,0 +1,150 @@
+package ksbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sync/atomic"
+
+	"github.com/kamalshkeir/ksmux/ws"
+	"github.com/kamalshkeir/lg"
+)
+
+// DeadLetterTopic is the default topic receiving dropped messages, see Bus.WithDeadLetter
+const DeadLetterTopic = "$sys.dead_letter"
+
+// DropReason tell why a message was not delivered
+type DropReason string
+
+const (
+	DropFullChannel   DropReason = "full_channel"   // a channel subscriber or a RPC queue had no room
+	DropWriteError    DropReason = "write_error"    // writing on the connection failed
+	DropSlowConsumer  DropReason = "slow_consumer"  // the outbound queue of the connection was full
+	DropUnknownID     DropReason = "unknown_id"     // no connection use the target id
+	DropExpired       DropReason = "expired"        // the ttl of the message passed before delivery
+	DropForbidden     DropReason = "forbidden"      // the ACL denied the publish
+	DropMaxDeliveries DropReason = "max_deliveries" // not acked after max deliveries
+)
+
+// WithDeadLetter set the topic receiving dropped messages as {"original_topic", "target_id", "reason", "attempts", "error", "data"}, default DeadLetterTopic
+func (b *Bus) WithDeadLetter(topic string) {
+	b.deadLetter = topic
+}
+
+// Drops return the number of dropped messages per reason
+func (b *Bus) Drops() map[DropReason]uint64 {
+	res := map[DropReason]uint64{}
+	b.drops.Range(func(reason DropReason, n *atomic.Uint64) bool {
+		res[reason] = n.Load()
+		return true
+	})
+	return res
+}
+
+func (b *Bus) deadLetterTopic() string {
+	if b.deadLetter == "" {
+		return DeadLetterTopic
+	}
+	return b.deadLetter
+}
+
+// drop record that data, published on topic or sent to targetID, was not delivered, and publish it on the dead letter topic if someone listen or the log record it
+func (b *Bus) drop(reason DropReason, topic, targetID string, data map[string]any, attempts int, err error) {
+	b.drops.GetOrCompute(reason, func() *atomic.Uint64 {
+		return &atomic.Uint64{}
+	}).Add(1)
+	lg.DebugC("message dropped", "reason", reason, "topic", topic, "target", targetID, "err", err)
+	dlTopic := b.deadLetterTopic()
+	// dead letters that cannot be delivered are not dead lettered again
+	if topic == dlTopic {
+		return
+	}
+	if !b.hasSubscribers(dlTopic) && (b.log == nil || !b.log.records(dlTopic)) {
+		return
+	}
+	dl := map[string]any{
+		"original_topic": topic,
+		"target_id":      targetID,
+		"reason":         string(reason),
+		"attempts":       attempts,
+	}
+	if data != nil {
+		dl["data"] = maps.Clone(data)
+	}
+	if err != nil {
+		dl["error"] = err.Error()
+	}
+	b.Publish(dlTopic, dl)
+}
+
+func writeDropReason(err error) DropReason {
+	if errors.Is(err, ErrSlowConsumer) {
+		return DropSlowConsumer
+	}
+	return DropWriteError
+}
+
+// dropRaw record a message dropped from the outbound queue of conn
+func (b *Bus) dropRaw(reason DropReason, conn *ws.Conn, msg []byte) {
+	data := map[string]any{}
+	_ = json.Unmarshal(msg, &data)
+	topic, _ := data["topic"].(string)
+	id, _ := b.allWS.Get(conn)
+	b.drop(reason, topic, id, data, 1, nil)
+}
+
+// dropDenied record a publish denied by the ACL, other denied actions are ignored, data is dead lettered only with DeadLetterDenied
+func (s *Server) dropDenied(action Action, target string, data any, err error) {
+	var msg map[string]any
+	if s.deadLetterDenied {
+		switch v := data.(type) {
+		case map[string]any:
+			msg = v
+		case nil:
+		default:
+			msg = map[string]any{"data": v}
+		}
+	}
+	switch action {
+	case ActionPublish:
+		s.Bus.drop(DropForbidden, target, "", msg, 0, err)
+	case ActionPublishToID:
+		s.Bus.drop(DropForbidden, "", target, msg, 0, err)
+	}
+}
+
+// ReplayDeadLetter publish again the data of a dead letter on its original topic, or send it to its target id
+func (b *Bus) ReplayDeadLetter(ctx context.Context, deadLetter map[string]any) error {
+	return replayDeadLetter(deadLetter, func(topic string, data map[string]any) error {
+		return b.PublishCtx(ctx, topic, data)
+	}, func(id string, data map[string]any) error {
+		return b.PublishToIDCtx(ctx, id, data)
+	})
+}
+
+// ReplayDeadLetter publish again the data of a dead letter on its original topic, or send it to its target id
+func (s *Server) ReplayDeadLetter(ctx context.Context, deadLetter map[string]any) error {
+	return replayDeadLetter(deadLetter, func(topic string, data map[string]any) error {
+		return s.PublishCtx(ctx, topic, data)
+	}, func(id string, data map[string]any) error {
+		return s.PublishToIDCtx(ctx, id, data)
+	})
+}
+
+func replayDeadLetter(deadLetter map[string]any, pub, pubID func(string, map[string]any) error) error {
+	data, _ := deadLetter["data"].(map[string]any)
+	if data == nil {
+		data = map[string]any{}
+	}
+	// routing fields of the dropped message are set again on publish
+	delete(data, "topic")
+	delete(data, "to_id")
+	if topic, _ := deadLetter["original_topic"].(string); topic != "" {
+		return pub(topic, data)
+	}
+	if id, _ := deadLetter["target_id"].(string); id != "" {
+		return pubID(id, data)
+	}
+	return errors.New("dead letter without original_topic or target_id")
+}
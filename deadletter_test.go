@@ -0,0 +1,94 @@
+package ksbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDropDenied(t *testing.T) {
+	tests := []struct {
+		name     string
+		keepData bool
+		action   Action
+		data     any
+		wantData bool
+	}{
+		{"publish", false, ActionPublish, map[string]any{"secret": 1}, false},
+		{"publish kept", true, ActionPublish, map[string]any{"secret": 1}, true},
+		{"publish to id kept", true, ActionPublishToID, "text", true},
+		{"publish without data", true, ActionPublish, nil, false},
+	}
+	for _, tt := range tests {
+		s, _ := newTestServer(t, ServerOpts{DeadLetterDenied: tt.keepData})
+		got := make(chan map[string]any, 1)
+		s.Subscribe(DeadLetterTopic, func(dl map[string]any, _ Unsub) {
+			got <- dl
+		})
+		s.dropDenied(tt.action, "orders", tt.data, ErrForbidden)
+		dl := receive(t, got)
+		if dl["reason"] != string(DropForbidden) {
+			t.Errorf("%s: reason %v", tt.name, dl["reason"])
+		}
+		if _, ok := dl["data"]; ok != tt.wantData {
+			t.Errorf("%s: dead letter %v, want data %v", tt.name, dl, tt.wantData)
+		}
+		if n := s.Bus.Drops()[DropForbidden]; n != 1 {
+			t.Errorf("%s: %d drops counted", tt.name, n)
+		}
+	}
+}
+
+func TestDropWhileSubscribersModify(t *testing.T) {
+	bus := New()
+	letters := make(chan map[string]any, 10)
+	bus.Subscribe(DeadLetterTopic, func(dl map[string]any, _ Unsub) {
+		letters <- dl
+	})
+	bus.Subscribe("orders", func(data map[string]any, _ Unsub) {
+		delete(data, "n")
+		data["seen"] = true
+	})
+	block := make(chan struct{})
+	defer close(block)
+	bus.Subscribe("orders", func(data map[string]any, _ Unsub) {
+		<-block
+	})
+	for n := range 3 {
+		bus.Publish("orders", map[string]any{"n": n})
+	}
+	for {
+		select {
+		case dl := <-letters:
+			data, _ := dl["data"].(map[string]any)
+			if _, ok := data["n"]; !ok {
+				t.Fatalf("dead letter data %v modified by a subscriber", data)
+			}
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatal("no dead letter")
+		}
+	}
+}
+
+func TestRPCPublishToIDDrops(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	s.idConnRPC.Set("rpc1", &RPCConn{Id: "rpc1", msgChan: make(chan map[string]any, 1)})
+	b := &BusRPC{server: s}
+	tests := []struct {
+		name   string
+		data   map[string]any
+		reason DropReason
+	}{
+		{"expired", map[string]any{"expires_at": time.Now().Add(-time.Second).UnixMilli()}, DropExpired},
+		{"first", map[string]any{"n": 1}, ""},
+		{"full channel", map[string]any{"n": 2}, DropFullChannel},
+	}
+	for _, tt := range tests {
+		if err := b.PublishToID(&RPCRequest{From: "rpc2", Id: "rpc1", Data: tt.data}, &RPCResponse{}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.reason != "" && s.Bus.Drops()[tt.reason] != 1 {
+			t.Errorf("%s: drops %v, want one %s", tt.name, s.Bus.Drops(), tt.reason)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package ksbus
+
+import "errors"
+
+var (
+	// ErrClosed is returned when writing on a closed or lost connection
+	ErrClosed = errors.New("connection closed")
+	// ErrUnknownID is returned by PublishToIDCtx when no connection use the id
+	ErrUnknownID = errors.New("unknown id")
+	// ErrUnauthenticated is returned when a connection could not be authenticated
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrNotRegistered is returned by RPC calls of a client without session, after its session expired
+	ErrNotRegistered = errors.New("client not registered")
+	// ErrSlowConsumer is returned when a message is dropped because the outbound queue of a connection is full
+	ErrSlowConsumer = errors.New("slow consumer, outbound queue full")
+	// ErrNoResponders is returned by Request when nobody is subscribed to the topic
+	ErrNoResponders = errors.New("no responders for request")
+	// ErrOutboxFull is returned by publishes of a disconnected client when its offline buffer is full
+	ErrOutboxFull = errors.New("offline buffer full")
+	// ErrHandlerPanic is wrapped by the PanicError given to OnHandlerError
+	ErrHandlerPanic = errors.New("handler panic")
+	// ErrDecode is wrapped by the errors of SubscribeTyped when a message cannot be decoded
+	ErrDecode = errors.New("cannot decode")
+	// ErrScheduleRejected is wrapped by the errors of PublishWith when the message cannot be scheduled
+	ErrScheduleRejected = errors.New("schedule rejected")
+)
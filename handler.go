@@ -0,0 +1,111 @@
+package ksbus
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/kamalshkeir/ksmux/ws"
+	"github.com/kamalshkeir/lg"
+)
+
+// HandlerErrorFunc receive the panics of handlers as *PanicError, with the topic and the message handled
+type HandlerErrorFunc func(topic string, err error, data map[string]any)
+
+// PanicError is a recovered panic of a handler, it wrap ErrHandlerPanic
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrHandlerPanic, e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	return ErrHandlerPanic
+}
+
+// callHandler run fn, the handler of data received on topic, and recover its panic
+//
+// the panic is given to onErr, or logged, a pending request of data get the error as reply and a pending ack is nacked so the message is redelivered
+func callHandler(topic string, data map[string]any, unsub Unsub, onErr HandlerErrorFunc, reply func(replyTo string, msg map[string]any), fn func()) (err error) {
+	// read before fn, request handlers remove reply_to
+	replyTo, _ := data["reply_to"].(string)
+	ackID, _ := data["ack_id"].(string)
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		pe := &PanicError{Value: r, Stack: debug.Stack()}
+		err = pe
+		if onErr != nil {
+			onErr(topic, err, data)
+		} else {
+			lg.Error("handler panic", "topic", topic, "err", err, "stack", string(pe.Stack))
+		}
+		if replyTo != "" && reply != nil {
+			reply(replyTo, replyMessage(nil, err))
+		}
+		if acker, ok := unsub.(Acker); ok && ackID != "" {
+			acker.Nack()
+		}
+	}()
+	fn()
+	return nil
+}
+
+// OnHandlerError set the function receiving the panics of subscription handlers, they are logged by default
+func (b *Bus) OnHandlerError(fn HandlerErrorFunc) {
+	b.onHandlerError = fn
+}
+
+func (b *Bus) callHandler(topic string, data map[string]any, unsub Unsub, fn func()) {
+	_ = callHandler(topic, data, unsub, b.onHandlerError, func(replyTo string, msg map[string]any) {
+		msg["from"] = "INTERNAL"
+		b.Publish(replyTo, msg)
+	}, fn)
+}
+
+// OnHandlerError set the function receiving the panics of subscription handlers and of the websocket handlers OnDataWs, OnId and OnServerData
+func (s *Server) OnHandlerError(fn HandlerErrorFunc) {
+	s.Bus.OnHandlerError(fn)
+}
+
+// callWS run fn, handling the websocket message m of conn, a panic is sent back to conn as a structured error
+func (s *Server) callWS(m map[string]any, conn *ws.Conn, fn func()) {
+	topic, _ := m["topic"].(string)
+	data, _ := m["data"].(map[string]any)
+	err := callHandler(topic, data, nil, s.Bus.onHandlerError, func(replyTo string, msg map[string]any) {
+		msg["from"] = s.ID
+		s.Publish(replyTo, msg)
+	}, fn)
+	if err != nil {
+		_ = s.Bus.writeTo(conn, map[string]any{
+			"error": err.Error(),
+			"code":  CodeHandlerPanic,
+		})
+	}
+}
+
+// OnHandlerError set the function receiving the panics of handlers, they are logged by default
+func (client *Client) OnHandlerError(fn HandlerErrorFunc) {
+	client.onHandlerError = fn
+}
+
+func (client *Client) callHandler(topic string, data map[string]any, unsub Unsub, fn func()) {
+	_ = callHandler(topic, data, unsub, client.onHandlerError, func(replyTo string, msg map[string]any) {
+		client.Publish(replyTo, msg)
+	}, fn)
+}
+
+// OnHandlerError set the function receiving the panics of handlers, they are logged by default
+func (c *RPCClient) OnHandlerError(fn HandlerErrorFunc) {
+	c.onHandlerError = fn
+}
+
+func (c *RPCClient) callHandler(topic string, data map[string]any, unsub Unsub, fn func()) {
+	_ = callHandler(topic, data, unsub, c.onHandlerError, func(replyTo string, msg map[string]any) {
+		c.Publish(replyTo, msg)
+	}, fn)
+}
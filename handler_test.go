@@ -0,0 +1,91 @@
+package ksbus
+
+import (
+	"errors"
+	"testing"
+)
+
+// testAcker record the Nack of a handler
+type testAcker struct{ nacked *bool }
+
+func (a testAcker) Unsubscribe() {}
+func (a testAcker) Ack()         {}
+func (a testAcker) Nack()        { *a.nacked = true }
+
+// testUnsub cannot ack
+type testUnsub struct{}
+
+func (testUnsub) Unsubscribe() {}
+
+func TestCallHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]any
+		acker     bool
+		panics    bool
+		wantReply bool
+		wantNack  bool
+	}{
+		{"no panic", map[string]any{"reply_to": "r", "ack_id": "a"}, true, false, false, false},
+		{"panic", map[string]any{}, true, true, false, false},
+		{"panic request", map[string]any{"reply_to": "r"}, false, true, true, false},
+		{"panic ack", map[string]any{"ack_id": "a"}, true, true, false, true},
+		{"panic ack without acker", map[string]any{"ack_id": "a"}, false, true, false, false},
+	}
+	for _, tt := range tests {
+		nacked := false
+		var unsub Unsub = testUnsub{}
+		if tt.acker {
+			unsub = testAcker{nacked: &nacked}
+		}
+		var reported error
+		var reply map[string]any
+		err := callHandler("t", tt.data, unsub, func(topic string, err error, data map[string]any) {
+			reported = err
+		}, func(replyTo string, msg map[string]any) {
+			reply = msg
+		}, func() {
+			// request handlers remove reply_to before they panic
+			delete(tt.data, "reply_to")
+			if tt.panics {
+				panic("boom")
+			}
+		})
+		if tt.panics != (err != nil) || !errors.Is(reported, err) {
+			t.Errorf("%s: err %v, reported %v", tt.name, err, reported)
+		}
+		if err != nil && !errors.Is(err, ErrHandlerPanic) {
+			t.Errorf("%s: err %v is not ErrHandlerPanic", tt.name, err)
+		}
+		if (reply != nil) != tt.wantReply || (reply != nil && reply["error"] == nil) {
+			t.Errorf("%s: reply %v, want reply %v", tt.name, reply, tt.wantReply)
+		}
+		if nacked != tt.wantNack {
+			t.Errorf("%s: nacked %v, want %v", tt.name, nacked, tt.wantNack)
+		}
+	}
+}
+
+func TestBusHandlerPanicKeepSubscription(t *testing.T) {
+	bus := New()
+	errs := make(chan error, 1)
+	bus.OnHandlerError(func(topic string, err error, data map[string]any) {
+		errs <- err
+	})
+	got := make(chan map[string]any, 1)
+	bus.Subscribe("jobs", func(data map[string]any, _ Unsub) {
+		if data["n"] == 1 {
+			panic("boom")
+		}
+		got <- data
+	})
+	bus.Publish("jobs", map[string]any{"n": 1})
+	var perr *PanicError
+	if err := receive(t, errs); !errors.As(err, &perr) || perr.Value != "boom" {
+		t.Fatalf("err %v, want the panic", err)
+	}
+	bus.Publish("jobs", map[string]any{"n": 2})
+	if data := receive(t, got); data["n"] != 2 {
+		t.Fatalf("got %v", data)
+	}
+}
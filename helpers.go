@@ -1,6 +1,9 @@
 package ksbus
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
 	"strings"
 	"time"
 
@@ -9,34 +12,85 @@ import (
 	"github.com/kamalshkeir/lg"
 )
 
-func (s *Server) subscribeWS(id, topic string, conn *ws.Conn) {
+// subscribeWS subscribe conn to topic as id
+//
+// with from set the durable log is replayed first, messages published meanwhile are sent after the replay and skipped if replayed
+func (s *Server) subscribeWS(id, topic string, conn *ws.Conn, queue string, ack bool, from Replay) {
 	if id == "" {
 		GenerateRandomString(5)
 	}
-	if subs, ok := s.Bus.topicSubscribers.Get(topic); ok {
-		subs = append(subs, Subscriber{
-			bus:   s.Bus,
-			Id:    id,
-			Topic: topic,
-			Conn:  conn,
-		})
-		s.Bus.topicSubscribers.Set(topic, subs)
-	} else {
-		_ = s.Bus.topicSubscribers.Set(topic, []Subscriber{{
-			bus:   s.Bus,
-			Id:    id,
-			Topic: topic,
-			Conn:  conn,
-		}})
+	sub := Subscriber{
+		bus:   s.Bus,
+		Id:    id,
+		Topic: topic,
+		Conn:  conn,
+		Queue: queue,
+		ack:   ack,
+	}
+	if !from.isZero() {
+		sub.gate = &replayGate{max: s.Bus.queueSize()}
+		s.Bus.addSubscriber(sub)
+		sub.gate.release(s.replayWS(topic, from, conn))
+		return
+	}
+	s.Bus.addSubscriber(sub)
+	if sub.Queue == "" {
+		for _, msg := range s.Bus.retainedFor(topic) {
+			_ = s.Bus.writeTo(conn, msg)
+		}
+	}
+}
+
+// publishWS publish data of a pub action, with its delay, deliver_at and ttl options
+func (s *Server) publishWS(conn *ws.Conn, topic string, data map[string]any, opts PublishOpts) {
+	if err := s.PublishWith(topic, data, opts); err != nil {
+		s.publishFailedWS(conn, "pub", err)
+		lg.DebugC("ws publish", "topic", topic, "err", err)
+	}
+}
+
+// publishToIDWS send data of a pub_id action, with its delay, deliver_at and ttl options
+func (s *Server) publishToIDWS(conn *ws.Conn, id string, data map[string]any, opts PublishOpts) {
+	if err := s.PublishToIDWith(id, data, opts); err != nil {
+		s.publishFailedWS(conn, "pub_id", err)
+		lg.DebugC("ws publish to id", "id", id, "err", err)
+	}
+}
+
+// publishFailedWS tell conn that its delayed message was not scheduled
+func (s *Server) publishFailedWS(conn *ws.Conn, action string, err error) {
+	if !errors.Is(err, ErrScheduleRejected) {
+		return
+	}
+	_ = s.Bus.writeTo(conn, (&ProtocolError{
+		Code:    CodeScheduleFull,
+		Action:  action,
+		Message: err.Error(),
+	}).message())
+}
+
+// replayWS send to conn the messages of topic recorded in the durable log and return the last sequence sent
+func (s *Server) replayWS(topic string, from Replay, conn *ws.Conn) uint64 {
+	var last uint64
+	err := s.Replay(topic, from, func(rec LogRecord) bool {
+		if s.Bus.writeToWait(conn, rec.Data) != nil {
+			return false
+		}
+		last = rec.Seq
+		return true
+	})
+	if err != nil {
+		_ = s.Bus.writeTo(conn, errorMessage(CodeReplayFailed, err))
 	}
+	return last
 }
 
 func (s *Server) unsubscribeWS(topic string, wsConn *ws.Conn) {
-	if clients, ok := s.Bus.topicSubscribers.Get(topic); ok {
+	if clients, ok := s.Bus.topicSubscribers.Get(normalizeTopic(topic)); ok {
 		for i, s := range clients {
 			if s.Conn == wsConn {
 				clients = append(clients[:i], clients[i+1:]...)
-				go s.bus.topicSubscribers.Set(topic, clients)
+				go s.bus.setSubscribers(topic, clients)
 				return
 			}
 		}
@@ -45,39 +99,43 @@ func (s *Server) unsubscribeWS(topic string, wsConn *ws.Conn) {
 
 func (s *Server) removeWSFromAllTopics(wsConn *ws.Conn) {
 	runned := false
-	s.Bus.topicSubscribers.Range(func(key string, value []Subscriber) bool {
-		for i, v := range value {
-			if v.Conn == wsConn {
-				value = append(value[:i], value[i+1:]...)
-				go s.Bus.topicSubscribers.Set(key, value)
-				if s.onWsClose != nil && !runned {
-					runned = true
-					s.onWsClose(v.Id)
-				}
-				break
-			}
-		}
-		return true
-	})
+	// a connection can subscribe to the same topic more than once, with and without queue group
+	if ids := s.Bus.removeSubscribers(func(sub Subscriber) bool { return sub.Conn == wsConn }); len(ids) > 0 && s.onWsClose != nil {
+		runned = true
+		s.onWsClose(ids[0])
+	}
 	go s.Bus.allWS.Delete(wsConn)
+	go s.principals.Delete(wsConn)
+	var ids []string
 	s.Bus.idConn.Range(func(key string, value *ws.Conn) bool {
 		if value == wsConn {
-			go s.Bus.idConn.Delete(key)
-			if s.onWsClose != nil && !runned {
-				runned = true
-				s.onWsClose(key)
-			}
+			ids = append(ids, key)
 		}
 		return true
 	})
+	for _, id := range ids {
+		s.Bus.idConn.Delete(id)
+		s.announceID(id, false)
+		if s.onWsClose != nil && !runned {
+			runned = true
+			s.onWsClose(id)
+		}
+	}
 }
 
+// AllTopics return the topics having subscribers, system topics like $sys.query.presence are not listed
 func (server *Server) AllTopics() []string {
-	return server.Bus.topicSubscribers.Keys()
+	topics := []string{}
+	for _, t := range server.Bus.topicSubscribers.Keys() {
+		if !strings.HasPrefix(t, sysPrefix) {
+			topics = append(topics, t)
+		}
+	}
+	return topics
 }
 
 func (s *Server) GetSubscribers(topic string) []Subscriber {
-	if subs, ok := s.Bus.topicSubscribers.Get(topic); ok {
+	if subs, ok := s.Bus.topicSubscribers.Get(normalizeTopic(topic)); ok {
 		return subs
 	}
 	return nil
@@ -95,266 +153,236 @@ func (server *Server) handleWS() {
 
 func handlerBusWs(server *Server) ksmux.Handler {
 	return func(c *ksmux.Context) {
+		if c.Request.Header.Get(peerHeader) != "" {
+			if server.cluster == nil {
+				c.Status(http.StatusForbidden).Error("clustering not enabled")
+				return
+			}
+			server.cluster.accept(c)
+			return
+		}
+		principal, err := server.authenticate(credentialsFromRequest(c.Request, server.authCookie))
+		if err != nil {
+			c.Status(http.StatusUnauthorized).Error(err.Error())
+			return
+		}
+		if principal != nil {
+			if server.idTaken(principal.ID) {
+				c.Status(http.StatusConflict).Error("ID already exist, should be unique")
+				return
+			}
+		}
 		conn, err := c.UpgradeConnection()
 		if lg.CheckError(err) {
 			return
 		}
 		defer conn.Close()
+		server.Bus.registerWriter(conn)
+		defer server.Bus.unregisterWriter(conn)
+		if principal != nil {
+			if err := server.bindWS(conn, principal); err != nil {
+				server.rejectWS(conn, errorMessage(CodeIDTaken, err))
+				return
+			}
+		}
 		for {
-			var m map[string]any
-			err := conn.ReadJSON(&m)
+			_, raw, err := conn.ReadMessage()
 			if err != nil {
 				lg.DebugC(err.Error())
 				server.removeWSFromAllTopics(conn)
 				break
 			}
-			if server.onDataWS != nil {
-				if err := server.onDataWS(m, conn, c.Request); err != nil {
-					_ = conn.WriteJSON(map[string]any{
-						"error": err.Error(),
-					})
-					continue
-				}
+			var m map[string]any
+			// a malformed message is rejected, the connection is kept
+			if err := json.Unmarshal(raw, &m); err != nil || m == nil {
+				_ = server.Bus.writeTo(conn, (&ProtocolError{Code: CodeBadFrame, Message: "message must be a json object"}).message())
+				continue
+			}
+			// a connection with an id can only speak for itself
+			if id, ok := server.Bus.allWS.Get(conn); ok {
+				m["from"] = id
 			}
-			server.handleActions(m, conn)
+			// a panic handling one message must not close the connection
+			server.callWS(m, conn, func() {
+				if server.onDataWS != nil {
+					if err := server.onDataWS(m, conn, c.Request); err != nil {
+						_ = server.Bus.writeTo(conn, errorMessage(CodeRejected, err))
+						return
+					}
+				}
+				server.handleActions(m, conn)
+			})
 		}
 	}
 }
 
-func (server *Server) handleActions(m map[string]any, conn *ws.Conn) {
-	if action, ok := m["action"]; ok {
-		switch action {
-		case "pub", "publish":
-			if data, ok := m["data"]; ok {
-				switch v := data.(type) {
-				case string:
-					mm := map[string]any{
-						"data": v,
-					}
-
-					if topic, ok := m["topic"]; ok {
-						mm["topic"] = topic.(string)
-						server.Publish(topic.(string), mm)
-					} else {
-						_ = conn.WriteJSON(map[string]any{
-							"error": "topic missing",
-						})
-					}
-				case map[string]any:
-					if data, ok := m["data"].(map[string]any); ok {
-						if eventID, ok := data["event_id"].(string); ok {
-							server.Publish(eventID, map[string]any{
-								"ok":   "done",
-								"from": server.ID,
-							})
-						}
-					}
-					if topic, ok := m["topic"]; ok {
-						if from, ok := m["from"]; ok {
-							v["from"] = from
-						} else if cc, ok := server.Bus.allWS.Get(conn); ok {
-							v["from"] = cc
-						}
-						server.Publish(topic.(string), v)
-					} else {
-						_ = conn.WriteJSON(map[string]any{
-							"error": "topic missing",
-						})
-					}
-				default:
-					_ = conn.WriteJSON(map[string]any{
-						"error": "type not handled, only json or object stringified",
-					})
-				}
-			}
-
-		case "sub", "subscribe":
-			if topic, ok := m["topic"]; ok {
-				if from, ok := m["from"]; ok {
-					server.subscribeWS(from.(string), topic.(string), conn)
-				} else if cc, ok := server.Bus.allWS.Get(conn); ok {
-					server.subscribeWS(cc, topic.(string), conn)
-				}
-			} else {
-				_ = conn.WriteJSON(map[string]any{
-					"error": "topic missing",
-				})
-			}
+// rejectWS write msg to conn before it is closed, the writer is stopped first so msg is not left in its queue
+func (server *Server) rejectWS(conn *ws.Conn, msg map[string]any) {
+	server.Bus.unregisterWriter(conn)
+	_ = server.Bus.writeTo(conn, msg)
+}
 
-		case "unsub", "unsubscribe":
-			if topic, ok := m["topic"]; ok {
-				server.unsubscribeWS(topic.(string), conn)
-			}
-		case "remove_topic", "removeTopic":
-			if topic, ok := m["topic"]; ok {
-				server.RemoveTopic(topic.(string))
-			} else {
-				_ = conn.WriteJSON(map[string]any{
-					"error": "topic missing",
+func (server *Server) handleActions(m map[string]any, conn *ws.Conn) {
+	frame, perr := decodeFrame(m)
+	if perr != nil {
+		_ = server.Bus.writeTo(conn, perr.message())
+		return
+	}
+	principal, _ := server.principals.Get(conn)
+	boundID, _ := server.Bus.allWS.Get(conn)
+	if err := server.authorizeWS(principal, conn, m); err != nil {
+		act, target, _ := wsAction(m)
+		server.dropDenied(act, target, m["data"], err)
+		_ = server.Bus.writeTo(conn, accessErrorMessage(err))
+		return
+	}
+	if server.duplicate(m) {
+		return
+	}
+	switch f := frame.(type) {
+	case *pubFrame:
+		switch v := f.Data.(type) {
+		case string:
+			server.publishWS(conn, f.Topic, map[string]any{
+				"data":  v,
+				"topic": f.Topic,
+			}, f.Opts)
+		case map[string]any:
+			server.authorizeSenderTopics(principal, boundID, v)
+			if eventID, ok := v["event_id"].(string); ok {
+				server.Publish(eventID, map[string]any{
+					"ok":   "done",
+					"from": server.ID,
 				})
 			}
-		case "server_message", "serverMessage":
-			if server.onServerData != nil {
-				if data, ok := m["data"]; ok {
-					if addr, ok := m["addr"]; ok && strings.Contains(addr.(string), server.Address) {
-						for _, fn := range server.onServerData {
-							fn(data, conn)
-						}
-					}
-				}
+			server.setFromWS(v, f.From, conn)
+			server.publishWS(conn, f.Topic, v, f.Opts)
+		}
+	case *subFrame:
+		if id, ok := server.idWS(f.From, conn); ok {
+			server.subscribeWS(id, f.Topic, conn, f.Queue, f.Ack, f.Replay)
+		} else if !f.Replay.isZero() {
+			server.replayWS(f.Topic, f.Replay, conn)
+		} else {
+			_ = server.Bus.writeTo(conn, (&ProtocolError{
+				Code:    CodeIDMissing,
+				Action:  "sub",
+				Field:   "from",
+				Message: "from is required before a ping bind the connection to an id",
+			}).message())
+		}
+	case *ackFrame:
+		server.Bus.ack(f.AckID, f.From, f.OK)
+	case *unsubFrame:
+		server.unsubscribeWS(f.Topic, conn)
+	case *removeTopicFrame:
+		server.RemoveTopic(f.Topic)
+	case *clearRetainedFrame:
+		server.ClearRetained(f.Topic)
+	case *serverMessageFrame:
+		if strings.Contains(f.Addr, server.Address) {
+			for _, fn := range server.onServerData {
+				fn(f.Data, conn)
 			}
-		case "pub_id":
-			if data, ok := m["data"]; ok {
-				switch v := data.(type) {
-				case string:
-					mm := map[string]any{
-						"data": v,
-					}
-					if id, ok := m["id"]; ok {
-						if id.(string) == server.ID {
-							if ddd, ok := m["data"].(map[string]any); ok {
-								if eventID, ok := ddd["event_id"]; ok {
-									server.Publish(eventID.(string), map[string]any{
-										"ok":   "done",
-										"from": server.ID,
-									})
-								} else {
-									if server.onId != nil {
-										server.onId(ddd)
-									}
-								}
-								return
-							}
-						}
-						if from, ok := m["from"]; ok {
-							mm["from"] = from
-						} else if cc, ok := server.Bus.allWS.Get(conn); ok {
-							mm["from"] = cc
-						}
-						server.PublishToID(id.(string), mm)
-					} else {
-						_ = conn.WriteJSON(map[string]any{
-							"error": "id missing",
-						})
-					}
-				case map[string]any:
-					if id, ok := m["id"]; ok {
-						if from, ok := m["from"]; ok {
-							v["from"] = from
-						} else if cc, ok := server.Bus.allWS.Get(conn); ok {
-							v["from"] = cc
-						}
-						if id.(string) == server.ID {
-							if eventID, ok := v["event_id"]; ok {
-								server.Publish(eventID.(string), map[string]any{
-									"ok":   "done",
-									"from": server.ID,
-								})
-							}
-							if server.onId != nil {
-								server.onId(v)
-							}
-							return
-						}
-						server.PublishToID(id.(string), v)
-					} else {
-						_ = conn.WriteJSON(map[string]any{
-							"error": "id missing",
-						})
-					}
-				default:
-					_ = conn.WriteJSON(map[string]any{
-						"error": "type not handled, only json",
-					})
-				}
+		}
+	case *pubIDFrame:
+		var data map[string]any
+		switch v := f.Data.(type) {
+		case string:
+			data = map[string]any{
+				"data": v,
 			}
-		case "pub_server":
-			if data, ok := m["data"]; ok {
-				switch v := data.(type) {
-				case string:
-					mm := map[string]any{
-						"data": v,
-					}
-					if addr, ok := m["addr"].(string); ok {
-						if strings.Contains(addr, server.Address) {
-							for _, fn := range server.onServerData {
-								fn(mm, conn)
-							}
-							return
-						}
-					}
-					if secure, ok := m["secure"]; ok && secure.(bool) {
-						err := server.PublishToServer(m["addr"].(string), mm, true)
-						if err != nil {
-							_ = conn.WriteJSON(map[string]any{
-								"error": err.Error(),
-							})
-						}
-					} else {
-						err := server.PublishToServer(m["addr"].(string), mm)
-						if err != nil {
-							_ = conn.WriteJSON(map[string]any{
-								"error": err.Error(),
-							})
-						}
-					}
-				case map[string]any:
-					if addr, ok := m["addr"].(string); ok {
-						if strings.Contains(addr, server.Address) {
-							for _, fn := range server.onServerData {
-								fn(m, conn)
-							}
-							return
-						}
-					}
-					if secure, ok := m["secure"]; ok && secure.(bool) {
-						err := server.PublishToServer(m["addr"].(string), v, true)
-						if err != nil {
-							_ = conn.WriteJSON(map[string]any{
-								"error": err.Error(),
-							})
-						}
-					} else {
-						err := server.PublishToServer(m["addr"].(string), v)
-						if err != nil {
-							_ = conn.WriteJSON(map[string]any{
-								"error": err.Error(),
-							})
-						}
-					}
-				default:
-					_ = conn.WriteJSON(map[string]any{
-						"error": "type not handled, only json",
-					})
-				}
+		case map[string]any:
+			data = v
+		}
+		server.setFromWS(data, f.From, conn)
+		server.authorizeSenderTopics(principal, boundID, data)
+		if f.ID == server.ID {
+			if eventID, ok := data["event_id"].(string); ok {
+				server.Publish(eventID, map[string]any{
+					"ok":   "done",
+					"from": server.ID,
+				})
 			}
-		case "ping":
-			var from string
-			if from, ok = m["from"].(string); !ok {
-				from = GenerateUUID()
+			if server.onId != nil {
+				server.onId(data)
 			}
-			found := false
-			for _, v := range server.Bus.allWS.Values() {
-				if v == from {
-					found = true
-				}
+			return
+		}
+		server.publishToIDWS(conn, f.ID, data, f.Opts)
+	case *pubServerFrame:
+		var data map[string]any
+		// local handlers get the whole message when data is an object
+		var local any = m
+		switch v := f.Data.(type) {
+		case string:
+			data = map[string]any{
+				"data": v,
 			}
-			if !found {
-				server.Bus.allWS.Set(conn, from)
-				server.Bus.idConn.Set(from, conn)
-			} else {
-				_ = conn.WriteJSON(map[string]any{
-					"error": "ID already exist, should be unique",
-				})
+			local = data
+		case map[string]any:
+			data = v
+		}
+		if strings.Contains(f.Addr, server.Address) {
+			for _, fn := range server.onServerData {
+				fn(local, conn)
 			}
-			_ = conn.WriteJSON(map[string]any{
+			return
+		}
+		if err := server.PublishToServer(f.Addr, data, f.Secure); err != nil {
+			_ = server.Bus.writeTo(conn, errorMessage(CodePublishFailed, err))
+		}
+	case *pingFrame:
+		// connections already bound, by authentication or a previous ping, keep their id
+		if id, bound := server.Bus.allWS.Get(conn); bound {
+			_ = server.Bus.writeTo(conn, map[string]any{
 				"data": "pong",
+				"id":   id,
 			})
-		default:
-			_ = conn.WriteJSON(map[string]any{
-				"error": "action " + action.(string) + " not handled",
-			})
+			return
+		}
+		from := f.From
+		if from == "" {
+			from = GenerateUUID()
 		}
+		found := server.idTaken(from)
+		for _, v := range server.Bus.allWS.Values() {
+			if v == from {
+				found = true
+			}
+		}
+		if !found {
+			server.Bus.allWS.Set(conn, from)
+			server.Bus.idConn.Set(from, conn)
+			server.announceID(from, true)
+		} else {
+			_ = server.Bus.writeTo(conn, (&ProtocolError{
+				Code:    CodeIDTaken,
+				Action:  "ping",
+				Field:   "from",
+				Message: "ID already exist, should be unique",
+			}).message())
+			return
+		}
+		_ = server.Bus.writeTo(conn, map[string]any{
+			"data": "pong",
+			"id":   from,
+		})
+	}
+}
+
+// idWS return from, or the id bound to conn if from is empty
+func (server *Server) idWS(from string, conn *ws.Conn) (string, bool) {
+	if from != "" {
+		return from, true
+	}
+	return server.Bus.allWS.Get(conn)
+}
+
+// setFromWS set the from field of data published by conn
+func (server *Server) setFromWS(data map[string]any, from string, conn *ws.Conn) {
+	if id, ok := server.idWS(from, conn); ok {
+		data["from"] = id
 	}
 }
 
@@ -369,21 +397,29 @@ func RunEvery(t time.Duration, fn func() bool) {
 	}
 }
 
+// RetryEvery call function every t until it succeed or maxRetry calls are made, t <= 0 retry without waiting, see RetryBackoff for increasing delays
 func RetryEvery(t time.Duration, function func() error, maxRetry ...int) {
-	i := 0
-	err := function()
-	for err != nil {
-		time.Sleep(t)
-		i++
-		if len(maxRetry) > 0 {
-			if i < maxRetry[0] {
-				err = function()
-			} else {
-				lg.Info("max retry exceeded", "max", maxRetry)
-				break
-			}
-		} else {
-			err = function()
+	attempts := 0
+	if len(maxRetry) > 0 {
+		attempts = max(maxRetry[0], 1)
+	}
+	if t > 0 {
+		_ = RetryBackoff(Backoff{Initial: t, Max: t, Multiplier: 1, MaxAttempts: attempts}, function)
+		return
+	}
+	for n := 1; function() != nil; n++ {
+		if attempts > 0 && n >= attempts {
+			lg.Info("max retry exceeded", "max", attempts)
+			return
 		}
 	}
 }
+
+// RetryBackoff call function with the delays of b until it succeed, it return the last error once b.MaxAttempts calls are made or b.Ctx is done
+func RetryBackoff(b Backoff, function func() error) error {
+	err := b.Retry(function)
+	if err != nil {
+		lg.Info("retry stopped", "err", err)
+	}
+	return err
+}
@@ -0,0 +1,496 @@
+package ksbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kamalshkeir/lg"
+)
+
+// LogOpts configure the durable message log, an append only log split in segment files
+type LogOpts struct {
+	Dir          string        // directory of segment files, required
+	Topics       []string      // topics recorded, wildcards accepted, all topics if empty
+	SegmentBytes int64         // size of a segment before rolling to a new one, default 16MB
+	MaxAge       time.Duration // closed segments older than MaxAge are deleted, 0 keep forever
+	MaxBytes     int64         // oldest closed segments are deleted while the log is bigger, 0 no limit
+	Compact      bool          // closed segments only keep the last message of each topic
+	CleanEvery   time.Duration // retention and compaction interval, default 1 minute
+}
+
+// SeqKey is the field holding the durable log sequence of a message, only the log set it, publishers cannot
+const SeqKey = "$seq"
+
+// LogRecord is a message stored in the durable log
+type LogRecord struct {
+	Seq   uint64         `json:"seq"`
+	Time  int64          `json:"ts"` // unix nano
+	Topic string         `json:"topic"`
+	Data  map[string]any `json:"data"`
+}
+
+// Replay select where a subscription resume from in the durable log
+type Replay struct {
+	Seq   uint64    // resume from this sequence included
+	Since time.Time // resume from this time, used if Seq is 0
+}
+
+func (r Replay) isZero() bool {
+	return r.Seq == 0 && r.Since.IsZero()
+}
+
+func (r Replay) match(rec *LogRecord) bool {
+	if r.Seq > 0 {
+		return rec.Seq >= r.Seq
+	}
+	return rec.Time >= r.Since.UnixNano()
+}
+
+const segmentExt = ".log"
+
+type msgLog struct {
+	opts    LogOpts
+	active  *os.File
+	size    int64
+	lastSeq uint64
+	mu      sync.Mutex
+	done    chan struct{}
+}
+
+func openMsgLog(opts LogOpts) (*msgLog, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("durable log dir is empty")
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 16 << 20
+	}
+	if opts.CleanEvery <= 0 {
+		opts.CleanEvery = time.Minute
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &msgLog{
+		opts: opts,
+		done: make(chan struct{}),
+	}
+	segs, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		if err := l.roll(1); err != nil {
+			return nil, err
+		}
+	} else {
+		last := segs[len(segs)-1]
+		l.lastSeq = last.first - 1
+		err := readSegment(last.path, func(rec *LogRecord) bool {
+			l.lastSeq = rec.Seq
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(last.path, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		l.active, l.size = f, st.Size()
+	}
+	go l.cleaner()
+	return l, nil
+}
+
+type segment struct {
+	first uint64
+	path  string
+}
+
+// segments return segment files sorted by first sequence
+func (l *msgLog) segments() ([]segment, error) {
+	entries, err := os.ReadDir(l.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	segs := []segment{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{first: first, path: filepath.Join(l.opts.Dir, name)})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].first < segs[j].first })
+	return segs, nil
+}
+
+// roll close the active segment and open a new one starting at first, l.mu must be held
+func (l *msgLog) roll(first uint64) error {
+	if l.active != nil {
+		_ = l.active.Close()
+	}
+	path := filepath.Join(l.opts.Dir, fmt.Sprintf("%020d%s", first, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	l.active, l.size = f, 0
+	return nil
+}
+
+func (l *msgLog) records(topic string) bool {
+	if len(l.opts.Topics) == 0 {
+		return true
+	}
+	for _, t := range l.opts.Topics {
+		if MatchTopic(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// append record data on topic and set its sequence in data[SeqKey]
+func (l *msgLog) append(topic string, data map[string]any) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+		return 0, fmt.Errorf("durable log closed")
+	default:
+	}
+	rec := LogRecord{
+		Seq:   l.lastSeq + 1,
+		Time:  time.Now().UnixNano(),
+		Topic: topic,
+		Data:  data,
+	}
+	data[SeqKey] = rec.Seq
+	b, err := json.Marshal(rec)
+	if err != nil {
+		delete(data, SeqKey)
+		return 0, err
+	}
+	if l.size > 0 && l.size+int64(len(b))+1 > l.opts.SegmentBytes {
+		if err := l.roll(rec.Seq); err != nil {
+			delete(data, SeqKey)
+			return 0, err
+		}
+	}
+	n, err := l.active.Write(append(b, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		delete(data, SeqKey)
+		return 0, err
+	}
+	l.lastSeq = rec.Seq
+	return rec.Seq, nil
+}
+
+// replay call fn for each record of topic starting at from, until fn return false
+func (l *msgLog) replay(topic string, from Replay, fn func(rec *LogRecord) bool) error {
+	l.mu.Lock()
+	last := l.lastSeq
+	segs, err := l.segments()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, seg := range segs {
+		if from.Seq > 0 && i+1 < len(segs) && segs[i+1].first <= from.Seq {
+			continue
+		}
+		stop := false
+		err := readSegment(seg.path, func(rec *LogRecord) bool {
+			if rec.Seq > last {
+				stop = true
+				return false
+			}
+			if !from.match(rec) || !MatchTopic(topic, rec.Topic) {
+				return true
+			}
+			if !fn(rec) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+func readSegment(path string, fn func(rec *LogRecord) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for sc.Scan() {
+		var rec LogRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// partial write at the end of a segment
+			continue
+		}
+		if !fn(&rec) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+func (l *msgLog) cleaner() {
+	t := time.NewTicker(l.opts.CleanEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			if err := l.clean(); err != nil {
+				lg.Error("durable log clean", "err", err)
+			}
+		}
+	}
+}
+
+// clean apply retention by age and size and compaction on closed segments
+func (l *msgLog) clean() error {
+	l.mu.Lock()
+	segs, err := l.segments()
+	activePath := ""
+	if l.active != nil {
+		activePath = l.active.Name()
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	closed := make([]segment, 0, len(segs))
+	for _, s := range segs {
+		if s.path != activePath {
+			closed = append(closed, s)
+		}
+	}
+
+	if l.opts.MaxAge > 0 {
+		limit := time.Now().Add(-l.opts.MaxAge)
+		kept := closed[:0]
+		for _, s := range closed {
+			if st, err := os.Stat(s.path); err == nil && st.ModTime().Before(limit) {
+				_ = os.Remove(s.path)
+				continue
+			}
+			kept = append(kept, s)
+		}
+		closed = kept
+	}
+
+	if l.opts.MaxBytes > 0 {
+		var total int64
+		sizes := make([]int64, len(segs))
+		for i, s := range segs {
+			if st, err := os.Stat(s.path); err == nil {
+				sizes[i] = st.Size()
+				total += st.Size()
+			}
+		}
+		for len(closed) > 0 && total > l.opts.MaxBytes {
+			for i, s := range segs {
+				if s.path == closed[0].path {
+					total -= sizes[i]
+				}
+			}
+			_ = os.Remove(closed[0].path)
+			closed = closed[1:]
+		}
+	}
+
+	if l.opts.Compact && len(closed) > 0 {
+		return l.compact(closed, activePath)
+	}
+	return nil
+}
+
+// compact rewrite closed segments keeping only the last record of each topic in the whole log
+func (l *msgLog) compact(closed []segment, activePath string) error {
+	latest := map[string]uint64{}
+	all := append(append([]segment{}, closed...), segment{path: activePath})
+	for _, s := range all {
+		if s.path == "" {
+			continue
+		}
+		err := readSegment(s.path, func(rec *LogRecord) bool {
+			latest[rec.Topic] = rec.Seq
+			return true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, s := range closed {
+		tmp := s.path + ".compact"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		kept := 0
+		err = readSegment(s.path, func(rec *LogRecord) bool {
+			if latest[rec.Topic] != rec.Seq {
+				return true
+			}
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return true
+			}
+			_, _ = w.Write(append(b, '\n'))
+			kept++
+			return true
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		f.Close()
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		if kept == 0 {
+			_ = os.Remove(tmp)
+			_ = os.Remove(s.path)
+			continue
+		}
+		// keep modification time, retention by age rely on it
+		if st, err := os.Stat(s.path); err == nil {
+			_ = os.Chtimes(tmp, st.ModTime(), st.ModTime())
+		}
+		if err := os.Rename(tmp, s.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *msgLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+		return nil
+	default:
+		close(l.done)
+	}
+	if l.active != nil {
+		return l.active.Close()
+	}
+	return nil
+}
+
+// replayGate hold the messages published to a new subscriber while the durable log is replayed to it, so they are delivered after the replay and once
+type replayGate struct {
+	mu      sync.Mutex
+	open    bool
+	last    uint64 // last sequence replayed
+	max     int
+	pending []gatedMsg
+}
+
+type gatedMsg struct {
+	seq    uint64
+	hasSeq bool
+	send   func()
+}
+
+// hold return true if the message must not be sent now, send is kept until release or the message was already replayed, full is true if it was dropped
+func (g *replayGate) hold(seq uint64, hasSeq bool, send func()) (held, full bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if hasSeq && seq <= g.last {
+		return true, false
+	}
+	if g.open {
+		return false, false
+	}
+	if g.max > 0 && len(g.pending) >= g.max {
+		return true, true
+	}
+	g.pending = append(g.pending, gatedMsg{seq: seq, hasSeq: hasSeq, send: send})
+	return true, false
+}
+
+// release send the held messages not replayed, last is the last sequence replayed, messages are then sent directly
+func (g *replayGate) release(last uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last = last
+	for _, m := range g.pending {
+		if !m.hasSeq || m.seq > last {
+			m.send()
+		}
+	}
+	g.pending = nil
+	g.open = true
+}
+
+// trackSeq keep in last the highest durable log sequence seen in data
+func trackSeq(last *atomic.Uint64, data map[string]any) {
+	seq, ok := toUint64(data[SeqKey])
+	if !ok {
+		return
+	}
+	for {
+		cur := last.Load()
+		if seq <= cur || last.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+// toUint64 convert a number decoded from json or gob
+func toUint64(v any) (uint64, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return n, true
+	case int:
+		return uint64(n), n >= 0
+	case int64:
+		return uint64(n), n >= 0
+	case uint:
+		return uint64(n), true
+	case uint32:
+		return uint64(n), true
+	case float64:
+		return uint64(n), n >= 0
+	case json.Number:
+		u, err := strconv.ParseUint(string(n), 10, 64)
+		return u, err == nil
+	}
+	return 0, false
+}
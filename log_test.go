@@ -0,0 +1,202 @@
+package ksbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogReplay(t *testing.T) {
+	bus := New()
+	if err := bus.WithDurableLog(LogOpts{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	for _, topic := range []string{"orders.1", "users.1", "orders.2", "orders.3"} {
+		bus.Publish(topic, map[string]any{"n": topic})
+	}
+	tests := []struct {
+		name  string
+		topic string
+		from  Replay
+		want  []uint64
+	}{
+		{"from first seq", "orders.*", Replay{Seq: 1}, []uint64{1, 3, 4}},
+		{"from seq", "orders.*", Replay{Seq: 3}, []uint64{3, 4}},
+		{"exact topic", "users.1", Replay{Seq: 1}, []uint64{2}},
+		{"since", "#", Replay{Since: time.Now().Add(-time.Minute)}, []uint64{1, 2, 3, 4}},
+		{"since future", "#", Replay{Since: time.Now().Add(time.Minute)}, nil},
+		{"after last", "#", Replay{Seq: 5}, nil},
+	}
+	for _, tt := range tests {
+		var got []uint64
+		err := bus.Replay(tt.topic, tt.from, func(rec LogRecord) bool {
+			got = append(got, rec.Seq)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLogReopenKeepSeq(t *testing.T) {
+	dir := t.TempDir()
+	bus := New()
+	if err := bus.WithDurableLog(LogOpts{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish("a", map[string]any{})
+	bus.Publish("a", map[string]any{})
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bus.log.append("a", map[string]any{}); err == nil {
+		t.Fatal("append after close should fail")
+	}
+
+	bus = New()
+	if err := bus.WithDurableLog(LogOpts{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	data := map[string]any{}
+	bus.Publish("a", data)
+	if seq, _ := toUint64(data[SeqKey]); seq != 3 {
+		t.Fatalf("seq after reopen = %v, want 3", data[SeqKey])
+	}
+}
+
+func TestReplayGate(t *testing.T) {
+	tests := []struct {
+		name string
+		held []uint64 // sequences published during the replay, 0 for messages not logged
+		last uint64
+		want []uint64
+	}{
+		{"nothing held", nil, 3, nil},
+		{"replayed skipped", []uint64{2, 3, 4, 5}, 3, []uint64{4, 5}},
+		{"not logged kept", []uint64{0, 3, 4}, 3, []uint64{0, 4}},
+		{"empty replay", []uint64{1, 2}, 0, []uint64{1, 2}},
+	}
+	for _, tt := range tests {
+		g := &replayGate{}
+		var got []uint64
+		for _, seq := range tt.held {
+			held, full := g.hold(seq, seq > 0, func() { got = append(got, seq) })
+			if !held || full {
+				t.Fatalf("%s: hold(%d) = %v, %v, want held", tt.name, seq, held, full)
+			}
+		}
+		g.release(tt.last)
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		// after release replayed messages are skipped and others sent directly
+		if held, _ := g.hold(tt.last, tt.last > 0, func() {}); tt.last > 0 && !held {
+			t.Fatalf("%s: replayed seq %d not skipped after release", tt.name, tt.last)
+		}
+		if held, _ := g.hold(tt.last+100, true, func() {}); held {
+			t.Fatalf("%s: new message held after release", tt.name)
+		}
+	}
+}
+
+func TestReplayGateFull(t *testing.T) {
+	g := &replayGate{max: 1}
+	if _, full := g.hold(1, true, func() {}); full {
+		t.Fatal("first message dropped")
+	}
+	if held, full := g.hold(2, true, func() {}); !held || !full {
+		t.Fatalf("hold = %v, %v, want held and full", held, full)
+	}
+}
+
+func TestPublishHeldDuringReplay(t *testing.T) {
+	bus := New()
+	if err := bus.WithDurableLog(LogOpts{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	bus.Publish("a", map[string]any{})
+	ch := make(chan map[string]any, 10)
+	sub := Subscriber{bus: bus, Id: "c", Topic: "a", Ch: ch, gate: &replayGate{}}
+	bus.addSubscriber(sub)
+	bus.Publish("a", map[string]any{})
+	select {
+	case <-ch:
+		t.Fatal("message delivered during the replay")
+	default:
+	}
+	var last uint64
+	_ = bus.Replay("a", Replay{Seq: 1}, func(rec LogRecord) bool {
+		ch <- rec.Data
+		last = rec.Seq
+		return true
+	})
+	sub.gate.release(last)
+	bus.Publish("a", map[string]any{})
+	for want := uint64(1); want <= 3; want++ {
+		select {
+		case data := <-ch:
+			if seq, _ := toUint64(data[SeqKey]); seq != want {
+				t.Fatalf("seq = %d, want %d", seq, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("seq %d not received", want)
+		}
+	}
+	select {
+	case data := <-ch:
+		t.Fatalf("duplicate %v", data[SeqKey])
+	default:
+	}
+}
+
+func TestLogSeqKeepPayload(t *testing.T) {
+	bus := New()
+	if err := bus.WithDurableLog(LogOpts{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	bus.Publish("a", map[string]any{})
+	tests := []struct {
+		name    string
+		data    map[string]any
+		wantSeq uint64
+	}{
+		{"payload seq", map[string]any{"seq": 99}, 2},
+		{"forged log seq", map[string]any{SeqKey: uint64(1000)}, 3},
+		{"forged replayed seq", map[string]any{SeqKey: uint64(1)}, 4},
+	}
+	for _, tt := range tests {
+		payload := tt.data["seq"]
+		bus.Publish("a", tt.data)
+		if seq, _ := toUint64(tt.data[SeqKey]); seq != tt.wantSeq {
+			t.Errorf("%s: log seq %v, want %d", tt.name, tt.data[SeqKey], tt.wantSeq)
+		}
+		if tt.data["seq"] != payload {
+			t.Errorf("%s: payload seq %v, want %v", tt.name, tt.data["seq"], payload)
+		}
+	}
+
+	// without log the forged sequence is removed
+	bus = New()
+	data := map[string]any{"seq": 1, SeqKey: uint64(7)}
+	bus.Publish("a", data)
+	if _, ok := data[SeqKey]; ok || data["seq"] != 1 {
+		t.Fatalf("got %v", data)
+	}
+}
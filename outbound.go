@@ -0,0 +1,188 @@
+package ksbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+// OverflowPolicy decide what happen when the outbound queue of a websocket connection is full
+type OverflowPolicy int
+
+const (
+	// DropOldest drop the oldest queued message to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest drop the new message
+	DropNewest
+	// DisconnectSlow close the connection of the slow consumer
+	DisconnectSlow
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop_oldest"
+	case DropNewest:
+		return "drop_newest"
+	case DisconnectSlow:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// DefaultOutboundQueueSize is the number of messages queued per websocket connection
+var DefaultOutboundQueueSize = 256
+
+// connWriter own all writes on a websocket connection, messages are queued and written by its goroutine
+type connWriter struct {
+	conn  *ws.Conn
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+	mu    sync.Mutex
+}
+
+// queueSize return the size of outbound queues
+func (b *Bus) queueSize() int {
+	if b.outboundSize <= 0 {
+		return DefaultOutboundQueueSize
+	}
+	return b.outboundSize
+}
+
+// registerWriter start the writer goroutine of conn
+func (b *Bus) registerWriter(conn *ws.Conn) *connWriter {
+	w := &connWriter{
+		conn:  conn,
+		queue: make(chan []byte, b.queueSize()),
+		done:  make(chan struct{}),
+	}
+	b.writers.Set(conn, w)
+	go w.run()
+	return w
+}
+
+// unregisterWriter stop the writer goroutine of conn
+func (b *Bus) unregisterWriter(conn *ws.Conn) {
+	if w, ok := b.writers.Get(conn); ok {
+		w.stop()
+		b.writers.Delete(conn)
+	}
+}
+
+func (w *connWriter) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case msg := <-w.queue:
+			if err := w.conn.WriteMessage(ws.TextMessage, msg); err != nil {
+				// the read loop of the connection fail too and clean its subscriptions
+				_ = w.conn.Close()
+				w.stop()
+				return
+			}
+		}
+	}
+}
+
+func (w *connWriter) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// push queue msg, if wait is true it block until there is room instead of applying the overflow policy
+//
+// dropped hold every message dropped, the oldest ones for DropOldest or msg for the other policies
+func (w *connWriter) push(msg []byte, policy OverflowPolicy, wait bool) (dropped [][]byte, err error) {
+	select {
+	case <-w.done:
+		return nil, ErrClosed
+	default:
+	}
+	if wait {
+		select {
+		case w.queue <- msg:
+			return nil, nil
+		case <-w.done:
+			return nil, ErrClosed
+		}
+	}
+	select {
+	case w.queue <- msg:
+		return nil, nil
+	default:
+	}
+	switch policy {
+	case DropNewest:
+		return [][]byte{msg}, ErrSlowConsumer
+	case DisconnectSlow:
+		_ = w.conn.Close()
+		w.stop()
+		return [][]byte{msg}, ErrSlowConsumer
+	default:
+		// serialize drop oldest, so concurrent publishers don't drop more than needed
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for {
+			select {
+			case w.queue <- msg:
+				return dropped, nil
+			default:
+			}
+			select {
+			case old := <-w.queue:
+				dropped = append(dropped, old)
+			default:
+			}
+		}
+	}
+}
+
+// writeTo send data to conn through its outbound queue, conns without writer are written directly
+func (b *Bus) writeTo(conn *ws.Conn, data any) error {
+	msg, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return b.writeRaw(conn, msg, false)
+}
+
+// writeToWait is like writeTo but wait for room in the queue, used for replays that must not be dropped
+func (b *Bus) writeToWait(conn *ws.Conn, data any) error {
+	msg, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return b.writeRaw(conn, msg, true)
+}
+
+func (b *Bus) writeRaw(conn *ws.Conn, msg []byte, wait bool) error {
+	w, ok := b.writers.Get(conn)
+	if !ok {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return conn.WriteMessage(ws.TextMessage, msg)
+	}
+	dropped, err := w.push(msg, b.overflow, wait)
+	if len(dropped) > 0 && b.onOverflow != nil {
+		id, _ := b.allWS.Get(conn)
+		for _, d := range dropped {
+			b.onOverflow(id, b.overflow, d)
+		}
+	}
+	// a new message dropped is returned as an error and recorded by the publisher
+	if err == nil {
+		for _, d := range dropped {
+			b.dropRaw(DropSlowConsumer, conn, d)
+		}
+	}
+	if err != nil {
+		id, _ := b.allWS.Get(conn)
+		return fmt.Errorf("connection %s: %w", id, err)
+	}
+	return nil
+}
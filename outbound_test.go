@@ -0,0 +1,51 @@
+package ksbus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConnWriterPush(t *testing.T) {
+	tests := []struct {
+		policy      OverflowPolicy
+		wantDropped []string
+		wantErr     error
+		wantQueue   []string
+	}{
+		{DropOldest, []string{"1"}, nil, []string{"2", "3"}},
+		{DropNewest, []string{"3"}, ErrSlowConsumer, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		w := &connWriter{queue: make(chan []byte, 2), done: make(chan struct{})}
+		for _, m := range []string{"1", "2"} {
+			if dropped, err := w.push([]byte(m), tt.policy, false); err != nil || dropped != nil {
+				t.Fatalf("%s: push %s = %v, %v", tt.policy, m, dropped, err)
+			}
+		}
+		dropped, err := w.push([]byte("3"), tt.policy, false)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: err = %v, want %v", tt.policy, err, tt.wantErr)
+		}
+		if len(dropped) != len(tt.wantDropped) {
+			t.Fatalf("%s: dropped %q, want %q", tt.policy, dropped, tt.wantDropped)
+		}
+		for i := range dropped {
+			if string(dropped[i]) != tt.wantDropped[i] {
+				t.Fatalf("%s: dropped %q, want %q", tt.policy, dropped, tt.wantDropped)
+			}
+		}
+		for _, want := range tt.wantQueue {
+			if got := string(<-w.queue); got != want {
+				t.Fatalf("%s: queued %s, want %s", tt.policy, got, want)
+			}
+		}
+	}
+}
+
+func TestConnWriterClosed(t *testing.T) {
+	w := &connWriter{queue: make(chan []byte, 1), done: make(chan struct{})}
+	w.stop()
+	if _, err := w.push([]byte("1"), DropOldest, false); !errors.Is(err, ErrClosed) {
+		t.Fatalf("err = %v, want ErrClosed", err)
+	}
+}
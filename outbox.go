@@ -0,0 +1,295 @@
+package ksbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kamalshkeir/kmap"
+	"github.com/kamalshkeir/lg"
+)
+
+// DedupWindow is how long the server remember the msg_id of published messages to drop the ones sent again
+var DedupWindow = 2 * time.Minute
+
+// DedupSize is the number of msg_id remembered per sender, the oldest is forgotten first
+var DedupSize = 1024
+
+// outbox queue the publishes of a disconnected client, in memory or in a spool file
+type outbox struct {
+	mu        sync.Mutex
+	connected bool
+	limit     int
+	frames    []map[string]any
+	spool     string
+	spooled   int
+}
+
+func newOutbox(limit int, spool string) *outbox {
+	o := &outbox{limit: limit, spool: spool}
+	if spool == "" {
+		return o
+	}
+	// messages left by a previous run are sent after connecting
+	if f, err := os.Open(spool); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			o.spooled++
+		}
+		f.Close()
+	}
+	return o
+}
+
+func (o *outbox) len() int {
+	if o.spool != "" {
+		return o.spooled
+	}
+	return len(o.frames)
+}
+
+// push queue frame if the client is disconnected or frames are waiting, it return false when the frame should be written now
+func (o *outbox) push(frame map[string]any) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// frames queued before are sent first
+	if o.connected && o.len() == 0 {
+		return false, nil
+	}
+	return true, o.add(frame)
+}
+
+// add queue frame, o.mu must be held
+func (o *outbox) add(frame map[string]any) error {
+	if o.len() >= o.limit {
+		return ErrOutboxFull
+	}
+	if o.spool == "" {
+		o.frames = append(o.frames, frame)
+		return nil
+	}
+	b, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.spool, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	o.spooled++
+	return nil
+}
+
+// requeue queue again a frame whose write failed
+func (o *outbox) requeue(frame map[string]any) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.add(frame)
+}
+
+// disconnected make next publishes queued
+func (o *outbox) disconnected() {
+	o.mu.Lock()
+	o.connected = false
+	o.mu.Unlock()
+}
+
+// flush write queued frames in order then mark the client connected, frames not written stay queued
+func (o *outbox) flush(write func(frame map[string]any) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	frames := o.frames
+	if o.spool != "" {
+		var err error
+		frames, err = o.readSpool()
+		if err != nil {
+			return err
+		}
+	}
+	for i, frame := range frames {
+		if err := write(frame); err != nil {
+			o.keep(frames[i:])
+			return err
+		}
+	}
+	o.keep(nil)
+	o.connected = true
+	return nil
+}
+
+func (o *outbox) readSpool() ([]map[string]any, error) {
+	f, err := os.Open(o.spool)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frames := []map[string]any{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		frame := map[string]any{}
+		if err := json.Unmarshal(sc.Bytes(), &frame); err != nil {
+			lg.Error("skipping corrupted spooled message", "spool", o.spool, "err", err)
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	return frames, sc.Err()
+}
+
+// keep replace queued frames by frames, o.mu must be held
+func (o *outbox) keep(frames []map[string]any) {
+	if o.spool == "" {
+		o.frames = frames
+		return
+	}
+	o.spooled = 0
+	if err := os.Truncate(o.spool, 0); err != nil && !os.IsNotExist(err) {
+		lg.Error("error truncating spool", "spool", o.spool, "err", err)
+	}
+	for _, frame := range frames {
+		if err := o.add(frame); err != nil {
+			lg.Error("error spooling message", "spool", o.spool, "err", err)
+		}
+	}
+}
+
+// publishFrame write a pub or pub_id frame, or queue it while the client is disconnected
+func (client *Client) publishFrame(ctx context.Context, frame map[string]any) error {
+	// without Autorestart nothing would send the queued frames
+	if client.outbox == nil || !client.Autorestart {
+		return client.writeJSON(ctx, frame)
+	}
+	if client.stopped() {
+		return ErrClosed
+	}
+	// set before the first write, so the server can drop the frame if it is sent again after a failed write
+	frame["msg_id"] = GenerateUUID()
+	queued, err := client.outbox.push(frame)
+	if queued || err != nil {
+		return err
+	}
+	err = client.writeJSON(ctx, frame)
+	if err != nil && ctx.Err() == nil && !client.stopped() {
+		return client.outbox.requeue(frame)
+	}
+	return err
+}
+
+// stopped return true once the client is closed or gave up reconnecting
+func (client *Client) stopped() bool {
+	if client.closing.Load() {
+		return true
+	}
+	select {
+	case <-client.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushOutbox send the publishes queued while disconnected, subscriptions should be restored before
+func (client *Client) flushOutbox() {
+	if client.outbox == nil {
+		return
+	}
+	err := client.outbox.flush(func(frame map[string]any) error {
+		return client.writeJSON(context.Background(), frame)
+	})
+	if err != nil {
+		lg.Error("error flushing offline messages", "err", err)
+	}
+}
+
+// Buffered return the number of publishes waiting for the connection
+func (client *Client) Buffered() int {
+	if client.outbox == nil {
+		return 0
+	}
+	client.outbox.mu.Lock()
+	defer client.outbox.mu.Unlock()
+	return client.outbox.len()
+}
+
+// dedupWindow keep the last msg_ids of a sender in a ring, the oldest is forgotten when it is full
+type dedupWindow struct {
+	mu   sync.Mutex
+	ids  map[string]int64 // msg_id to unix nano
+	ring []string
+	next int
+	last int64 // unix nano of the last msg_id
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		ids:  make(map[string]int64, size),
+		ring: make([]string, max(size, 1)),
+	}
+}
+
+// seen report if id was recorded during DedupWindow, then record it
+func (w *dedupWindow) seen(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now().UnixNano()
+	w.last = now
+	at, ok := w.ids[id]
+	if ok && time.Duration(now-at) < DedupWindow {
+		return true
+	}
+	w.ids[id] = now
+	if ok {
+		return false
+	}
+	if old := w.ring[w.next]; old != "" {
+		delete(w.ids, old)
+	}
+	w.ring[w.next] = id
+	w.next = (w.next + 1) % len(w.ring)
+	return false
+}
+
+func (w *dedupWindow) idle(before int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last < before
+}
+
+// duplicate report if the msg_id of m was already handled, ids are scoped by sender, senders idle during DedupWindow are forgotten
+func (s *Server) duplicate(m map[string]any) bool {
+	msgID, _ := m["msg_id"].(string)
+	if msgID == "" {
+		return false
+	}
+	s.dedupOnce.Do(func() {
+		s.seenMsgs = kmap.New[string, *dedupWindow](100)
+		go RunEvery(DedupWindow, func() bool {
+			select {
+			case <-s.done:
+				return true
+			default:
+			}
+			before := time.Now().Add(-DedupWindow).UnixNano()
+			for _, from := range s.seenMsgs.Keys() {
+				if w, ok := s.seenMsgs.Get(from); ok && w.idle(before) {
+					s.seenMsgs.Delete(from)
+				}
+			}
+			return false
+		})
+	})
+	from, _ := m["from"].(string)
+	w := s.seenMsgs.GetOrCompute(from, func() *dedupWindow { return newDedupWindow(DedupSize) })
+	return w.seen(msgID)
+}
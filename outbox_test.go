@@ -0,0 +1,77 @@
+package ksbus
+
+import (
+	"testing"
+)
+
+func TestDedupWindow(t *testing.T) {
+	w := newDedupWindow(2)
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"a", false},
+		{"a", true},
+		{"b", false},
+		{"a", true},
+		{"c", false}, // a is forgotten, the window is full
+		{"a", false},
+		{"b", false},
+		{"a", true},
+	}
+	for i, tt := range tests {
+		if got := w.seen(tt.id); got != tt.want {
+			t.Errorf("%d: seen(%q) = %v, want %v", i, tt.id, got, tt.want)
+		}
+	}
+	if len(w.ids) != 2 {
+		t.Fatalf("window keep %d ids, want 2", len(w.ids))
+	}
+}
+
+func TestServerDuplicate(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	tests := []struct {
+		from, msgID string
+		want        bool
+	}{
+		{"alice", "", false},
+		{"alice", "", false},
+		{"alice", "1", false},
+		{"alice", "1", true},
+		{"bob", "1", false},
+		{"bob", "2", false},
+	}
+	for _, tt := range tests {
+		m := map[string]any{"from": tt.from, "msg_id": tt.msgID}
+		if got := s.duplicate(m); got != tt.want {
+			t.Errorf("duplicate(%s, %q) = %v, want %v", tt.from, tt.msgID, got, tt.want)
+		}
+	}
+}
+
+func TestOutboxKeepOrder(t *testing.T) {
+	o := newOutbox(10, "")
+	o.connected = true
+	// a failed write is queued again while the client is still marked connected
+	if err := o.requeue(map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	queued, err := o.push(map[string]any{"n": 2})
+	if err != nil || !queued {
+		t.Fatalf("publish written before the queued one, queued %v err %v", queued, err)
+	}
+	var sent []any
+	if err := o.flush(func(frame map[string]any) error {
+		sent = append(sent, frame["n"])
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[0] != 1 || sent[1] != 2 {
+		t.Fatalf("sent %v, want [1 2]", sent)
+	}
+	if queued, _ := o.push(map[string]any{"n": 3}); queued {
+		t.Fatal("publish queued once the outbox is empty")
+	}
+}
@@ -0,0 +1,173 @@
+package ksbus
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	// PresenceJoinTopic receive {"id", "server"} when a client id connect to a server
+	PresenceJoinTopic = "$sys.presence.join"
+	// PresenceLeaveTopic receive {"id", "server"} when a client id disconnect
+	PresenceLeaveTopic = "$sys.presence.leave"
+	// PresenceQueryTopic answer requests {"of": topic} with {"of", "ids"}, the ids subscribed to topic
+	PresenceQueryTopic = "$sys.query.presence"
+
+	presenceTopics    = "$sys.presence.*"
+	sysPrefix         = "$sys."
+	subscribersPrefix = "$sys.subscribers."
+)
+
+// SubscribersTopic return the topic receiving {"event": "join" or "leave", "id", "topic"} when subscribers of topic change
+func SubscribersTopic(topic string) string {
+	return subscribersPrefix + topic
+}
+
+// announceID tell peers and presence subscribers that id connected to, or left, this server
+func (s *Server) announceID(id string, active bool) {
+	if s.cluster != nil {
+		s.cluster.announceID(id, active)
+	}
+	topic := PresenceLeaveTopic
+	if active {
+		topic = PresenceJoinTopic
+	}
+	if !s.Bus.hasSubscribers(topic) {
+		return
+	}
+	s.Publish(topic, map[string]any{
+		"id":     id,
+		"server": s.ID,
+	})
+}
+
+// subscriptionChanged publish join and leave events of topic subscribers, system topics and inboxes are ignored
+func (s *Server) subscriptionChanged(topic, id string, joined bool) {
+	if strings.HasPrefix(topic, sysPrefix) || strings.HasPrefix(topic, inboxPrefix) {
+		return
+	}
+	evt := SubscribersTopic(topic)
+	if !s.Bus.hasSubscribers(evt) {
+		return
+	}
+	event := "leave"
+	if joined {
+		event = "join"
+	}
+	s.Publish(evt, map[string]any{
+		"event": event,
+		"id":    id,
+		"topic": topic,
+	})
+}
+
+// Presence return the ids subscribed to topic on this server, wildcard subscriptions matching topic included, server side subscribers are not listed
+func (s *Server) Presence(topic string) []string {
+	ids := []string{}
+	for _, sub := range s.Bus.subscribersFor(topic) {
+		if sub.Id != "INTERNAL" && !slices.Contains(ids, sub.Id) {
+			ids = append(ids, sub.Id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Online return the ids of the websocket and RPC clients connected to this server
+func (s *Server) Online() []string {
+	ids := append(s.Bus.idConn.Keys(), s.idConnRPC.Keys()...)
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+func (s *Server) handlePresenceQuery() {
+	s.HandleRequest(PresenceQueryTopic, func(req map[string]any) (map[string]any, error) {
+		// the topic field of a request is the query topic itself
+		topic, _ := req["of"].(string)
+		if topic == "" {
+			return nil, errors.New("topic missing")
+		}
+		// the ids of a topic are only given to those who can subscribe to it
+		from, _ := req["from"].(string)
+		if err := s.authorize(s.principalOfID(from), from, ActionSubscribe, topic); err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			"of":  topic,
+			"ids": s.Presence(topic),
+		}, nil
+	})
+}
+
+// presenceIDs read the ids of a presence query response
+func presenceIDs(resp map[string]any) []string {
+	var ids []string
+	switch v := resp["ids"].(type) {
+	case []string:
+		ids = v
+	case []any:
+		for _, id := range v {
+			if s, ok := id.(string); ok {
+				ids = append(ids, s)
+			}
+		}
+	}
+	return ids
+}
+
+// presenceEvent call fn for join and leave events received on a presence topic
+func presenceEvent(data map[string]any, fn func(event, id string)) {
+	id, _ := data["id"].(string)
+	if event, ok := data["event"].(string); ok {
+		fn(event, id)
+		return
+	}
+	switch data["topic"] {
+	case PresenceJoinTopic:
+		fn("join", id)
+	case PresenceLeaveTopic:
+		fn("leave", id)
+	}
+}
+
+// Presence return the ids subscribed to topic, asked to the server
+func (client *Client) Presence(ctx context.Context, topic string) ([]string, error) {
+	resp, err := client.Request(ctx, PresenceQueryTopic, map[string]any{"of": topic})
+	if err != nil {
+		return nil, err
+	}
+	return presenceIDs(resp), nil
+}
+
+// SubscribePresence call fn with "join" or "leave" when subscribers of topic change, an empty topic follow ids connecting to the server
+func (client *Client) SubscribePresence(topic string, fn func(event, id string)) ClientSubscriber {
+	t := SubscribersTopic(topic)
+	if topic == "" {
+		t = presenceTopics
+	}
+	return client.Subscribe(t, func(data map[string]any, _ ClientSubscriber) {
+		presenceEvent(data, fn)
+	})
+}
+
+// Presence return the ids subscribed to topic, asked to the server
+func (c *RPCClient) Presence(ctx context.Context, topic string) ([]string, error) {
+	resp, err := c.Request(ctx, PresenceQueryTopic, map[string]any{"of": topic})
+	if err != nil {
+		return nil, err
+	}
+	return presenceIDs(resp), nil
+}
+
+// SubscribePresence call fn with "join" or "leave" when subscribers of topic change, an empty topic follow ids connecting to the server
+func (c *RPCClient) SubscribePresence(topic string, fn func(event, id string)) RPCSubscriber {
+	t := SubscribersTopic(topic)
+	if topic == "" {
+		t = presenceTopics
+	}
+	return c.Subscribe(t, func(data map[string]any, _ RPCSubscriber) {
+		presenceEvent(data, fn)
+	})
+}
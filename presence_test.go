@@ -0,0 +1,84 @@
+package ksbus
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	s.Subscribe("chat.room", func(map[string]any, Unsub) {})
+	c := newTestClient(t, addr, ClientConnectOptions{Id: "alice"})
+	c.Subscribe("chat.*", func(map[string]any, ClientSubscriber) {})
+	eventually(t, func() bool { return len(s.Presence("chat.room")) == 1 })
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"chat.room", []string{"alice"}},
+		{"chat.other", []string{"alice"}},
+		{"news", []string{}},
+	}
+	for _, tt := range tests {
+		if got := s.Presence(tt.topic); !slices.Equal(got, tt.want) {
+			t.Errorf("Presence(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestPresenceLeave(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	events := make(chan map[string]any, 10)
+	s.Subscribe(PresenceLeaveTopic, func(data map[string]any, _ Unsub) {
+		events <- data
+	})
+	c := newTestClient(t, addr, ClientConnectOptions{Id: "bob"})
+	eventually(t, func() bool { return slices.Contains(s.Online(), "bob") })
+	_ = c.Close()
+	if data := receive(t, events); data["id"] != "bob" || data["server"] != s.ID {
+		t.Fatalf("leave event %v", data)
+	}
+	if slices.Contains(s.Online(), "bob") {
+		t.Fatalf("bob still online: %v", s.Online())
+	}
+}
+
+func TestPresenceQueryAuthorized(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Publish: []string{"$sys.query.presence"}, Subscribe: []string{"public.>"}},
+	}}
+	s, addr := newTestServer(t, ServerOpts{
+		Authenticator: func(cred Credentials) (*Principal, error) {
+			return &Principal{ID: cred.Token}, nil
+		},
+		Authorizer: acl.Authorize,
+	})
+	s.Subscribe("private.x", func(map[string]any, Unsub) {})
+	c := newTestClient(t, addr, ClientConnectOptions{Token: "alice"})
+	c.Subscribe("public.x", func(map[string]any, ClientSubscriber) {})
+	eventually(t, func() bool { return len(s.Presence("public.x")) == 1 })
+	tests := []struct {
+		topic   string
+		want    []string
+		wantErr bool
+	}{
+		{"public.x", []string{"alice"}, false},
+		{"private.x", nil, true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		ids, err := c.Presence(ctx, tt.topic)
+		cancel()
+		if (err != nil) != tt.wantErr || !slices.Equal(ids, tt.want) {
+			t.Errorf("Presence(%q) = %v, %v, want %v", tt.topic, ids, err, tt.want)
+		}
+	}
+	for _, topic := range s.AllTopics() {
+		if strings.HasPrefix(topic, sysPrefix) {
+			t.Fatalf("AllTopics list %s", topic)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package ksbus
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Error codes sent back to clients as the code field of error messages, and in RPCResponse.Code
+const (
+	CodeBadFrame      = "E_BAD_FRAME"      // the message is not a json object
+	CodeBadType       = "E_BAD_TYPE"       // a field has the wrong type, see field
+	CodeActionMissing = "E_ACTION_MISSING" // the message has no action
+	CodeUnknownAction = "E_UNKNOWN_ACTION" // the action is not handled by the server
+	CodeTopicMissing  = "E_TOPIC_MISSING"  // the action need a topic
+	CodeBadTopic      = "E_BAD_TOPIC"      // a '>' or '#' wildcard is not the last level of the topic
+	CodeIDMissing     = "E_ID_MISSING"     // pub_id need the target id, sub need from on a connection without id
+	CodeAddrMissing   = "E_ADDR_MISSING"   // pub_server and server_message need the server address
+	CodeDataMissing   = "E_DATA_MISSING"   // the action need data
+	CodeAckIDMissing  = "E_ACK_ID_MISSING" // ack and nack need the ack_id of the message
+	CodeIDTaken       = "E_ID_TAKEN"       // another connection use the id
+	CodeForbidden     = "E_FORBIDDEN"      // the Authorizer denied the action
+	CodeRejected      = "E_REJECTED"       // OnDataWs returned an error
+	CodeHandlerPanic  = "E_HANDLER_PANIC"  // the server panicked handling the message
+	CodePublishFailed = "E_PUBLISH_FAILED" // pub_server could not reach the server
+	CodeReplayFailed  = "E_REPLAY_FAILED"  // the durable log could not be replayed
+	CodeScheduleFull  = "E_SCHEDULE_FULL"  // a delayed pub or pub_id was rejected, or its delay or ttl is above MaxScheduleDelay
+)
+
+// ProtocolError is a message rejected by the server, sent back as {"error", "code", "action", "field"}
+type ProtocolError struct {
+	Code    string
+	Action  string // action of the message, empty if it has none
+	Field   string // field at fault, empty if the error is not about one field
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Action == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Code, e.Action, e.Message)
+}
+
+// message build the error message sent to a websocket client
+func (e *ProtocolError) message() map[string]any {
+	msg := map[string]any{
+		"error": e.Message,
+		"code":  e.Code,
+	}
+	if e.Action != "" {
+		msg["action"] = e.Action
+	}
+	if e.Field != "" {
+		msg["field"] = e.Field
+	}
+	return msg
+}
+
+// errorMessage build the error message with code sent to a websocket client for err
+func errorMessage(code string, err error) map[string]any {
+	return (&ProtocolError{Code: code, Message: err.Error()}).message()
+}
+
+// protocolErrorFromMessage rebuild the error of an error message received from the server, ok is false for other messages
+func protocolErrorFromMessage(principal string, data map[string]any) (error, bool) {
+	code, _ := data["code"].(string)
+	msg, _ := data["error"].(string)
+	if code == "" || msg == "" {
+		return nil, false
+	}
+	if _, ok := data["topic"]; ok {
+		// replies and published messages may carry their own error
+		return nil, false
+	}
+	action, _ := data["action"].(string)
+	if code == CodeForbidden {
+		target, _ := data["target"].(string)
+		return &AccessError{Principal: principal, Action: Action(action), Target: target}, true
+	}
+	field, _ := data["field"].(string)
+	return &ProtocolError{Code: code, Action: action, Field: field, Message: msg}, true
+}
+
+// pubFrame is a pub action, Data is a string or a json object
+type pubFrame struct {
+	From  string
+	Topic string
+	Data  any
+	Opts  PublishOpts
+}
+
+// subFrame is a sub action
+type subFrame struct {
+	From   string
+	Topic  string
+	Queue  string
+	Ack    bool
+	Replay Replay
+}
+
+// unsubFrame is an unsub action
+type unsubFrame struct {
+	Topic string
+}
+
+// removeTopicFrame is a remove_topic action
+type removeTopicFrame struct {
+	Topic string
+}
+
+// clearRetainedFrame is a clear_retained action
+type clearRetainedFrame struct {
+	Topic string
+}
+
+// ackFrame is an ack or nack action
+type ackFrame struct {
+	From  string
+	AckID string
+	OK    bool // false for nack
+}
+
+// pubIDFrame is a pub_id action, Data is a string or a json object
+type pubIDFrame struct {
+	From string
+	ID   string
+	Data any
+	Opts PublishOpts
+}
+
+// pubServerFrame is a pub_server action, Data is a string or a json object
+type pubServerFrame struct {
+	Addr   string
+	Data   any
+	Secure bool
+}
+
+// serverMessageFrame is a server_message action, Data is a string or a json object
+type serverMessageFrame struct {
+	Addr string
+	Data any
+}
+
+// pingFrame is a ping action, From is the id asked by the client, empty for a generated one
+type pingFrame struct {
+	From string
+}
+
+// decodeFrame validate the websocket message m and return the frame of its action
+func decodeFrame(m map[string]any) (any, *ProtocolError) {
+	r := &frameReader{m: m}
+	action := r.str("action", CodeActionMissing)
+	if r.err != nil {
+		return nil, r.err
+	}
+	r.action = action
+	var frame any
+	switch action {
+	case "pub", "publish":
+		frame = &pubFrame{
+			From:  r.str("from", ""),
+			Topic: r.str("topic", CodeTopicMissing),
+			Data:  r.data(),
+			Opts:  r.publishOpts(),
+		}
+	case "sub", "subscribe":
+		frame = &subFrame{
+			From:   r.str("from", ""),
+			Topic:  r.str("topic", CodeTopicMissing),
+			Queue:  r.str("queue", ""),
+			Ack:    r.boolean("ack"),
+			Replay: r.replay(),
+		}
+		r.pattern("topic")
+	case "unsub", "unsubscribe":
+		frame = &unsubFrame{Topic: r.str("topic", CodeTopicMissing)}
+	case "remove_topic", "removeTopic":
+		frame = &removeTopicFrame{Topic: r.str("topic", CodeTopicMissing)}
+	case "clear_retained", "clearRetained":
+		frame = &clearRetainedFrame{Topic: r.str("topic", CodeTopicMissing)}
+	case "ack", "nack":
+		frame = &ackFrame{
+			From:  r.str("from", ""),
+			AckID: r.str("ack_id", CodeAckIDMissing),
+			OK:    action == "ack",
+		}
+	case "pub_id":
+		frame = &pubIDFrame{
+			From: r.str("from", ""),
+			ID:   r.str("id", CodeIDMissing),
+			Data: r.data(),
+			Opts: r.publishOpts(),
+		}
+	case "pub_server":
+		frame = &pubServerFrame{
+			Addr:   r.str("addr", CodeAddrMissing),
+			Data:   r.data(),
+			Secure: r.boolean("secure"),
+		}
+	case "server_message", "serverMessage":
+		frame = &serverMessageFrame{
+			Addr: r.str("addr", CodeAddrMissing),
+			Data: r.data(),
+		}
+	case "ping":
+		frame = &pingFrame{From: r.str("from", "")}
+	default:
+		return nil, &ProtocolError{Code: CodeUnknownAction, Action: action, Field: "action", Message: "action " + action + " not handled"}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return frame, nil
+}
+
+// frameReader read the fields of a message, the first invalid field is kept in err
+type frameReader struct {
+	m      map[string]any
+	action string
+	err    *ProtocolError
+}
+
+func (r *frameReader) fail(code, field, msg string) {
+	if r.err == nil {
+		r.err = &ProtocolError{Code: code, Action: r.action, Field: field, Message: msg}
+	}
+}
+
+// str return the string field key, missingCode is set if it is required and missing or empty
+func (r *frameReader) str(key, missingCode string) string {
+	v, ok := r.m[key]
+	if !ok || v == nil {
+		if missingCode != "" {
+			r.fail(missingCode, key, key+" missing")
+		}
+		return ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		r.fail(CodeBadType, key, key+" must be a string")
+		return ""
+	}
+	if s == "" && missingCode != "" {
+		r.fail(missingCode, key, key+" missing")
+	}
+	return s
+}
+
+// pattern check the topic field key is a valid subscription pattern
+func (r *frameReader) pattern(key string) {
+	if s, _ := r.m[key].(string); s != "" && !ValidTopic(s) {
+		r.fail(CodeBadTopic, key, "wildcards > and # must be the last level of "+key)
+	}
+}
+
+func (r *frameReader) boolean(key string) bool {
+	v, ok := r.m[key]
+	if !ok || v == nil {
+		return false
+	}
+	b, ok := v.(bool)
+	if !ok {
+		r.fail(CodeBadType, key, key+" must be a boolean")
+	}
+	return b
+}
+
+// number return the positive number field key, 0 if missing
+func (r *frameReader) number(key string) uint64 {
+	v, ok := r.m[key]
+	if !ok || v == nil {
+		return 0
+	}
+	n, ok := toUint64(v)
+	if !ok {
+		r.fail(CodeBadType, key, key+" must be a positive number")
+	}
+	return n
+}
+
+// data return the required data field, a string or a json object
+func (r *frameReader) data() any {
+	v, ok := r.m["data"]
+	if !ok || v == nil {
+		r.fail(CodeDataMissing, "data", "data missing")
+		return nil
+	}
+	switch v.(type) {
+	case string, map[string]any:
+		return v
+	}
+	r.fail(CodeBadType, "data", "data must be a json object or a string")
+	return nil
+}
+
+// publishOpts read retain, delay and ttl (milliseconds) and deliver_at (unix milli) of a pub or pub_id action
+func (r *frameReader) publishOpts() PublishOpts {
+	opts := PublishOpts{Retain: r.boolean("retain")}
+	opts.Delay = r.millis("delay")
+	if ms := r.number("deliver_at"); ms > math.MaxInt64 {
+		r.fail(CodeBadType, "deliver_at", "deliver_at must be a unix time in milliseconds")
+	} else if ms > 0 {
+		opts.DeliverAt = time.UnixMilli(int64(ms))
+	}
+	opts.TTL = r.millis("ttl")
+	return opts
+}
+
+// millis read the duration key in milliseconds, it is checked before being converted so it cannot overflow to a short delay
+func (r *frameReader) millis(key string) time.Duration {
+	ms := r.number(key)
+	limit := uint64(math.MaxInt64 / int64(time.Millisecond))
+	if MaxScheduleDelay > 0 {
+		limit = uint64(MaxScheduleDelay.Milliseconds())
+	}
+	if ms > limit {
+		r.fail(CodeScheduleFull, key, fmt.Sprintf("%s must be at most %d milliseconds", key, limit))
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// replay read from_seq or since (unix milli) of a sub action
+func (r *frameReader) replay() Replay {
+	var from Replay
+	from.Seq = r.number("from_seq")
+	if since := r.number("since"); since > 0 {
+		from.Since = time.UnixMilli(int64(since))
+	}
+	return from
+}
+
+// invalidRPC check the required field of req, "topic" or "id", a missing one is written to resp as a protocol error
+func invalidRPC(req *RPCRequest, resp *RPCResponse, field string) bool {
+	if req.Data == nil {
+		req.Data = map[string]any{}
+	}
+	value, code := req.Topic, CodeTopicMissing
+	if field == "id" {
+		value, code = req.Id, CodeIDMissing
+	}
+	if value != "" {
+		return false
+	}
+	resp.Error = field + " missing"
+	resp.Code = code
+	resp.Data = map[string]any{
+		"field": field,
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package ksbus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+// roundTrip send frame on conn and return the next message received
+func roundTrip(t *testing.T, conn *ws.Conn, frame string) map[string]any {
+	t.Helper()
+	if err := conn.WriteMessage(ws.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var m map[string]any
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatalf("%s: %v", frame, err)
+	}
+	return m
+}
+
+func TestProtocolErrors(t *testing.T) {
+	_, addr := newTestServer(t, ServerOpts{})
+	conn := dialRaw(t, addr)
+	tests := []struct {
+		frame string
+		code  string
+		field string
+	}{
+		{`not json`, CodeBadFrame, ""},
+		{`[1, 2]`, CodeBadFrame, ""},
+		{`{}`, CodeActionMissing, "action"},
+		{`{"action": "nope"}`, CodeUnknownAction, "action"},
+		{`{"action": "pub", "data": {}}`, CodeTopicMissing, "topic"},
+		{`{"action": "pub", "topic": 1, "data": {}}`, CodeBadType, "topic"},
+		{`{"action": "pub", "topic": "a", "data": 1}`, CodeBadType, "data"},
+		{`{"action": "sub", "topic": "a.#.b", "from": "x"}`, CodeBadTopic, "topic"},
+		{`{"action": "sub", "topic": "a"}`, CodeIDMissing, "from"},
+		{`{"action": "pub_id", "data": {}}`, CodeIDMissing, "id"},
+		{`{"action": "ack"}`, CodeAckIDMissing, "ack_id"},
+		{`{"action": "pub", "topic": "a", "data": {}, "delay": 1e16}`, CodeScheduleFull, "delay"},
+		{`{"action": "pub", "topic": "a", "data": {}, "ttl": 1e16}`, CodeScheduleFull, "ttl"},
+		{`{"action": "pub", "topic": "a", "data": {}, "deliver_at": 1e19}`, CodeBadType, "deliver_at"},
+	}
+	for _, tt := range tests {
+		m := roundTrip(t, conn, tt.frame)
+		if m["code"] != tt.code {
+			t.Errorf("%s: got %v, want code %s", tt.frame, m, tt.code)
+			continue
+		}
+		if field, _ := m["field"].(string); field != tt.field {
+			t.Errorf("%s: field %q, want %q", tt.frame, field, tt.field)
+		}
+	}
+}
+
+func TestProtocolPing(t *testing.T) {
+	_, addr := newTestServer(t, ServerOpts{})
+	alice := dialRaw(t, addr)
+	if m := roundTrip(t, alice, `{"action": "ping", "from": "alice"}`); m["data"] != "pong" || m["id"] != "alice" {
+		t.Fatalf("got %v, want pong for alice", m)
+	}
+	// a bound connection keep its id
+	if m := roundTrip(t, alice, `{"action": "ping", "from": "bob"}`); m["id"] != "alice" {
+		t.Fatalf("got %v, want pong for alice", m)
+	}
+
+	other := dialRaw(t, addr)
+	m := roundTrip(t, other, `{"action": "ping", "from": "alice"}`)
+	if m["code"] != CodeIDTaken {
+		t.Fatalf("got %v, want %s", m, CodeIDTaken)
+	}
+	// no pong follow the error, the next message answer the next frame
+	if m := roundTrip(t, other, `{}`); m["code"] != CodeActionMissing {
+		b, _ := json.Marshal(m)
+		t.Fatalf("got %s after %s", b, CodeIDTaken)
+	}
+	if m := roundTrip(t, other, `{"action": "ping"}`); m["data"] != "pong" || m["id"] == "" || m["id"] == "alice" {
+		t.Fatalf("got %v, want pong with a generated id", m)
+	}
+}
@@ -0,0 +1,64 @@
+package ksbus
+
+import (
+	"slices"
+	"strings"
+)
+
+// deliveries keep subscribers without queue group and pick one member per queue group, in round robin
+func (b *Bus) deliveries(topic string, subs []Subscriber) []Subscriber {
+	var groups map[string][]Subscriber
+	res := make([]Subscriber, 0, len(subs))
+	for _, s := range subs {
+		if s.Queue == "" {
+			res = append(res, s)
+			continue
+		}
+		if groups == nil {
+			groups = map[string][]Subscriber{}
+		}
+		groups[s.Queue] = append(groups[s.Queue], s)
+	}
+	topic = normalizeTopic(topic)
+	for queue, members := range groups {
+		key := queue + "@" + topic
+		b.cursorsMu.Lock()
+		n := b.queueCursors[key]
+		b.queueCursors[key] = n + 1
+		b.cursorsMu.Unlock()
+		res = append(res, members[n%uint64(len(members))])
+	}
+	return res
+}
+
+// dropCursors delete the round robin cursors of the queue groups of old that have no member left on topic
+func (b *Bus) dropCursors(topic string, old, subs []Subscriber) {
+	var left []string
+	for _, o := range old {
+		if o.Queue == "" || slices.Contains(left, o.Queue) || slices.ContainsFunc(subs, func(s Subscriber) bool { return s.Queue == o.Queue }) {
+			continue
+		}
+		left = append(left, o.Queue)
+	}
+	if len(left) == 0 {
+		return
+	}
+	b.cursorsMu.Lock()
+	defer b.cursorsMu.Unlock()
+	for key := range b.queueCursors {
+		queue, published, _ := strings.Cut(key, "@")
+		if !slices.Contains(left, queue) || !MatchTopic(topic, published) {
+			continue
+		}
+		// another subscription of the group, using a matching pattern, still use the cursor
+		if slices.ContainsFunc(b.subscribersFor(published), func(s Subscriber) bool { return s.Queue == queue }) {
+			continue
+		}
+		delete(b.queueCursors, key)
+	}
+}
+
+// QueueSubscribe subscribe to topic as a member of queue group, each message is received by only one member of the group
+func (b *Bus) QueueSubscribe(topic, queue string, fn func(data map[string]any, unsub Unsub), onData ...func(data map[string]any)) Unsub {
+	return b.subscribe(topic, queue, fn, onData...)
+}
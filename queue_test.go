@@ -0,0 +1,97 @@
+package ksbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveriesRoundRobin(t *testing.T) {
+	bus := New()
+	subs := []Subscriber{
+		{Id: "plain", Topic: "jobs"},
+		{Id: "a", Topic: "jobs", Queue: "workers"},
+		{Id: "b", Topic: "jobs", Queue: "workers"},
+		{Id: "c", Topic: "jobs", Queue: "workers"},
+		{Id: "x", Topic: "jobs", Queue: "audit"},
+	}
+	tests := []struct {
+		want []string
+	}{
+		{[]string{"plain", "a", "x"}},
+		{[]string{"plain", "b", "x"}},
+		{[]string{"plain", "c", "x"}},
+		{[]string{"plain", "a", "x"}},
+	}
+	for i, tt := range tests {
+		got := map[string]bool{}
+		for _, s := range bus.deliveries("jobs", subs) {
+			got[s.Id] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("publish %d: got %v, want %v", i, got, tt.want)
+		}
+		for _, id := range tt.want {
+			if !got[id] {
+				t.Fatalf("publish %d: got %v, want %v", i, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestQueueSubscribeOneMemberPerMessage(t *testing.T) {
+	bus := New()
+	got := make(chan string, 10)
+	for _, name := range []string{"a", "b"} {
+		bus.QueueSubscribe("jobs", "workers", func(data map[string]any, _ Unsub) {
+			got <- name
+		})
+	}
+	for range 4 {
+		bus.Publish("jobs", map[string]any{"n": 1})
+	}
+	counts := map[string]int{}
+	for range 4 {
+		select {
+		case name := <-got:
+			counts[name]++
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, want 4 deliveries", counts)
+		}
+	}
+	if counts["a"] != 2 || counts["b"] != 2 {
+		t.Fatalf("got %v, want 2 deliveries each", counts)
+	}
+	select {
+	case name := <-got:
+		t.Fatalf("extra delivery to %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQueueCursorsDropped(t *testing.T) {
+	bus := New()
+	a := bus.QueueSubscribe("jobs", "workers", func(map[string]any, Unsub) {})
+	b := bus.QueueSubscribe("jobs.*", "workers", func(map[string]any, Unsub) {})
+	bus.Publish("jobs", map[string]any{})
+	bus.Publish("jobs.x", map[string]any{})
+	bus.Publish("jobs.y", map[string]any{})
+	cursors := func() int {
+		bus.cursorsMu.Lock()
+		defer bus.cursorsMu.Unlock()
+		return len(bus.queueCursors)
+	}
+	tests := []struct {
+		name  string
+		unsub Unsub
+		want  int
+	}{
+		{"jobs member left", a, 2},
+		{"last member left", b, 0},
+	}
+	for _, tt := range tests {
+		tt.unsub.Unsubscribe()
+		if n := cursors(); n != tt.want {
+			t.Errorf("%s: %d cursors, want %d", tt.name, n, tt.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package ksbus
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"time"
+)
+
+// DefaultRequestTimeout is used by Request when ctx has no deadline
+var DefaultRequestTimeout = 10 * time.Second
+
+// RequestHandler handle a request and return the response sent back to the requester, a non nil error is returned to the requester instead
+type RequestHandler func(req map[string]any) (map[string]any, error)
+
+const inboxPrefix = "_INBOX."
+
+// newInbox return a reply topic owned by id, only the connection using id can subscribe to it when an Authorizer is set
+func newInbox(id string) string {
+	return inboxPrefix + EscapeTopicLevel(id) + "." + GenerateUUID()
+}
+
+// inboxOwner return the escaped id owning inbox
+func inboxOwner(inbox string) string {
+	owner, _, _ := strings.Cut(strings.TrimPrefix(inbox, inboxPrefix), ".")
+	return owner
+}
+
+func requestCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultRequestTimeout)
+}
+
+// replyMessage build the message sent back to reply_to by a request handler
+func replyMessage(resp map[string]any, err error) map[string]any {
+	if err != nil {
+		return map[string]any{
+			"error": err.Error(),
+		}
+	}
+	if resp == nil {
+		resp = map[string]any{}
+	}
+	return map[string]any{
+		"data": resp,
+	}
+}
+
+// replyResult extract the response or the error of a reply message
+func replyResult(data map[string]any) (map[string]any, error) {
+	if e, ok := data["error"].(string); ok && e != "" {
+		return nil, errors.New(e)
+	}
+	switch v := data["data"].(type) {
+	case map[string]any:
+		return v, nil
+	case nil:
+		return map[string]any{}, nil
+	default:
+		return map[string]any{"data": v}, nil
+	}
+}
+
+// waitReply wait for the first reply or ctx done
+func waitReply(ctx context.Context, replies chan map[string]any) (map[string]any, error) {
+	select {
+	case data := <-replies:
+		return replyResult(data)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Request publish data on topic and wait for the response of a handler registered using HandleRequest
+func (b *Bus) Request(ctx context.Context, topic string, data map[string]any) (map[string]any, error) {
+	return b.request(ctx, "INTERNAL", topic, data)
+}
+
+func (b *Bus) request(ctx context.Context, from, topic string, data map[string]any) (map[string]any, error) {
+	if !b.hasSubscribers(topic) {
+		return nil, ErrNoResponders
+	}
+	ctx, cancel := requestCtx(ctx)
+	defer cancel()
+	if data == nil {
+		data = map[string]any{}
+	}
+	inbox := newInbox(from)
+	// the inbox channel is never closed, a late reply cannot panic a publisher
+	replies := make(chan map[string]any, 1)
+	sub := Subscriber{
+		bus:   b,
+		Id:    from,
+		Topic: inbox,
+		Ch:    replies,
+	}
+	b.addSubscriber(sub)
+	defer sub.Unsubscribe()
+	if _, ok := data["from"]; !ok {
+		data["from"] = from
+	}
+	data["reply_to"] = inbox
+	b.Publish(topic, data)
+	return waitReply(ctx, replies)
+}
+
+// HandleRequest subscribe to topic and answer requests sent using Request
+func (b *Bus) HandleRequest(topic string, fn RequestHandler) Unsub {
+	return b.handleRequest("INTERNAL", topic, fn)
+}
+
+func (b *Bus) handleRequest(from, topic string, fn RequestHandler) Unsub {
+	return b.Subscribe(topic, func(data map[string]any, _ Unsub) {
+		replyTo, ok := data["reply_to"].(string)
+		if !ok || replyTo == "" {
+			return
+		}
+		// other subscribers may get the same map
+		req := maps.Clone(data)
+		delete(req, "reply_to")
+		msg := replyMessage(fn(req))
+		msg["from"] = from
+		b.Publish(replyTo, msg)
+	})
+}
+
+// Request publish data on topic and wait for the response of a handler registered using HandleRequest
+func (s *Server) Request(ctx context.Context, topic string, data map[string]any) (map[string]any, error) {
+	return s.Bus.request(ctx, s.ID, topic, data)
+}
+
+// HandleRequest subscribe to topic and answer requests sent using Request
+func (s *Server) HandleRequest(topic string, fn RequestHandler) Unsub {
+	return s.Bus.handleRequest(s.ID, topic, fn)
+}
+
+// Request publish data on topic and wait for the response of a handler registered using HandleRequest
+func (client *Client) Request(ctx context.Context, topic string, data map[string]any) (map[string]any, error) {
+	ctx, cancel := requestCtx(ctx)
+	defer cancel()
+	if data == nil {
+		data = map[string]any{}
+	}
+	inbox := newInbox(client.currentID())
+	replies := make(chan map[string]any, 1)
+	client.Subscribe(inbox, func(data map[string]any, _ ClientSubscriber) {
+		select {
+		case replies <- data:
+		default:
+		}
+	})
+	defer client.Unsubscribe(inbox)
+	data["reply_to"] = inbox
+	client.Publish(topic, data)
+	return waitReply(ctx, replies)
+}
+
+// HandleRequest subscribe to topic and answer requests sent using Request, fn run on its own goroutine so it can make requests too
+func (client *Client) HandleRequest(topic string, fn RequestHandler) ClientSubscriber {
+	return client.Subscribe(topic, func(data map[string]any, _ ClientSubscriber) {
+		replyTo, ok := data["reply_to"].(string)
+		if !ok || replyTo == "" {
+			return
+		}
+		// the read loop keep using data
+		req := maps.Clone(data)
+		go client.callHandler(topic, req, nil, func() {
+			delete(req, "reply_to")
+			client.Publish(replyTo, replyMessage(fn(req)))
+		})
+	})
+}
+
+// Request publish data on topic and wait for the response of a handler registered using HandleRequest
+func (c *RPCClient) Request(ctx context.Context, topic string, data map[string]any) (map[string]any, error) {
+	ctx, cancel := requestCtx(ctx)
+	defer cancel()
+	if data == nil {
+		data = map[string]any{}
+	}
+	inbox := newInbox(c.currentID())
+	replies := make(chan map[string]any, 1)
+	c.Subscribe(inbox, func(data map[string]any, _ RPCSubscriber) {
+		select {
+		case replies <- data:
+		default:
+		}
+	})
+	defer c.Unsubscribe(inbox)
+	data["reply_to"] = inbox
+	c.Publish(topic, data)
+	return waitReply(ctx, replies)
+}
+
+// HandleRequest subscribe to topic and answer requests sent using Request, fn run on its own goroutine so it can make requests too
+func (c *RPCClient) HandleRequest(topic string, fn RequestHandler) RPCSubscriber {
+	return c.Subscribe(topic, func(data map[string]any, _ RPCSubscriber) {
+		replyTo, ok := data["reply_to"].(string)
+		if !ok || replyTo == "" {
+			return
+		}
+		// the read loop keep using data
+		req := maps.Clone(data)
+		go c.callHandler(topic, req, nil, func() {
+			delete(req, "reply_to")
+			c.Publish(replyTo, replyMessage(fn(req)))
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package ksbus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBusRequest(t *testing.T) {
+	bus := New()
+	bus.HandleRequest("math.double", func(req map[string]any) (map[string]any, error) {
+		n, _ := req["n"].(int)
+		if n < 0 {
+			return nil, errors.New("negative")
+		}
+		return map[string]any{"n": n * 2}, nil
+	})
+	tests := []struct {
+		n       int
+		want    int
+		wantErr string
+	}{
+		{2, 4, ""},
+		{0, 0, ""},
+		{-1, 0, "negative"},
+	}
+	for _, tt := range tests {
+		resp, err := bus.Request(context.Background(), "math.double", map[string]any{"n": tt.n})
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("n=%d: err = %v, want %s", tt.n, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || resp["n"] != tt.want {
+			t.Fatalf("n=%d: got %v, %v, want %d", tt.n, resp, err, tt.want)
+		}
+	}
+	if _, err := bus.Request(context.Background(), "nobody", nil); !errors.Is(err, ErrNoResponders) {
+		t.Fatalf("err = %v, want ErrNoResponders", err)
+	}
+}
+
+func TestInboxNotMatchedByWildcards(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"#", false},
+		{">", false},
+		{"*.x", false},
+		{"_INBOX.>", true},
+		{"_INBOX.*", true},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, "_INBOX.x"); got != tt.want {
+			t.Errorf("MatchTopic(%q, _INBOX.x) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+
+	bus := New()
+	got := make(chan map[string]any, 10)
+	bus.Subscribe("#", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	bus.HandleRequest("ping", func(req map[string]any) (map[string]any, error) {
+		return map[string]any{}, nil
+	})
+	if _, err := bus.Request(context.Background(), "ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data := receive(t, got); data["topic"] != "ping" {
+		t.Fatalf("got %v, want the request", data)
+	}
+	select {
+	case data := <-got:
+		t.Fatalf("wildcard subscriber received %v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientRequestFromHandler(t *testing.T) {
+	_, addr := newTestServer(t, ServerOpts{})
+	c := newTestClient(t, addr)
+	c.HandleRequest("inner", func(req map[string]any) (map[string]any, error) {
+		return map[string]any{"v": "inner"}, nil
+	})
+	// the handler request another handler of the same client
+	c.HandleRequest("outer", func(req map[string]any) (map[string]any, error) {
+		return c.Request(context.Background(), "inner", nil)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var resp map[string]any
+	var err error
+	eventually(t, func() bool {
+		resp, err = c.Request(ctx, "outer", nil)
+		return !errors.Is(err, ErrNoResponders)
+	})
+	if err != nil || resp["v"] != "inner" {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,233 @@
+package ksbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kamalshkeir/ksmux"
+	"github.com/kamalshkeir/lg"
+)
+
+// DefaultRESTPath is the prefix of the REST API
+var DefaultRESTPath = "/bus"
+
+// handleREST register the REST API on App, behind the middlewares of the websocket endpoint
+//
+//	POST {prefix}/publish/*topic            body published on topic, ?retain=true to retain it
+//	POST {prefix}/id/:id                    body sent to a connection id
+//	POST {prefix}/request/*topic            body sent as a request, respond with the reply, ?timeout=5s
+//	GET  {prefix}/topics                    topics having subscribers, request inboxes excluded
+//	GET  {prefix}/topics/:topic/subscribers subscribers of topic
+//
+// published topics are the rest of the path, they can hold '/' separators, ex: POST /bus/publish/orders/created,
+// the topic of subscribers is one path segment using '.' separators, ex: GET /bus/topics/orders.created/subscribers
+func (server *Server) handleREST() {
+	prefix := server.restPath
+	routes := []struct {
+		method  string
+		path    string
+		handler ksmux.Handler
+	}{
+		{http.MethodPost, prefix + "/publish/*topic", server.restPublish},
+		{http.MethodPost, prefix + "/id/:id", server.restPublishToID},
+		{http.MethodPost, prefix + "/request/*topic", server.restRequest},
+		{http.MethodGet, prefix + "/topics", server.restTopics},
+		{http.MethodGet, prefix + "/topics/:topic/subscribers", server.restSubscribers},
+	}
+	for _, r := range routes {
+		handler := server.restAuth(r.handler)
+		for _, h := range server.busMidws {
+			handler = h(handler)
+		}
+		if r.method == http.MethodPost {
+			server.App.Post(r.path, handler)
+		} else {
+			server.App.Get(r.path, handler)
+		}
+	}
+}
+
+type restPrincipalKey struct{}
+
+// restAuth run the authenticator like the websocket upgrade, the principal is stored in the request context
+func (server *Server) restAuth(next ksmux.Handler) ksmux.Handler {
+	return func(c *ksmux.Context) {
+		principal, err := server.authenticate(credentialsFromRequest(c.Request, server.authCookie))
+		if err != nil {
+			c.Status(http.StatusUnauthorized).Error(err.Error())
+			return
+		}
+		if principal != nil {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), restPrincipalKey{}, principal))
+		}
+		next(c)
+	}
+}
+
+func restPrincipal(c *ksmux.Context) *Principal {
+	p, _ := c.Request.Context().Value(restPrincipalKey{}).(*Principal)
+	return p
+}
+
+// restCheck authorize action on target, a denial is written to c
+func (server *Server) restCheck(c *ksmux.Context, action Action, target string) bool {
+	if err := server.authorize(restPrincipal(c), principalID(restPrincipal(c)), action, target); err != nil {
+		server.dropDenied(action, target, nil, err)
+		c.Status(http.StatusForbidden).Json(accessErrorMessage(err))
+		return false
+	}
+	return true
+}
+
+// restBody decode a json body, values that are not objects are sent as data like websocket string publishes
+func (server *Server) restBody(c *ksmux.Context) (map[string]any, bool) {
+	defer c.Request.Body.Close()
+	var v any
+	if err := json.NewDecoder(c.Request.Body).Decode(&v); err != nil && !errors.Is(err, io.EOF) {
+		c.Status(http.StatusBadRequest).Error("invalid json body: " + err.Error())
+		return nil, false
+	}
+	data, ok := v.(map[string]any)
+	if !ok {
+		data = map[string]any{}
+		if v != nil {
+			data["data"] = v
+		}
+	}
+	// the from sent by the client is never trusted, authenticated clients use their principal id, others a generated one
+	p := restPrincipal(c)
+	if p != nil {
+		data["from"] = p.ID
+	} else {
+		data["from"] = GenerateUUID()
+	}
+	server.authorizeSenderTopics(p, principalID(p), data)
+	return data, true
+}
+
+// restTopic return the topic of the catch-all param, a missing topic is written to c
+func restTopic(c *ksmux.Context) (string, bool) {
+	topic := strings.Trim(c.Param("topic"), "/")
+	if topic == "" {
+		c.Status(http.StatusBadRequest).Error("topic missing")
+		return "", false
+	}
+	return topic, true
+}
+
+func (server *Server) restPublish(c *ksmux.Context) {
+	topic, ok := restTopic(c)
+	if !ok || !server.restCheck(c, ActionPublish, topic) {
+		return
+	}
+	data, ok := server.restBody(c)
+	if !ok {
+		return
+	}
+	retain := c.QueryParam("retain") == "true"
+	if err := server.PublishCtx(c.Request.Context(), topic, data, retain); err != nil {
+		// the message was published, some subscribers could not get it
+		lg.DebugC("rest publish", "topic", topic, "err", err)
+	}
+	c.Success("published")
+}
+
+func (server *Server) restPublishToID(c *ksmux.Context) {
+	id := c.Param("id")
+	if !server.restCheck(c, ActionPublishToID, id) {
+		return
+	}
+	data, ok := server.restBody(c)
+	if !ok {
+		return
+	}
+	if err := server.PublishToIDCtx(c.Request.Context(), id, data); err != nil {
+		if errors.Is(err, ErrUnknownID) {
+			c.Status(http.StatusNotFound).Error(err.Error())
+			return
+		}
+		c.Status(http.StatusBadGateway).Error(err.Error())
+		return
+	}
+	c.Success("sent")
+}
+
+func (server *Server) restRequest(c *ksmux.Context) {
+	topic, ok := restTopic(c)
+	if !ok || !server.restCheck(c, ActionPublish, topic) {
+		return
+	}
+	data, ok := server.restBody(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if t := c.QueryParam("timeout"); t != "" {
+		timeout, err := time.ParseDuration(t)
+		if err != nil {
+			c.Status(http.StatusBadRequest).Error("invalid timeout: " + err.Error())
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// from is the principal id or a generated one, see restBody
+	resp, err := server.Bus.request(ctx, data["from"].(string), topic, data)
+	switch {
+	case err == nil:
+		c.Json(resp)
+	case errors.Is(err, ErrNoResponders):
+		c.Status(http.StatusServiceUnavailable).Error(err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		c.Status(http.StatusGatewayTimeout).Error(err.Error())
+	default:
+		// error returned by the request handler
+		c.Status(http.StatusBadGateway).Error(err.Error())
+	}
+}
+
+func (server *Server) restTopics(c *ksmux.Context) {
+	p := restPrincipal(c)
+	topics := []string{}
+	for _, t := range server.AllTopics() {
+		// inboxes are only known by their requester
+		if strings.HasPrefix(t, inboxPrefix) {
+			continue
+		}
+		if server.authorize(p, principalID(p), ActionSubscribe, t) == nil {
+			topics = append(topics, t)
+		}
+	}
+	slices.Sort(topics)
+	c.Json(map[string]any{
+		"topics": topics,
+	})
+}
+
+func (server *Server) restSubscribers(c *ksmux.Context) {
+	topic, ok := restTopic(c)
+	if !ok || !server.restCheck(c, ActionSubscribe, topic) {
+		return
+	}
+	subs := []map[string]any{}
+	for _, s := range server.GetSubscribers(topic) {
+		sub := map[string]any{
+			"id": s.Id,
+		}
+		if s.Queue != "" {
+			sub["queue"] = s.Queue
+		}
+		subs = append(subs, sub)
+	}
+	c.Json(map[string]any{
+		"topic":       topic,
+		"subscribers": subs,
+	})
+}
@@ -0,0 +1,131 @@
+package ksbus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func restCall(t *testing.T, method, url, body string) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var v map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&v)
+	return resp.StatusCode, v
+}
+
+func TestRESTPublish(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	got := make(chan map[string]any, 10)
+	s.Subscribe("orders.new", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"dot topic", "/bus/publish/orders.new", `{"id": 1}`, http.StatusOK},
+		{"slash topic", "/bus/publish/orders/new", `{"id": 2}`, http.StatusOK},
+		{"forged from", "/bus/publish/orders.new", `{"id": 3, "from": "` + s.ID + `"}`, http.StatusOK},
+		{"bad body", "/bus/publish/orders.new", `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		status, _ := restCall(t, "POST", "http://"+addr+tt.path, tt.body)
+		if status != tt.status {
+			t.Fatalf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		data := receive(t, got)
+		if data["from"] == s.ID || data["from"] == "" {
+			t.Fatalf("%s: from %v not replaced", tt.name, data["from"])
+		}
+	}
+}
+
+func TestRESTTopicsHideInboxes(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	block := make(chan struct{})
+	defer close(block)
+	s.HandleRequest("slow", func(req map[string]any) (map[string]any, error) {
+		<-block
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() { _, _ = s.Request(ctx, "slow", nil) }()
+	eventually(t, func() bool {
+		for _, topic := range s.AllTopics() {
+			if strings.HasPrefix(topic, inboxPrefix) {
+				return true
+			}
+		}
+		return false
+	})
+	status, v := restCall(t, "GET", "http://"+addr+"/bus/topics", "")
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	topics, _ := v["topics"].([]any)
+	found := false
+	for _, topic := range topics {
+		if strings.HasPrefix(topic.(string), inboxPrefix) {
+			t.Fatalf("inbox listed in %v", topics)
+		}
+		found = found || topic == "slow"
+	}
+	if !found {
+		t.Fatalf("topics %v, want slow", topics)
+	}
+}
+
+func TestRESTRequest(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	s.HandleRequest("math.double", func(req map[string]any) (map[string]any, error) {
+		return map[string]any{"v": req["v"].(float64) * 2, "from": req["from"]}, nil
+	})
+	status, v := restCall(t, "POST", "http://"+addr+"/bus/request/math/double", `{"v": 21, "from": "`+s.ID+`"}`)
+	if status != http.StatusOK || v["v"] != float64(42) {
+		t.Fatalf("status %d, got %v", status, v)
+	}
+	if v["from"] == s.ID {
+		t.Fatal("request sent with the server id")
+	}
+	if status, _ := restCall(t, "POST", "http://"+addr+"/bus/request/nobody", `{}`); status != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want 503", status)
+	}
+}
+
+func TestRESTSubscribers(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	s.Subscribe("a/b", func(map[string]any, Unsub) {})
+	tests := []struct {
+		path   string
+		status int
+		subs   int
+	}{
+		{"/bus/topics/a.b/subscribers", http.StatusOK, 1},
+		{"/bus/topics/other/subscribers", http.StatusOK, 0},
+		{"/bus/subscribers/a/b", http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		status, v := restCall(t, "GET", "http://"+addr+tt.path, "")
+		if status != tt.status {
+			t.Fatalf("%s: status %d, want %d", tt.path, status, tt.status)
+		}
+		if subs, _ := v["subscribers"].([]any); len(subs) != tt.subs {
+			t.Fatalf("%s: subscribers %v, want %d", tt.path, v, tt.subs)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package ksbus
+
+// retain keep a copy of data as the last value of topic
+func (b *Bus) retain(topic string, data map[string]any) {
+	topic = normalizeTopic(topic)
+	msg := make(map[string]any, len(data))
+	for k, v := range data {
+		if k != "event_id" {
+			msg[k] = v
+		}
+	}
+	b.retainedMsgs.Set(topic, msg)
+}
+
+// retainedFor return a copy of the retained messages of topics matched by pattern, flagged with retained=true
+func (b *Bus) retainedFor(pattern string) []map[string]any {
+	pattern = normalizeTopic(pattern)
+	var res []map[string]any
+	if !IsWildcardTopic(pattern) {
+		if msg, ok := b.retainedMsgs.Get(pattern); ok && !expired(msg) {
+			res = append(res, retainedCopy(msg))
+		}
+		return res
+	}
+	b.retainedMsgs.Range(func(topic string, msg map[string]any) bool {
+		if MatchTopic(pattern, topic) && !expired(msg) {
+			res = append(res, retainedCopy(msg))
+		}
+		return true
+	})
+	return res
+}
+
+func retainedCopy(msg map[string]any) map[string]any {
+	cp := make(map[string]any, len(msg)+1)
+	for k, v := range msg {
+		cp[k] = v
+	}
+	cp["retained"] = true
+	return cp
+}
+
+// Retained return the last value retained on topic
+func (b *Bus) Retained(topic string) (map[string]any, bool) {
+	topic = normalizeTopic(topic)
+	msg, ok := b.retainedMsgs.Get(topic)
+	if !ok || expired(msg) {
+		return nil, false
+	}
+	return retainedCopy(msg), true
+}
+
+// ClearRetained remove the last value retained on topic, subscribers are kept
+func (b *Bus) ClearRetained(topic string) {
+	topic = normalizeTopic(topic)
+	b.retainedMsgs.Delete(topic)
+}
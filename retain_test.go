@@ -0,0 +1,67 @@
+package ksbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetainedFor(t *testing.T) {
+	bus := New()
+	bus.Publish("stats.cpu", map[string]any{"v": 1}, true)
+	bus.Publish("stats.cpu", map[string]any{"v": 2}, true)
+	bus.Publish("stats/mem", map[string]any{"v": 3}, true)
+	bus.Publish("stats.disk", map[string]any{"v": 4})
+	tests := []struct {
+		pattern string
+		want    []int
+	}{
+		{"stats.cpu", []int{2}},
+		{"stats.mem", []int{3}},
+		{"stats.disk", nil},
+		{"stats.*", []int{2, 3}},
+		{"#", []int{2, 3}},
+		{"other.*", nil},
+	}
+	for _, tt := range tests {
+		got := map[int]bool{}
+		for _, msg := range bus.retainedFor(tt.pattern) {
+			if msg["retained"] != true {
+				t.Errorf("%s: retained flag missing in %v", tt.pattern, msg)
+			}
+			got[msg["v"].(int)] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.pattern, got, tt.want)
+		}
+		for _, v := range tt.want {
+			if !got[v] {
+				t.Fatalf("%s: got %v, want %v", tt.pattern, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRetainedSentOnSubscribe(t *testing.T) {
+	bus := New()
+	bus.Publish("stats.cpu", map[string]any{"v": 1, "event_id": "e"}, true)
+	got := make(chan map[string]any, 1)
+	bus.Subscribe("stats.*", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	select {
+	case data := <-got:
+		if data["v"] != 1 || data["retained"] != true {
+			t.Fatalf("got %v", data)
+		}
+		if _, ok := data["event_id"]; ok {
+			t.Fatalf("event_id retained: %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retained message not received")
+	}
+
+	bus.ClearRetained("stats.cpu")
+	if _, ok := bus.Retained("stats.cpu"); ok {
+		t.Fatal("retained value not cleared")
+	}
+}
@@ -1,10 +1,15 @@
 package ksbus
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/gob"
@@ -15,16 +20,28 @@ import (
 
 // RPCClient implements a client that connects to the bus system using RPC
 type RPCClient struct {
-	Id            string
-	ServerAddr    string
-	conn          *rpc.Client
-	topicHandlers *kmap.SafeMap[string, func(map[string]any, RPCSubscriber)]
-	onId          func(data map[string]any, unsub RPCSubscriber)
-	onDataRPC     func(data map[string]any) error
-	onClose       func()
-	Autorestart   bool
-	RestartEvery  time.Duration
-	Done          chan struct{}
+	Id             string
+	ServerAddr     string
+	conn           *rpc.Client
+	topicHandlers  *kmap.SafeMap[string, func(map[string]any, RPCSubscriber)]
+	topicQueues    *kmap.SafeMap[string, string]
+	onId           func(data map[string]any, unsub RPCSubscriber)
+	onDataRPC      func(data map[string]any) error
+	onClose        func()
+	onReconnect    func()
+	onDisconnect   func(err error)
+	onHandlerError HandlerErrorFunc
+	resume         bool
+	Autorestart    bool
+	RestartEvery   time.Duration
+	Done           chan struct{}
+	lastSeq        atomic.Uint64
+	token          string
+	session        string
+	closeOnce      sync.Once
+	backoff        Backoff
+	cancel         context.CancelFunc
+	mu             sync.RWMutex // guard conn, session and Id, replaced by dial and ping
 }
 
 // RPCSubscriber represents a subscription to a topic via RPC
@@ -39,60 +56,91 @@ func (s RPCSubscriber) Unsubscribe() {
 }
 
 type RPCClientOptions struct {
-	Id           string
-	Address      string // RPC server address (e.g. "localhost:9314")
-	OnId         func(data map[string]any, unsub RPCSubscriber)
-	OnDataRPC    func(data map[string]any) error
-	OnClose      func()
-	Autorestart  bool
-	RestartEvery time.Duration
+	Id             string
+	Address        string // RPC server address (e.g. "localhost:9314")
+	OnId           func(data map[string]any, unsub RPCSubscriber)
+	OnDataRPC      func(data map[string]any) error
+	OnClose        func()
+	Autorestart    bool
+	RestartEvery   time.Duration
+	Reconnect      *Backoff // reconnect policy when Autorestart, default DefaultBackoff starting at RestartEvery
+	Token          string   // credentials sent to the server Authenticator
+	OnDisconnect   func(err error)
+	OnReconnect    func()           // called once subscriptions are restored
+	OnHandlerError HandlerErrorFunc // receive the panics of handlers, they are logged by default
+	// ResumeFromLastSeq replay, after a reconnect, the durable log messages published since LastSeq
+	ResumeFromLastSeq bool
 }
 
 // RPCRequest represents the data structure for RPC calls
 type RPCRequest struct {
-	Action string
-	Topic  string
-	Data   map[string]any
-	From   string
-	Id     string
+	Action  string
+	Topic   string
+	Data    map[string]any
+	From    string
+	Id      string
+	Queue   string
+	FromSeq uint64        // replay the durable log from this sequence on subscribe
+	Since   int64         // replay the durable log from this unix milli time on subscribe, like since of websocket clients
+	Retain  bool          // keep published data as the last value of the topic
+	Token   string        // credentials sent on ping when the server use an Authenticator
+	Session string        // session returned by an authenticated ping
+	Wait    time.Duration // Poll block until a message arrive or Wait pass, 0 return at most one message at once
+	Max     int           // maximum messages returned by a blocking Poll, default DefaultPollBatch
 }
 
 // RPCResponse represents the response from RPC calls
 type RPCResponse struct {
 	Data  map[string]any
 	Error string
+	Code  string           // set for structured errors, ex: E_FORBIDDEN
+	Batch []map[string]any // messages returned by a blocking Poll, in delivery order
 }
 
 // NewRPCClient creates a new RPC client connection to the bus
 func NewRPCClient(opts RPCClientOptions) (*RPCClient, error) {
 	// Register types for gob encoding
 	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	// numbers of typed messages
+	gob.Register(json.Number(""))
 
 	if opts.Id == "" {
 		opts.Id = GenerateUUID()
 	}
+	backoff := reconnectPolicy(opts.Reconnect, opts.RestartEvery)
 	if opts.Autorestart && opts.RestartEvery == 0 {
-		opts.RestartEvery = 10 * time.Second
+		opts.RestartEvery = backoff.Initial
 	}
 	if opts.OnDataRPC == nil {
 		opts.OnDataRPC = func(data map[string]any) error { return nil }
 	}
 
 	client := &RPCClient{
-		Id:            opts.Id,
-		ServerAddr:    opts.Address,
-		topicHandlers: kmap.New[string, func(map[string]any, RPCSubscriber)](20),
-		onId:          opts.OnId,
-		onDataRPC:     opts.OnDataRPC,
-		onClose:       opts.OnClose,
-		Autorestart:   opts.Autorestart,
-		RestartEvery:  opts.RestartEvery,
-		Done:          make(chan struct{}),
+		Id:             opts.Id,
+		ServerAddr:     opts.Address,
+		topicHandlers:  kmap.New[string, func(map[string]any, RPCSubscriber)](20),
+		topicQueues:    kmap.New[string, string](5),
+		onId:           opts.OnId,
+		onDataRPC:      opts.OnDataRPC,
+		onClose:        opts.OnClose,
+		onReconnect:    opts.OnReconnect,
+		onDisconnect:   opts.OnDisconnect,
+		onHandlerError: opts.OnHandlerError,
+		resume:         opts.ResumeFromLastSeq,
+		Autorestart:    opts.Autorestart,
+		RestartEvery:   opts.RestartEvery,
+		Done:           make(chan struct{}),
+		token:          opts.Token,
 	}
 
+	backoff.Ctx, client.cancel = context.WithCancel(backoff.Ctx)
+	client.backoff = backoff
+
 	// Connect to RPC server
 	err := client.connect()
 	if err != nil {
+		client.cancel()
 		return nil, err
 	}
 
@@ -102,131 +150,256 @@ func NewRPCClient(opts RPCClientOptions) (*RPCClient, error) {
 	return client, nil
 }
 
+// connect dial the server and register the client, retrying with the reconnect policy when Autorestart
 func (c *RPCClient) connect() error {
+	if !c.Autorestart {
+		return c.dial()
+	}
+	return c.backoff.Retry(func() error {
+		err := c.dial()
+		if err != nil {
+			lg.Info("Connection failed", "addr", c.ServerAddr, "err", err)
+		}
+		return err
+	})
+}
+
+func (c *RPCClient) dial() error {
 	conn, err := rpc.DialHTTP("tcp", c.ServerAddr)
 	if err != nil {
-		if c.Autorestart {
-			lg.Info("Connection failed, will retry in", "seconds", c.RestartEvery.Seconds())
-			time.Sleep(c.RestartEvery)
-			err := c.connect()
-			if err != nil {
-				lg.Error("Failed to reconnect", "err", err)
-				return err
-			}
-			lg.Info("Successfully reconnected")
-			return nil
-		}
 		return err
 	}
+	c.mu.Lock()
 	c.conn = conn
+	c.mu.Unlock()
 
 	// Initial ping to register client
 	err = c.ping()
 	if err != nil {
-		if c.Autorestart {
-			lg.Info("Ping failed, will retry in", "seconds", c.RestartEvery.Seconds())
-			time.Sleep(c.RestartEvery)
-			err := c.connect()
-			if err != nil {
-				lg.Error("Failed to reconnect", "err", err)
-				return err
-			}
-			lg.Info("Successfully reconnected")
-			return nil
-		}
+		conn.Close()
 		return err
 	}
-
 	return nil
 }
 
 func (c *RPCClient) ping() error {
+	conn, _ := c.state()
 	req := RPCRequest{
 		Action: "ping",
-		From:   c.Id,
+		From:   c.currentID(),
+		Token:  c.token,
 	}
 	var resp RPCResponse
-	err := c.conn.Call("BusRPC.Ping", req, &resp)
+	err := conn.Call("BusRPC.Ping", req, &resp)
 	if err != nil {
 		return err
 	}
 	if resp.Error != "" {
 		return errors.New(resp.Error)
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// authenticated clients are bound to the id of their principal
+	if id, ok := resp.Data["id"].(string); ok && id != "" {
+		c.Id = id
+	}
+	if session, ok := resp.Data["session"].(string); ok {
+		c.session = session
+	}
 	return nil
 }
 
+// currentID return the id of the client, the one bound by the server once registered
+func (c *RPCClient) currentID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Id
+}
+
+// state return the connection and the session of the client
+func (c *RPCClient) state() (*rpc.Client, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn, c.session
+}
+
+// handlersFor return handlers of topic, including those subscribed using a matching wildcard
+func (c *RPCClient) handlersFor(topic string) []func(map[string]any, RPCSubscriber) {
+	var fns []func(map[string]any, RPCSubscriber)
+	c.topicHandlers.Range(func(pattern string, fn func(map[string]any, RPCSubscriber)) bool {
+		if MatchTopic(pattern, topic) {
+			fns = append(fns, fn)
+		}
+		return true
+	})
+	return fns
+}
+
 func (c *RPCClient) Subscribe(topic string, handler func(data map[string]any, unsub RPCSubscriber)) RPCSubscriber {
-	req := RPCRequest{
-		Action: "sub",
-		Topic:  topic,
-		From:   c.Id,
-	}
-	var resp RPCResponse
-	err := c.conn.Call("BusRPC.Subscribe", req, &resp)
+	return c.subscribe(topic, "", Replay{}, handler)
+}
+
+// QueueSubscribe subscribe to topic as a member of queue group, each message is received by only one member of the group
+func (c *RPCClient) QueueSubscribe(topic, queue string, handler func(data map[string]any, unsub RPCSubscriber)) RPCSubscriber {
+	return c.subscribe(topic, queue, Replay{}, handler)
+}
+
+// SubscribeReplay subscribe to topic and receive first the messages recorded in the server durable log starting at from
+func (c *RPCClient) SubscribeReplay(topic string, from Replay, handler func(data map[string]any, unsub RPCSubscriber)) RPCSubscriber {
+	return c.subscribe(topic, "", from, handler)
+}
+
+// LastSeq return the last durable log sequence received, can be used to resume using SubscribeReplay after a restart
+func (c *RPCClient) LastSeq() uint64 {
+	return c.lastSeq.Load()
+}
+
+// SubscribeCtx is like Subscribe but return the error if the subscription failed
+func (c *RPCClient) SubscribeCtx(ctx context.Context, topic string, handler func(data map[string]any, unsub RPCSubscriber)) (RPCSubscriber, error) {
+	return c.subscribeCtx(ctx, topic, "", Replay{}, handler)
+}
+
+func (c *RPCClient) subscribe(topic, queue string, from Replay, handler func(data map[string]any, unsub RPCSubscriber)) RPCSubscriber {
+	sub, err := c.subscribeCtx(context.Background(), topic, queue, from, handler)
 	if err != nil {
 		lg.Error("error subscribing", "topic", topic, "err", err)
-		return RPCSubscriber{
-			client: c,
-			Id:     c.Id,
-			Topic:  topic,
-		}
 	}
+	return sub
+}
 
-	c.topicHandlers.Set(topic, handler)
-	return RPCSubscriber{
+func (c *RPCClient) subscribeCtx(ctx context.Context, topic, queue string, from Replay, handler func(data map[string]any, unsub RPCSubscriber)) (RPCSubscriber, error) {
+	req := RPCRequest{
+		Action:  "sub",
+		Topic:   topic,
+		Queue:   queue,
+		From:    c.currentID(),
+		FromSeq: from.Seq,
+	}
+	if !from.Since.IsZero() {
+		req.Since = from.Since.UnixMilli()
+	}
+	sub := RPCSubscriber{
 		client: c,
-		Id:     c.Id,
+		Id:     c.currentID(),
 		Topic:  topic,
 	}
+	// handler must be set before replayed messages are polled
+	c.topicHandlers.Set(topic, handler)
+	if queue != "" {
+		c.topicQueues.Set(topic, queue)
+	} else {
+		c.topicQueues.Delete(topic)
+	}
+	if _, err := c.call(ctx, "BusRPC.Subscribe", req); err != nil {
+		var perr *ProtocolError
+		if errors.As(err, &perr) && perr.Code == CodeReplayFailed {
+			// subscribed, only a part of the replay was received
+			return sub, err
+		}
+		c.topicHandlers.Delete(topic)
+		c.topicQueues.Delete(topic)
+		return sub, err
+	}
+	return sub, nil
 }
 
 func (c *RPCClient) Unsubscribe(topic string) {
 	req := RPCRequest{
 		Action: "unsub",
 		Topic:  topic,
-		From:   c.Id,
+		From:   c.currentID(),
 	}
-	var resp RPCResponse
-	err := c.conn.Call("BusRPC.Unsubscribe", req, &resp)
+	_, err := c.call(context.Background(), "BusRPC.Unsubscribe", req)
 	if err != nil {
 		lg.Error("error unsubscribing", "topic", topic, "err", err)
 		return
 	}
 	c.topicHandlers.Delete(topic)
+	c.topicQueues.Delete(topic)
+}
+
+// Publish send data to subscribers of topic, if retain is true data is kept as the last value of topic and sent to new subscribers
+func (c *RPCClient) Publish(topic string, data map[string]any, retain ...bool) {
+	err := c.PublishCtx(context.Background(), topic, data, retain...)
+	if err != nil {
+		lg.Error("error publishing", "topic", topic, "err", err)
+	}
 }
 
-func (c *RPCClient) Publish(topic string, data map[string]any) {
+// PublishCtx is like Publish but return call errors, ErrClosed and ctx errors
+func (c *RPCClient) PublishCtx(ctx context.Context, topic string, data map[string]any, retain ...bool) error {
 	req := RPCRequest{
 		Action: "pub",
 		Topic:  topic,
 		Data:   data,
-		From:   c.Id,
+		From:   c.currentID(),
+		Retain: len(retain) > 0 && retain[0],
 	}
-	var resp RPCResponse
-	err := c.conn.Call("BusRPC.Publish", req, &resp)
+	_, err := c.call(ctx, "BusRPC.Publish", req)
+	return err
+}
+
+func (c *RPCClient) PublishToID(id string, data map[string]any) {
+	err := c.PublishToIDCtx(context.Background(), id, data)
 	if err != nil {
-		lg.Error("error publishing", "topic", topic, "err", err)
+		lg.Error("error publishing to ID", "id", id, "err", err)
 	}
 }
 
-func (c *RPCClient) PublishToID(id string, data map[string]any) {
+// PublishToIDCtx is like PublishToID but return call errors, ErrClosed and ctx errors
+func (c *RPCClient) PublishToIDCtx(ctx context.Context, id string, data map[string]any) error {
 	req := RPCRequest{
 		Action: "pub_id",
 		Id:     id,
 		Data:   data,
-		From:   c.Id,
+		From:   c.currentID(),
 	}
+	_, err := c.call(ctx, "BusRPC.PublishToID", req)
+	return err
+}
+
+// call invoke method on the server, it return early with ctx error if ctx is done before the response
+func (c *RPCClient) call(ctx context.Context, method string, req RPCRequest) (RPCResponse, error) {
 	var resp RPCResponse
-	err := c.conn.Call("BusRPC.PublishToID", req, &resp)
-	if err != nil {
-		lg.Error("error publishing to ID", "id", id, "err", err)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return resp, err
+	}
+	conn, session := c.state()
+	if conn == nil {
+		return resp, ErrClosed
+	}
+	req.Session = session
+	call := conn.Go(method, req, &resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			if errors.Is(call.Error, rpc.ErrShutdown) {
+				return resp, fmt.Errorf("%w: %v", ErrClosed, call.Error)
+			}
+			return resp, call.Error
+		}
+		if resp.Code == CodeForbidden {
+			return resp, accessErrorFromRPC(c.currentID(), resp)
+		}
+		if resp.Code != "" {
+			field, _ := resp.Data["field"].(string)
+			return resp, &ProtocolError{Code: resp.Code, Action: req.Action, Field: field, Message: resp.Error}
+		}
+		if resp.Error != "" {
+			return resp, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return RPCResponse{}, ctx.Err()
 	}
 }
 
 func (c *RPCClient) PublishWaitRecv(topic string, data map[string]any, onRecv func(data map[string]any), onExpire func(eventId string, topic string)) {
 	eventId := GenerateUUID()
-	data["from"] = c.Id
+	data["from"] = c.currentID()
 	data["event_id"] = eventId
 	data["topic"] = topic
 	done := make(chan struct{})
@@ -258,7 +431,7 @@ free:
 
 func (c *RPCClient) PublishToIDWaitRecv(id string, data map[string]any, onRecv func(data map[string]any), onExpire func(eventId string, id string)) {
 	eventId := GenerateUUID()
-	data["from"] = c.Id
+	data["from"] = c.currentID()
 	data["event_id"] = eventId
 	data["id"] = id
 	done := make(chan struct{})
@@ -288,24 +461,53 @@ free:
 	}
 }
 
+// ClearRetained remove the last value retained on topic, subscribers are kept
+func (c *RPCClient) ClearRetained(topic string) {
+	req := RPCRequest{
+		Action: "clear_retained",
+		Topic:  topic,
+		From:   c.currentID(),
+	}
+	_, err := c.call(context.Background(), "BusRPC.ClearRetained", req)
+	if err != nil {
+		lg.Error("error clearing retained", "topic", topic, "err", err)
+	}
+}
+
 func (c *RPCClient) RemoveTopic(topic string) {
 	req := RPCRequest{
 		Action: "removeTopic",
 		Topic:  topic,
-		From:   c.Id,
+		From:   c.currentID(),
 	}
-	var resp RPCResponse
-	err := c.conn.Call("BusRPC.RemoveTopic", req, &resp)
+	_, err := c.call(context.Background(), "BusRPC.RemoveTopic", req)
 	if err != nil {
 		lg.Error("error removing topic", "topic", topic, "err", err)
 	}
 }
 
+// Close tell the server to remove the session of the client, then close the connection
 func (c *RPCClient) Close() error {
+	first := false
+	c.closeOnce.Do(func() {
+		first = true
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, _ = c.call(ctx, "BusRPC.Close", RPCRequest{
+			Action: "close",
+			From:   c.currentID(),
+		})
+		cancel()
+		c.cancel()
+		close(c.Done)
+	})
+	if !first {
+		return nil
+	}
 	if c.onClose != nil {
 		c.onClose()
 	}
-	return c.conn.Close()
+	conn, _ := c.state()
+	return conn.Close()
 }
 
 // OnClose sets the callback function to be called when the connection is closed
@@ -313,61 +515,151 @@ func (c *RPCClient) OnClose(fn func()) {
 	c.onClose = fn
 }
 
-// listen continuously polls for messages from the server
-func (c *RPCClient) listen() {
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+// RPCPollWait is how long a poll of the RPC client wait on the server for messages
+var RPCPollWait = 20 * time.Second
 
+// listen continuously polls for messages from the server, each poll block until messages arrive and return them in order
+func (c *RPCClient) listen() {
 	for {
 		select {
 		case <-c.Done:
 			return
-		case <-ticker.C:
-			req := RPCRequest{
-				Action: "poll",
-				From:   c.Id,
+		default:
+		}
+		conn, session := c.state()
+		req := RPCRequest{
+			Action:  "poll",
+			From:    c.currentID(),
+			Session: session,
+			Wait:    RPCPollWait,
+			Max:     DefaultPollBatch,
+		}
+		var resp RPCResponse
+		err := conn.Call("BusRPC.Poll", req, &resp)
+		if err != nil {
+			select {
+			case <-c.Done:
+				return
+			default:
 			}
-			var resp RPCResponse
-			err := c.conn.Call("BusRPC.Poll", req, &resp)
-			if err != nil {
-				if errors.Is(err, rpc.ErrShutdown) {
-					lg.ErrorC(err.Error())
-					if c.onClose != nil {
-						c.onClose()
-					}
-					if c.Autorestart {
-						lg.Info("Connection lost, attempting to reconnect in", "seconds", c.RestartEvery.Seconds())
-						time.Sleep(c.RestartEvery)
-						if err := c.connect(); err != nil {
-							lg.Error("Failed to reconnect", "err", err)
-							continue
-						}
-						lg.Info("Successfully reconnected")
-						continue
-					}
-					c.Close()
-					return
-				}
+			lost := sessionLost(err)
+			if !lost && !errors.Is(err, rpc.ErrShutdown) {
 				lg.Error("error polling messages", "err", err)
+				time.Sleep(100 * time.Millisecond)
 				continue
 			}
-
-			if len(resp.Data) > 0 {
-				c.handleMessage(resp.Data)
+			lg.ErrorC(err.Error())
+			// Close fire onClose, the connection may still come back when Autorestart, an expired session is renewed on the same connection
+			if !lost && !c.Autorestart {
+				c.Close()
+				return
+			}
+			if c.onDisconnect != nil {
+				c.onDisconnect(err)
 			}
+			if !c.restore(lost, err) {
+				c.Close()
+				return
+			}
+			continue
+		}
+
+		for _, msg := range resp.Batch {
+			c.safeHandleMessage(msg)
+		}
+		if len(resp.Data) > 0 {
+			c.safeHandleMessage(resp.Data)
 		}
 	}
 }
 
+// sessionLost return true if err tell that the server removed the session of the client, after it expired
+func sessionLost(err error) bool {
+	var serr rpc.ServerError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	return string(serr) == ErrNotRegistered.Error() || string(serr) == ErrUnauthenticated.Error()
+}
+
+// restore register the client again, on the same connection when only its session was lost, then restore its subscriptions
+func (c *RPCClient) restore(renew bool, cause error) bool {
+	if renew {
+		lg.Info("Session lost, registering again", "err", cause)
+		if err := c.ping(); err != nil {
+			lg.Error("Failed to register again", "err", err)
+			return false
+		}
+	} else {
+		lg.Info("Connection lost, attempting to reconnect", "err", cause)
+		// jitter the first attempt too, clients of a restarting server would else reconnect together
+		if !c.backoff.wait(0) {
+			return false
+		}
+		if err := c.connect(); err != nil {
+			lg.Error("Failed to reconnect", "err", err)
+			return false
+		}
+	}
+	c.resubscribe()
+	lg.Info("Successfully reconnected")
+	if c.onReconnect != nil {
+		c.onReconnect()
+	}
+	return true
+}
+
+// resubscribe send again a sub for every topic having a handler, resuming from LastSeq if ResumeFromLastSeq is set
+func (c *RPCClient) resubscribe() {
+	for _, topic := range c.topicHandlers.Keys() {
+		req := RPCRequest{
+			Action: "sub",
+			Topic:  topic,
+			From:   c.currentID(),
+		}
+		queue, isQueue := c.topicQueues.Get(topic)
+		if isQueue {
+			req.Queue = queue
+		}
+		// queue members would all get the replay
+		if seq := c.lastSeq.Load(); c.resume && seq > 0 && !isQueue {
+			req.FromSeq = seq + 1
+		}
+		if _, err := c.call(context.Background(), "BusRPC.Subscribe", req); err != nil {
+			lg.Error("error resubscribing", "topic", topic, "err", err)
+		}
+	}
+}
+
+// OnReconnect set the callback called after a reconnect, once subscriptions are restored
+func (c *RPCClient) OnReconnect(fn func()) {
+	c.onReconnect = fn
+}
+
+// OnDisconnect set the callback called when the connection is lost
+func (c *RPCClient) OnDisconnect(fn func(err error)) {
+	c.onDisconnect = fn
+}
+
+// safeHandleMessage is handleMessage recovering panics of OnDataRPC and OnId, a panic must not stop polling
+func (c *RPCClient) safeHandleMessage(data map[string]any) {
+	topic, _ := data["topic"].(string)
+	c.callHandler(topic, data, RPCSubscriber{client: c, Id: c.currentID(), Topic: topic}, func() {
+		c.handleMessage(data)
+	})
+}
+
 func (c *RPCClient) handleMessage(data map[string]any) {
 	// Check if message is for a topic we're no longer subscribed to
 	if topic, ok := data["topic"].(string); ok {
-		if _, exists := c.topicHandlers.Get(topic); !exists {
+		if len(c.handlersFor(topic)) == 0 {
 			// Skip processing messages for topics we're not subscribed to
 			return
 		}
 	}
 
+	trackSeq(&c.lastSeq, data)
+
 	// Call general handler first for all messages
 	if err := c.onDataRPC(data); err != nil {
 		lg.Error("error handling RPC data", "err", err)
@@ -376,29 +668,30 @@ func (c *RPCClient) handleMessage(data map[string]any) {
 	if eventID, ok := data["event_id"]; ok {
 		c.Publish(eventID.(string), map[string]any{
 			"ok":   "done",
-			"from": c.Id,
+			"from": c.currentID(),
 		})
 	}
 
-	if toID, ok := data["to_id"]; ok && c.onId != nil && toID.(string) == c.Id {
+	if toID, ok := data["to_id"]; ok && c.onId != nil && toID.(string) == c.currentID() {
 		delete(data, "to_id")
 		sub := RPCSubscriber{
 			client: c,
-			Id:     c.Id,
+			Id:     c.currentID(),
 		}
 		c.onId(data, sub)
 		return
 	}
 
 	if topic, ok := data["topic"].(string); ok {
-		if handler, exists := c.topicHandlers.Get(topic); exists {
-			sub := RPCSubscriber{
-				client: c,
-				Id:     c.Id,
-				Topic:  topic,
-			}
-			handler(data, sub)
-			return
+		sub := RPCSubscriber{
+			client: c,
+			Id:     c.currentID(),
+			Topic:  topic,
+		}
+		for _, handler := range c.handlersFor(topic) {
+			c.callHandler(topic, data, sub, func() {
+				handler(data, sub)
+			})
 		}
 	}
 }
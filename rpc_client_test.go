@@ -0,0 +1,76 @@
+package ksbus
+
+import (
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kamalshkeir/kmap"
+)
+
+func TestRPCClientLostCloseOnce(t *testing.T) {
+	local, remote := net.Pipe()
+	var closed atomic.Int32
+	c := &RPCClient{
+		Id:            "rpc1",
+		conn:          rpc.NewClient(local),
+		topicHandlers: kmap.New[string, func(map[string]any, RPCSubscriber)](1),
+		topicQueues:   kmap.New[string, string](1),
+		onClose:       func() { closed.Add(1) },
+		Done:          make(chan struct{}),
+		cancel:        func() {},
+	}
+	_ = remote.Close()
+	go c.listen()
+	receive(t, c.Done)
+	time.Sleep(20 * time.Millisecond)
+	if n := closed.Load(); n != 1 {
+		t.Fatalf("onClose fired %d times, want 1", n)
+	}
+}
+
+func TestRPCClientSessionLost(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("BusRPC", &BusRPC{server: s}); err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	go srv.ServeConn(remote)
+	reconnected := make(chan struct{}, 1)
+	c := &RPCClient{
+		Id:            "rpc1",
+		conn:          rpc.NewClient(local),
+		topicHandlers: kmap.New[string, func(map[string]any, RPCSubscriber)](1),
+		topicQueues:   kmap.New[string, string](1),
+		onDataRPC:     func(map[string]any) error { return nil },
+		onReconnect:   func() { reconnected <- struct{}{} },
+		Done:          make(chan struct{}),
+		cancel:        func() {},
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if err := c.ping(); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan map[string]any, 1)
+	c.Subscribe("news", func(data map[string]any, _ RPCSubscriber) {
+		got <- data
+	})
+	go c.listen()
+	old, _ := s.idConnRPC.Get("rpc1")
+	eventually(t, func() bool { return old.polling.Load() > 0 })
+
+	// the session expire while the client poll, the poll is then woken up
+	s.removeRPC("rpc1")
+	old.msgChan <- map[string]any{"topic": "other"}
+	receive(t, reconnected)
+	if rpcConn, ok := s.idConnRPC.Get("rpc1"); !ok || rpcConn == old {
+		t.Fatal("client not registered again")
+	}
+	s.Publish("news", map[string]any{"n": 1})
+	if data := receive(t, got); data["n"] != 1 {
+		t.Fatalf("got %v", data)
+	}
+}
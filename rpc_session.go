@@ -0,0 +1,59 @@
+package ksbus
+
+import (
+	"time"
+
+	"github.com/kamalshkeir/lg"
+)
+
+// DefaultRPCSessionTimeout is how long a RPC client can stay without calling the server before its session expire
+var DefaultRPCSessionTimeout = 60 * time.Second
+
+// touch refresh the session of a RPC client
+func (c *RPCConn) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (c *RPCConn) expired(timeout time.Duration) bool {
+	return c.polling.Load() == 0 && time.Since(time.Unix(0, c.lastSeen.Load())) > timeout
+}
+
+// expireRPCSessions remove RPC clients that stopped calling the server, polling clients are never expired
+func (s *Server) expireRPCSessions() {
+	for _, id := range s.idConnRPC.Keys() {
+		if rpcConn, ok := s.idConnRPC.Get(id); ok && rpcConn.expired(s.rpcSessionTimeout) {
+			lg.DebugC("rpc session expired", "id", id)
+			s.removeRPC(id)
+		}
+	}
+}
+
+// removeRPC drop the session, queue and subscriptions of a RPC client, then fire OnRPCClose, or OnWsClose if not set
+func (s *Server) removeRPC(id string) {
+	rpcConn, ok := s.idConnRPC.Get(id)
+	if !ok || !rpcConn.removed.CompareAndSwap(false, true) {
+		return
+	}
+	s.idConnRPC.Delete(id)
+	s.Bus.removeSubscribers(func(sub Subscriber) bool { return sub.Ch == rpcConn.msgChan })
+	s.announceID(id, false)
+	if s.onRPCClose != nil {
+		s.onRPCClose(id)
+	} else if s.onWsClose != nil {
+		s.onWsClose(id)
+	}
+}
+
+// OnRPCClose set the callback fired when a RPC client close or its session expire
+func (s *Server) OnRPCClose(fn func(id string)) {
+	s.onRPCClose = fn
+}
+
+// Close remove the session of the calling client, sent by RPCClient.Close
+func (b *BusRPC) Close(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	b.server.removeRPC(req.From)
+	return nil
+}
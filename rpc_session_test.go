@@ -0,0 +1,58 @@
+package ksbus
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoveRPCOnce(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	var closed, left atomic.Int32
+	s.OnRPCClose(func(string) { closed.Add(1) })
+	s.Subscribe(PresenceLeaveTopic, func(map[string]any, Unsub) { left.Add(1) })
+	s.idConnRPC.Set("rpc1", &RPCConn{Id: "rpc1", msgChan: make(chan map[string]any, 1)})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.removeRPC("rpc1")
+		}()
+	}
+	wg.Wait()
+	eventually(t, func() bool { return left.Load() > 0 })
+	time.Sleep(20 * time.Millisecond)
+	if closed.Load() != 1 || left.Load() != 1 {
+		t.Fatalf("close fired %d times, leave %d times, want 1", closed.Load(), left.Load())
+	}
+}
+
+func TestExpireRPCSessions(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{RPCSessionTimeout: time.Minute})
+	tests := []struct {
+		id       string
+		lastSeen time.Duration
+		polling  bool
+		want     bool
+	}{
+		{"fresh", 0, false, true},
+		{"idle", 2 * time.Minute, false, false},
+		{"idle polling", 2 * time.Minute, true, true},
+	}
+	for _, tt := range tests {
+		rpcConn := &RPCConn{Id: tt.id, msgChan: make(chan map[string]any, 1)}
+		rpcConn.lastSeen.Store(time.Now().Add(-tt.lastSeen).UnixNano())
+		if tt.polling {
+			rpcConn.polling.Add(1)
+		}
+		s.idConnRPC.Set(tt.id, rpcConn)
+	}
+	s.expireRPCSessions()
+	for _, tt := range tests {
+		if _, ok := s.idConnRPC.Get(tt.id); ok != tt.want {
+			t.Errorf("%s: kept %v, want %v", tt.id, ok, tt.want)
+		}
+	}
+}
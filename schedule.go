@@ -0,0 +1,395 @@
+package ksbus
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kamalshkeir/lg"
+)
+
+// scheduleFile keep the scheduled messages in the directory of the durable log, one record per line
+const scheduleFile = "scheduled.jsonl"
+
+var (
+	// MaxScheduled is the max number of messages waiting for their delivery time, 0 for no limit
+	MaxScheduled = 100_000
+	// MaxScheduleDelay is the max wait before the delivery of a scheduled message, 0 for no limit
+	MaxScheduleDelay = 30 * 24 * time.Hour
+	// scheduleCompactMin is the number of records the schedule file can have beyond twice the queue before it is rewritten
+	scheduleCompactMin = 1000
+)
+
+// PublishOpts are the delivery options of PublishWith and PublishToIDWith
+type PublishOpts struct {
+	Delay     time.Duration // publish after Delay
+	DeliverAt time.Time     // publish at DeliverAt, used if Delay is 0
+	// TTL drop the message with DropExpired if it is not delivered TTL after being published, or after being due for scheduled messages
+	TTL    time.Duration
+	Retain bool // keep the message as the last value of its topic
+}
+
+// due return when a message published now with opts should be delivered, zero for now
+func (opts PublishOpts) due() time.Time {
+	if opts.Delay > 0 {
+		return time.Now().Add(opts.Delay)
+	}
+	if opts.DeliverAt.After(time.Now()) {
+		return opts.DeliverAt
+	}
+	return time.Time{}
+}
+
+// message return the data published with opts at, a copy with expires_at (unix milli) when opts has a TTL or the message is scheduled, the caller may reuse data
+func (opts PublishOpts) message(data map[string]any, at time.Time) map[string]any {
+	if opts.TTL <= 0 && at.IsZero() {
+		return data
+	}
+	data = maps.Clone(data)
+	if data == nil {
+		data = map[string]any{}
+	}
+	if opts.TTL > 0 {
+		if at.IsZero() {
+			at = time.Now()
+		}
+		data["expires_at"] = at.Add(opts.TTL).UnixMilli()
+	}
+	return data
+}
+
+// expired report if the expires_at of data passed
+func expired(data map[string]any) bool {
+	ms, ok := toUint64(data["expires_at"])
+	return ok && time.Now().UnixMilli() > int64(ms)
+}
+
+// PublishWith publish data on topic with delivery options, scheduled messages survive restarts when the durable log is enabled
+func (srv *Server) PublishWith(topic string, data map[string]any, opts PublishOpts) error {
+	at := opts.due()
+	data = opts.message(data, at)
+	if at.IsZero() {
+		return srv.PublishCtx(context.Background(), topic, data, opts.Retain)
+	}
+	return srv.scheduler().add(&scheduled{
+		ID:     GenerateUUID(),
+		At:     at.UnixMilli(),
+		Topic:  topic,
+		Retain: opts.Retain,
+		Data:   data,
+	})
+}
+
+// PublishToIDWith send data to id with delivery options, Retain is ignored
+func (srv *Server) PublishToIDWith(id string, data map[string]any, opts PublishOpts) error {
+	at := opts.due()
+	data = opts.message(data, at)
+	if at.IsZero() {
+		return srv.PublishToIDCtx(context.Background(), id, data)
+	}
+	return srv.scheduler().add(&scheduled{
+		ID:   GenerateUUID(),
+		At:   at.UnixMilli(),
+		ToID: id,
+		Data: data,
+	})
+}
+
+// setFrame add the options to a pub or pub_id frame sent to the server
+func (opts PublishOpts) setFrame(frame map[string]any) {
+	if opts.Delay > 0 {
+		frame["delay"] = opts.Delay.Milliseconds()
+	}
+	if !opts.DeliverAt.IsZero() {
+		frame["deliver_at"] = opts.DeliverAt.UnixMilli()
+	}
+	if opts.TTL > 0 {
+		frame["ttl"] = opts.TTL.Milliseconds()
+	}
+	if opts.Retain {
+		frame["retain"] = true
+	}
+}
+
+// PublishWith publish data on topic with delivery options, the server schedule it
+func (client *Client) PublishWith(topic string, data map[string]any, opts PublishOpts) error {
+	frame := map[string]any{
+		"data":   data,
+		"action": "pub",
+		"topic":  topic,
+		"from":   client.currentID(),
+	}
+	opts.setFrame(frame)
+	return client.publishFrame(context.Background(), frame)
+}
+
+// PublishToIDWith send data to id with delivery options, the server schedule it
+func (client *Client) PublishToIDWith(id string, data map[string]any, opts PublishOpts) error {
+	frame := map[string]any{
+		"data":   data,
+		"action": "pub_id",
+		"id":     id,
+		"from":   client.currentID(),
+	}
+	opts.setFrame(frame)
+	return client.publishFrame(context.Background(), frame)
+}
+
+// Scheduled return the number of messages waiting for their delivery time
+func (srv *Server) Scheduled() int {
+	s := srv.scheduler()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// scheduled is a message waiting for its delivery time
+type scheduled struct {
+	ID     string         `json:"id"`
+	At     int64          `json:"at"` // unix milli
+	Topic  string         `json:"topic,omitempty"`
+	ToID   string         `json:"to_id,omitempty"`
+	Retain bool           `json:"retain,omitempty"`
+	Data   map[string]any `json:"data"`
+}
+
+// scheduleQueue is a min heap of scheduled messages ordered by delivery time
+type scheduleQueue []*scheduled
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].At < q[j].At }
+func (q scheduleQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *scheduleQueue) Push(x any)        { *q = append(*q, x.(*scheduled)) }
+func (q *scheduleQueue) Pop() any {
+	old := *q
+	n := len(old)
+	msg := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return msg
+}
+
+// msgScheduler deliver scheduled messages from a single goroutine, waking up at the earliest delivery time
+type msgScheduler struct {
+	queue   scheduleQueue
+	wake    chan struct{}
+	done    <-chan struct{}
+	path    string // empty if not persisted
+	file    *os.File
+	records int // lines in the schedule file
+	fire    func(msg *scheduled)
+	mu      sync.Mutex
+}
+
+// scheduleRecord is a line of the schedule file, a message added or the id of a message fired
+type scheduleRecord struct {
+	Msg  *scheduled `json:"msg,omitempty"`
+	Done string     `json:"done,omitempty"`
+}
+
+// scheduler return the scheduler of the server, started on first use, persisted messages are loaded
+func (srv *Server) scheduler() *msgScheduler {
+	srv.schedOnce.Do(func() {
+		s := &msgScheduler{
+			wake: make(chan struct{}, 1),
+			done: srv.done,
+			fire: srv.fireScheduled,
+		}
+		if srv.Bus.log != nil {
+			s.path = filepath.Join(srv.Bus.log.opts.Dir, scheduleFile)
+			if err := s.load(); err != nil {
+				lg.Error("error loading scheduled messages", "path", s.path, "err", err)
+			}
+		}
+		srv.sched = s
+		go s.run()
+	})
+	return srv.sched
+}
+
+func (srv *Server) fireScheduled(msg *scheduled) {
+	// the server may have been down past the expiry
+	if expired(msg.Data) {
+		srv.Bus.drop(DropExpired, msg.Topic, msg.ToID, msg.Data, 0, nil)
+		return
+	}
+	var err error
+	if msg.ToID != "" {
+		err = srv.PublishToIDCtx(context.Background(), msg.ToID, msg.Data)
+	} else {
+		err = srv.PublishCtx(context.Background(), msg.Topic, msg.Data, msg.Retain)
+	}
+	if err != nil {
+		lg.DebugC("scheduled publish", "topic", msg.Topic, "id", msg.ToID, "err", err)
+	}
+}
+
+// add queue msg, it is rejected when the queue is full, its delivery is too far, it cannot be saved or the server is closed
+func (s *msgScheduler) add(msg *scheduled) error {
+	if MaxScheduleDelay > 0 && time.Until(time.UnixMilli(msg.At)) > MaxScheduleDelay {
+		return fmt.Errorf("%w: delivery is more than %v away", ErrScheduleRejected, MaxScheduleDelay)
+	}
+	s.mu.Lock()
+	// checked under the lock, the run loop close the file holding it once done is closed
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %w", ErrScheduleRejected, ErrClosed)
+	default:
+	}
+	if MaxScheduled > 0 && len(s.queue) >= MaxScheduled {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %d messages already scheduled", ErrScheduleRejected, MaxScheduled)
+	}
+	if err := s.append(scheduleRecord{Msg: msg}); err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrScheduleRejected, err)
+	}
+	heap.Push(&s.queue, msg)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *msgScheduler) run() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 && s.queue[0].At <= time.Now().UnixMilli() {
+			msg := heap.Pop(&s.queue).(*scheduled)
+			s.mu.Unlock()
+			s.fire(msg)
+			// recorded once fired, a crash in between deliver it again after restart instead of losing it
+			s.mu.Lock()
+			if err := s.append(scheduleRecord{Done: msg.ID}); err != nil {
+				lg.Error("error saving scheduled messages", "path", s.path, "err", err)
+			}
+			s.mu.Unlock()
+			continue
+		}
+		var timer *time.Timer
+		var due <-chan time.Time
+		if len(s.queue) > 0 {
+			timer = time.NewTimer(time.Until(time.UnixMilli(s.queue[0].At)))
+			due = timer.C
+		}
+		s.mu.Unlock()
+		select {
+		case <-due:
+		case <-s.wake:
+		case <-s.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			s.close()
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// append write rec at the end of the schedule file, rewritten when fired messages make most of it, s.mu must be held
+func (s *msgScheduler) append(rec scheduleRecord) error {
+	if s.path == "" {
+		return nil
+	}
+	if s.records > 2*len(s.queue)+scheduleCompactMin {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// compact rewrite the schedule file with the queued messages only, s.mu must be held
+func (s *msgScheduler) compact() error {
+	var buf []byte
+	for _, msg := range s.queue {
+		b, err := json.Marshal(scheduleRecord{Msg: msg})
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	// write then rename, a crash never leave a partial file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.records = len(s.queue)
+	return nil
+}
+
+func (s *msgScheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+func (s *msgScheduler) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	msgs := map[string]*scheduled{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		s.records++
+		var rec scheduleRecord
+		// the last line may be partial after a crash
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			lg.Error("skipping corrupted scheduled message", "path", s.path, "err", err)
+			continue
+		}
+		if rec.Msg != nil {
+			msgs[rec.Msg.ID] = rec.Msg
+		} else if rec.Done != "" {
+			delete(msgs, rec.Done)
+		}
+	}
+	for _, msg := range msgs {
+		heap.Push(&s.queue, msg)
+	}
+	return sc.Err()
+}
@@ -0,0 +1,173 @@
+package ksbus
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPublishWithCopyData(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	got := make(chan map[string]any, 1)
+	s.Subscribe("jobs", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	tests := []struct {
+		name string
+		opts PublishOpts
+	}{
+		{"ttl", PublishOpts{TTL: time.Minute}},
+		{"delay", PublishOpts{Delay: 20 * time.Millisecond}},
+		{"delay and ttl", PublishOpts{Delay: 20 * time.Millisecond, TTL: time.Minute}},
+	}
+	for _, tt := range tests {
+		data := map[string]any{"n": 1}
+		if err := s.PublishWith("jobs", data, tt.opts); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, ok := data["expires_at"]; ok {
+			t.Errorf("%s: expires_at written in the caller map", tt.name)
+		}
+		// the caller reuse its map
+		data["n"] = 2
+		msg := receive(t, got)
+		if msg["n"] != 1 {
+			t.Errorf("%s: got %v, want n 1", tt.name, msg)
+		}
+		if _, ok := msg["expires_at"]; ok != (tt.opts.TTL > 0) {
+			t.Errorf("%s: expires_at in %v", tt.name, msg)
+		}
+	}
+}
+
+func TestScheduleLimits(t *testing.T) {
+	maxScheduled, maxDelay := MaxScheduled, MaxScheduleDelay
+	MaxScheduled, MaxScheduleDelay = 2, time.Hour
+	defer func() { MaxScheduled, MaxScheduleDelay = maxScheduled, maxDelay }()
+	s, _ := newTestServer(t, ServerOpts{})
+	tests := []struct {
+		name    string
+		opts    PublishOpts
+		wantErr bool
+	}{
+		{"too far", PublishOpts{Delay: 2 * time.Hour}, true},
+		{"first", PublishOpts{Delay: time.Minute}, false},
+		{"second", PublishOpts{DeliverAt: time.Now().Add(time.Minute)}, false},
+		{"full", PublishOpts{Delay: time.Minute}, true},
+		{"not scheduled", PublishOpts{}, false},
+	}
+	for _, tt := range tests {
+		err := s.PublishWith("jobs", map[string]any{}, tt.opts)
+		if tt.wantErr != errors.Is(err, ErrScheduleRejected) {
+			t.Errorf("%s: err %v, want rejected %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if n := s.Scheduled(); n != 2 {
+		t.Fatalf("%d messages scheduled, want 2", n)
+	}
+}
+
+func TestScheduleClosed(t *testing.T) {
+	s, _ := newTestServer(t, ServerOpts{})
+	_ = s.Close()
+	err := s.PublishWith("jobs", map[string]any{}, PublishOpts{Delay: time.Minute})
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("err %v, want ErrClosed", err)
+	}
+	if n := s.Scheduled(); n != 0 {
+		t.Fatalf("%d messages scheduled after close, want 0", n)
+	}
+}
+
+func TestScheduleRejectedWS(t *testing.T) {
+	_, addr := newTestServer(t, ServerOpts{})
+	errs := make(chan error, 1)
+	c := newTestClient(t, addr, ClientConnectOptions{OnError: func(err error) {
+		errs <- err
+	}})
+	if err := c.PublishWith("jobs", map[string]any{}, PublishOpts{Delay: MaxScheduleDelay + time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	var perr *ProtocolError
+	if err := receive(t, errs); !errors.As(err, &perr) || perr.Code != CodeScheduleFull || perr.Action != "pub" {
+		t.Fatalf("err %v, want %s", err, CodeScheduleFull)
+	}
+}
+
+// scheduleLines return the number of records of the schedule file in dir
+func scheduleLines(t *testing.T, dir string) int {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, scheduleFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestSchedulePersist(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := newTestServer(t, ServerOpts{WithDurableLog: &LogOpts{Dir: dir}})
+	got := make(chan map[string]any, 1)
+	s.Subscribe("jobs", func(data map[string]any, _ Unsub) {
+		got <- data
+	})
+	if err := s.PublishWith("jobs", map[string]any{"n": 1}, PublishOpts{Delay: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishWith("jobs", map[string]any{"n": 2}, PublishOpts{Delay: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, got)
+	// two messages added then one fired, the file is only appended to
+	eventually(t, func() bool { return scheduleLines(t, dir) == 3 })
+	_ = s.Close()
+	eventually(t, func() bool {
+		s.sched.mu.Lock()
+		defer s.sched.mu.Unlock()
+		return s.sched.file == nil
+	})
+
+	restarted, _ := newTestServer(t, ServerOpts{WithDurableLog: &LogOpts{Dir: dir}})
+	if n := restarted.Scheduled(); n != 1 {
+		t.Fatalf("%d messages loaded, want 1", n)
+	}
+}
+
+func TestScheduleCompact(t *testing.T) {
+	compactMin := scheduleCompactMin
+	scheduleCompactMin = 0
+	defer func() { scheduleCompactMin = compactMin }()
+	dir := t.TempDir()
+	s := &msgScheduler{path: filepath.Join(dir, scheduleFile), wake: make(chan struct{}, 1)}
+	defer s.close()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.add(&scheduled{ID: id, At: time.Now().Add(time.Hour).UnixMilli()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Lock()
+	for range 2 {
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		if err := s.append(scheduleRecord{Done: msg.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Unlock()
+	// 4 records for 1 queued message before the last done, the file was rewritten with c then the done appended
+	if n := scheduleLines(t, dir); n != 2 {
+		t.Fatalf("%d records after compaction, want 2", n)
+	}
+	loaded := &msgScheduler{path: s.path}
+	if err := loaded.load(); err != nil || len(loaded.queue) != 1 || loaded.queue[0].ID != "c" {
+		t.Fatalf("loaded %v, %v, want c", loaded.queue, err)
+	}
+}
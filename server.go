@@ -1,11 +1,16 @@
 package ksbus
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/rpc"
 	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/gob"
@@ -24,6 +29,7 @@ type Server struct {
 	App                     *ksmux.Router
 	busMidws                []func(ksmux.Handler) ksmux.Handler
 	onWsClose               func(connID string)
+	onRPCClose              func(id string)
 	onDataWS                func(data map[string]any, conn *ws.Conn, originalRequest *http.Request) error
 	onServerData            []func(data any, conn *ws.Conn)
 	onId                    func(data map[string]any)
@@ -32,29 +38,69 @@ type Server struct {
 	rpcServer               *rpc.Server
 	idConnRPC               *kmap.SafeMap[string, *RPCConn]
 	rpcMaxQueueSize         int
+	rpcSessionTimeout       time.Duration
+	rpcExpireOnce           sync.Once
+	authenticator           Authenticator
+	authCookie              string
+	principals              *kmap.SafeMap[*ws.Conn, *Principal]
+	authorizer              Authorizer
+	deadLetterDenied        bool
+	ssePath                 string
+	restPath                string
+	cluster                 *cluster
+	seenMsgs                *kmap.SafeMap[string, *dedupWindow]
+	dedupOnce               sync.Once
+	sched                   *msgScheduler
+	schedOnce               sync.Once
+	done                    chan struct{} // closed by Close, stop the background loops
+	closeOnce               sync.Once
 }
 
 type RPCConn struct {
-	Id      string
-	msgChan chan map[string]any
+	Id        string
+	msgChan   chan map[string]any
+	session   string
+	principal *Principal
+	lastSeen  atomic.Int64 // unix nano of the last call
+	polling   atomic.Int32 // blocking polls in progress
+	removed   atomic.Bool  // set by the first removeRPC, so close callbacks fire once
 }
 
 type WithRpc struct {
 }
 
 type ServerOpts struct {
-	ID              string
-	Address         string
-	BusPath         string
-	BusMidws        []func(ksmux.Handler) ksmux.Handler
-	OnWsClose       func(connID string)
-	OnDataWS        func(data map[string]any, conn *ws.Conn, originalRequest *http.Request) error
-	OnServerData    []func(data any, conn *ws.Conn)
-	OnId            func(data map[string]any)
-	OnUpgradeWs     func(r *http.Request) bool
-	WithRPCAddress  string
-	WithOtherRouter *ksmux.Router
-	WithOtherBus    *Bus
+	ID                string
+	Address           string
+	BusPath           string
+	SSEPath           string   // Server-Sent Events endpoint, default DefaultSSEPath
+	RESTPath          string   // prefix of the REST API, default DefaultRESTPath
+	Peers             []string // addresses of the other servers of the cluster, every server list the others
+	PeersSecure       bool     // dial peers using wss
+	ClusterSecret     string   // shared by the servers of the cluster, required to accept peers when Authenticator or Authorizer is set
+	BusMidws          []func(ksmux.Handler) ksmux.Handler
+	OnWsClose         func(connID string)
+	OnRPCClose        func(id string) // RPC client closed or its session expired, OnWsClose is used if not set
+	OnDataWS          func(data map[string]any, conn *ws.Conn, originalRequest *http.Request) error
+	OnServerData      []func(data any, conn *ws.Conn)
+	OnId              func(data map[string]any)
+	OnHandlerError    HandlerErrorFunc // receive the panics of handlers, they are logged by default
+	OnUpgradeWs       func(r *http.Request) bool
+	WithRPCAddress    string
+	WithOtherRouter   *ksmux.Router
+	WithOtherBus      *Bus
+	WithDurableLog    *LogOpts
+	OutboundQueueSize int            // messages queued per websocket connection, default DefaultOutboundQueueSize
+	OverflowPolicy    OverflowPolicy // applied when the outbound queue of a connection is full, default DropOldest
+	OnOverflow        func(connID string, policy OverflowPolicy, dropped []byte)
+	Authenticator     Authenticator // run before websocket upgrade and on RPC ping, the connection id is bound to the principal
+	AuthCookie        string        // cookie read for a token, default DefaultAuthCookie
+	RPCSessionTimeout time.Duration // RPC clients not calling the server for this long are removed, default DefaultRPCSessionTimeout
+	Authorizer        Authorizer    // check pub, sub, pub_id, remove_topic and pub_server of websocket and RPC clients, see ACL
+	AckTimeout        time.Duration // messages of ack subscriptions not acked for this long are redelivered, default DefaultAckTimeout
+	MaxDeliveries     int           // deliveries of a message not acked before it is dropped, default DefaultMaxDeliveries
+	DeadLetterTopic   string        // topic receiving dropped messages with the drop reason, default DeadLetterTopic
+	DeadLetterDenied  bool          // keep the data of publishes denied by the Authorizer in dead letters, only the reason and target are kept by default
 }
 
 func NewDefaultServerOptions() ServerOpts {
@@ -119,6 +165,24 @@ func NewServer(options ...ServerOpts) *Server {
 		beforeUpgradeWs:         opts.OnUpgradeWs,
 		idConnRPC:               kmap.New[string, *RPCConn](10),
 		rpcMaxQueueSize:         1000,
+		rpcSessionTimeout:       opts.RPCSessionTimeout,
+		onRPCClose:              opts.OnRPCClose,
+		authenticator:           opts.Authenticator,
+		authCookie:              opts.AuthCookie,
+		principals:              kmap.New[*ws.Conn, *Principal](20),
+		authorizer:              opts.Authorizer,
+		ssePath:                 opts.SSEPath,
+		restPath:                opts.RESTPath,
+		done:                    make(chan struct{}),
+	}
+	if server.rpcSessionTimeout <= 0 {
+		server.rpcSessionTimeout = DefaultRPCSessionTimeout
+	}
+	if server.ssePath == "" {
+		server.ssePath = DefaultSSEPath
+	}
+	if server.restPath == "" {
+		server.restPath = DefaultRESTPath
 	}
 	if len(opts.BusMidws) > 0 {
 		server.busMidws = opts.BusMidws
@@ -129,7 +193,37 @@ func NewServer(options ...ServerOpts) *Server {
 			lg.Fatal("Failed to enable RPC:", "err", err)
 		}
 	}
+	server.Bus.outboundSize = opts.OutboundQueueSize
+	server.Bus.overflow = opts.OverflowPolicy
+	server.Bus.onOverflow = opts.OnOverflow
+	if opts.OnHandlerError != nil {
+		server.Bus.OnHandlerError(opts.OnHandlerError)
+	}
+	if opts.DeadLetterTopic != "" {
+		server.Bus.WithDeadLetter(opts.DeadLetterTopic)
+	}
+	server.deadLetterDenied = opts.DeadLetterDenied
+	if opts.AckTimeout > 0 || opts.MaxDeliveries > 0 {
+		server.Bus.WithAcks(opts.AckTimeout, opts.MaxDeliveries)
+	}
+	if opts.WithDurableLog != nil {
+		if err := server.Bus.WithDurableLog(*opts.WithDurableLog); err != nil {
+			lg.Fatal("Failed to open durable log:", "err", err)
+		}
+		// messages scheduled before a restart
+		server.scheduler()
+	}
+	server.App.OnShutdown(server.Close)
 	server.handleWS()
+	server.handleSSE()
+	server.handleREST()
+	server.Bus.onSubscription = server.subscriptionChanged
+	server.handlePresenceQuery()
+	if len(opts.Peers) > 0 || opts.ClusterSecret != "" {
+		server.cluster = newCluster(&server, opts)
+		server.Bus.relay = server.cluster
+		server.cluster.start()
+	}
 	return &server
 }
 
@@ -148,6 +242,11 @@ func (s *Server) OnId(fn func(data map[string]any)) {
 	s.onId = fn
 }
 
+// OnOverflow is called with the dropped message when the outbound queue of a websocket connection is full
+func (s *Server) OnOverflow(fn func(connID string, policy OverflowPolicy, dropped []byte)) {
+	s.Bus.onOverflow = fn
+}
+
 func (s *Server) WithPprof(path ...string) {
 	s.App.WithPprof(path...)
 }
@@ -169,22 +268,59 @@ func (s *Server) Subscribe(topic string, fn func(data map[string]any, unsub Unsu
 	})
 }
 
+// QueueSubscribe subscribe to topic as a member of queue group, each message is received by only one member of the group
+func (s *Server) QueueSubscribe(topic, queue string, fn func(data map[string]any, unsub Unsub)) (unsub Unsub) {
+	return s.Bus.QueueSubscribe(topic, queue, fn, func(data map[string]any) {
+		id, okID := data["id"]
+		if eventID, ok := data["event_id"]; ok && okID && id == s.ID {
+			s.Publish(eventID.(string), map[string]any{
+				"ok":   "done",
+				"from": s.ID,
+			})
+		}
+		delete(data, "event_id")
+	})
+}
+
 func (s *Server) Unsubscribe(topic string) {
 	s.Bus.Unsubscribe(topic)
 }
 
-func (srv *Server) Publish(topic string, data map[string]any) {
+// Publish send data to subscribers of topic, if retain is true data is kept as the last value of topic and sent to new subscribers
+func (srv *Server) Publish(topic string, data map[string]any, retain ...bool) {
+	_ = srv.PublishCtx(context.Background(), topic, data, retain...)
+}
+
+// PublishCtx is like Publish but return write errors of websocket subscribers and ctx errors
+func (srv *Server) PublishCtx(ctx context.Context, topic string, data map[string]any, retain ...bool) error {
 	if _, ok := data["from"]; !ok {
 		data["from"] = srv.ID
 	}
 	data["topic"] = topic
-	srv.Bus.Publish(topic, data)
+	return srv.Bus.PublishCtx(ctx, topic, data, retain...)
+}
+
+// ClearRetained remove the last value retained on topic, subscribers are kept
+func (s *Server) ClearRetained(topic string) {
+	s.Bus.ClearRetained(topic)
 }
 
 func (s *Server) PublishToID(id string, data map[string]any) {
+	_ = s.PublishToIDCtx(context.Background(), id, data)
+}
+
+// PublishToIDCtx is like PublishToID but return ErrUnknownID, write errors and ctx errors
+func (s *Server) PublishToIDCtx(ctx context.Context, id string, data map[string]any) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if _, ok := data["from"]; !ok {
 		data["from"] = s.ID
 	}
+	delete(data, SeqKey)
 
 	if rpcConn, ok := s.idConnRPC.Get(id); ok {
 		msg := map[string]any{
@@ -196,16 +332,22 @@ func (s *Server) PublishToID(id string, data map[string]any) {
 				msg[k] = v
 			}
 		}
+		if expired(msg) {
+			s.Bus.drop(DropExpired, "", id, msg, 0, nil)
+			return nil
+		}
 		select {
 		case rpcConn.msgChan <- msg:
 		default:
-			<-rpcConn.msgChan
+			old := <-rpcConn.msgChan
 			rpcConn.msgChan <- msg
+			topic, _ := old["topic"].(string)
+			s.Bus.drop(DropFullChannel, topic, id, old, 1, nil)
 		}
-		return
+		return nil
 	}
 
-	s.Bus.PublishToID(id, data)
+	return s.Bus.PublishToIDCtx(ctx, id, data)
 }
 
 func (s *Server) PublishWaitRecv(topic string, data map[string]any, onRecv func(data map[string]any), onExpire func(eventId string, topic string)) {
@@ -271,6 +413,11 @@ free:
 	}
 }
 
+// Replay call fn for each message of topic recorded in the durable log starting at from, until fn return false
+func (s *Server) Replay(topic string, from Replay, fn func(rec LogRecord) bool) error {
+	return s.Bus.Replay(topic, from, fn)
+}
+
 func (s *Server) RemoveTopic(topic string) {
 	s.Bus.RemoveTopic(topic)
 }
@@ -303,6 +450,16 @@ func (s *Server) PublishToServer(addr string, data map[string]any, secure ...boo
 	return nil
 }
 
+// Close stop the background loops of the server and close the durable log, it is called on shutdown of App
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.Bus.Close()
+	})
+	return err
+}
+
 // RUN
 func (s *Server) Run() {
 	s.App.Run()
@@ -319,6 +476,9 @@ func (s *Server) RunAutoTLS() {
 func (s *Server) EnableRPC(address string) error {
 	// Register types for gob encoding
 	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	// numbers of typed messages
+	gob.Register(json.Number(""))
 
 	s.rpcServer = rpc.NewServer()
 
@@ -336,53 +496,161 @@ func (s *Server) EnableRPC(address string) error {
 	}
 
 	go http.Serve(listener, nil)
+	s.rpcExpireOnce.Do(func() {
+		go RunEvery(s.rpcSessionTimeout/2, func() bool {
+			select {
+			case <-s.done:
+				return true
+			default:
+			}
+			s.expireRPCSessions()
+			return false
+		})
+	})
 	return nil
 }
 
+// DefaultPollBatch is the maximum number of messages returned by a blocking Poll
+var DefaultPollBatch = 100
+
+// MaxPollWait cap the time a blocking Poll wait for messages
+var MaxPollWait = 30 * time.Second
+
 type BusRPC struct {
 	server *Server
 }
 
 func (b *BusRPC) Ping(req *RPCRequest, resp *RPCResponse) error {
-	if _, ok := b.server.idConnRPC.Get(req.From); !ok {
-		rpcConn := &RPCConn{
-			Id:      req.From,
+	principal, err := b.server.authenticate(Credentials{Token: req.Token})
+	if err != nil {
+		return err
+	}
+	if principal == nil {
+		if req.From == b.server.ID {
+			return fmt.Errorf("id reserved by the server")
+		}
+		if _, ok := b.server.idConnRPC.Get(req.From); !ok {
+			if b.server.idTaken(req.From) {
+				return fmt.Errorf("ID already exist, should be unique")
+			}
+			rpcConn := &RPCConn{
+				Id:      req.From,
+				msgChan: make(chan map[string]any, b.server.rpcMaxQueueSize),
+			}
+			rpcConn.touch()
+			b.server.idConnRPC.Set(req.From, rpcConn)
+			b.server.announceID(req.From, true)
+		} else if rpcConn, ok := b.server.idConnRPC.Get(req.From); ok {
+			rpcConn.touch()
+		}
+		return nil
+	}
+	// authenticated clients use the id of their principal and a session sent on each call
+	rpcConn, ok := b.server.idConnRPC.Get(principal.ID)
+	if !ok {
+		if b.server.idTaken(principal.ID) {
+			return fmt.Errorf("ID already exist, should be unique")
+		}
+		b.server.announceID(principal.ID, true)
+		rpcConn = &RPCConn{
+			Id:      principal.ID,
 			msgChan: make(chan map[string]any, b.server.rpcMaxQueueSize),
 		}
-		b.server.idConnRPC.Set(req.From, rpcConn)
+	}
+	rpcConn.principal = principal
+	rpcConn.session = GenerateUUID()
+	rpcConn.touch()
+	b.server.idConnRPC.Set(principal.ID, rpcConn)
+	resp.Data = map[string]any{
+		"id":      principal.ID,
+		"session": rpcConn.session,
 	}
 	return nil
 }
 
 func (b *BusRPC) Subscribe(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	if invalidRPC(req, resp, "topic") || b.deniedRPC(req, resp, ActionSubscribe, req.Topic) {
+		return nil
+	}
 	rpcConn, ok := b.server.idConnRPC.Get(req.From)
 	if !ok {
-		return fmt.Errorf("client not registered")
+		return ErrNotRegistered
 	}
 
 	sub := Subscriber{
 		bus:   b.server.Bus,
 		Id:    req.From,
 		Topic: req.Topic,
+		Queue: req.Queue,
 		Ch:    rpcConn.msgChan,
 	}
 
-	if subs, found := b.server.Bus.topicSubscribers.Get(req.Topic); found {
-		subs = append(subs, sub)
-		b.server.Bus.topicSubscribers.Set(req.Topic, subs)
-	} else {
-		b.server.Bus.topicSubscribers.Set(req.Topic, []Subscriber{sub})
+	from := Replay{Seq: req.FromSeq}
+	if req.Since > 0 {
+		from.Since = time.UnixMilli(req.Since)
+	}
+	// a client resubscribing after a reconnect keep its session, its subscription is still there
+	subs, _ := b.server.Bus.topicSubscribers.Get(normalizeTopic(req.Topic))
+	exists := slices.ContainsFunc(subs, func(s Subscriber) bool { return s.Ch == sub.Ch && s.Queue == sub.Queue })
+	if from.isZero() {
+		if !exists {
+			b.server.Bus.addSubscriber(sub)
+		}
+		if req.Queue == "" && !exists {
+			for _, msg := range b.server.Bus.retainedFor(req.Topic) {
+				select {
+				case rpcConn.msgChan <- msg:
+				default:
+				}
+			}
+		}
+		return nil
+	}
+	// the replay is sent first, messages published meanwhile are held by the gate
+	if !exists {
+		sub.gate = &replayGate{max: b.server.rpcMaxQueueSize}
+		b.server.Bus.addSubscriber(sub)
+	}
+	var last uint64
+	full := false
+	err := b.server.Replay(req.Topic, from, func(rec LogRecord) bool {
+		select {
+		case rpcConn.msgChan <- rec.Data:
+			last = rec.Seq
+			return true
+		default:
+			full = true
+			return false
+		}
+	})
+	if sub.gate != nil {
+		sub.gate.release(last)
+	}
+	if err == nil && full {
+		err = fmt.Errorf("partial replay, the queue is full after sequence %d", last)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Code = CodeReplayFailed
+		resp.Data = map[string]any{
+			"last_seq": last,
+		}
 	}
-
 	return nil
 }
 
 func (b *BusRPC) Unsubscribe(req *RPCRequest, resp *RPCResponse) error {
-	if subs, ok := b.server.Bus.topicSubscribers.Get(req.Topic); ok {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	if subs, ok := b.server.Bus.topicSubscribers.Get(normalizeTopic(req.Topic)); ok {
 		for i := range subs {
 			if subs[i].Id == req.From {
 				subs = append(subs[:i], subs[i+1:]...)
-				b.server.Bus.topicSubscribers.Set(req.Topic, subs)
+				b.server.Bus.setSubscribers(req.Topic, subs)
 				break
 			}
 		}
@@ -391,6 +659,13 @@ func (b *BusRPC) Unsubscribe(req *RPCRequest, resp *RPCResponse) error {
 }
 
 func (b *BusRPC) Publish(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	if invalidRPC(req, resp, "topic") || b.deniedRPC(req, resp, ActionPublish, req.Topic) {
+		return nil
+	}
+	b.authorizeSenderTopics(req)
 	req.Data["from"] = req.From
 	msg := map[string]any{
 		"from":  req.From,
@@ -403,11 +678,29 @@ func (b *BusRPC) Publish(req *RPCRequest, resp *RPCResponse) error {
 		}
 	}
 
-	b.server.Bus.Publish(req.Topic, msg)
+	b.server.Bus.Publish(req.Topic, msg, req.Retain)
+	return nil
+}
+
+func (b *BusRPC) ClearRetained(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	if invalidRPC(req, resp, "topic") || b.deniedRPC(req, resp, ActionClearRetained, req.Topic) {
+		return nil
+	}
+	b.server.Bus.ClearRetained(req.Topic)
 	return nil
 }
 
 func (b *BusRPC) PublishToID(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	if invalidRPC(req, resp, "id") || b.deniedRPC(req, resp, ActionPublishToID, req.Id) {
+		return nil
+	}
+	b.authorizeSenderTopics(req)
 	req.Data["from"] = req.From
 	msg := map[string]any{
 		"to_id": req.Id,
@@ -425,7 +718,9 @@ func (b *BusRPC) PublishToID(req *RPCRequest, resp *RPCResponse) error {
 
 	if req.Id == b.server.ID {
 		if b.server.onId != nil {
-			b.server.onId(msg)
+			b.server.Bus.callHandler("", msg, nil, func() {
+				b.server.onId(msg)
+			})
 			if eventID, ok := msg["event_id"]; ok {
 				b.server.Bus.Publish(eventID.(string), map[string]any{
 					"ok":   "done",
@@ -436,40 +731,87 @@ func (b *BusRPC) PublishToID(req *RPCRequest, resp *RPCResponse) error {
 		}
 	}
 
-	if rpcConn, ok := b.server.idConnRPC.Get(req.Id); ok {
-		select {
-		case rpcConn.msgChan <- msg:
-		default:
-			<-rpcConn.msgChan
-			rpcConn.msgChan <- msg
-		}
-		return nil
-	}
-
-	b.server.Bus.PublishToID(req.Id, msg)
+	// same delivery as the server, expired messages and full channels are recorded as drops
+	_ = b.server.PublishToIDCtx(context.Background(), req.Id, msg)
 	return nil
 }
 
 func (b *BusRPC) RemoveTopic(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
+	if invalidRPC(req, resp, "topic") || b.deniedRPC(req, resp, ActionRemoveTopic, req.Topic) {
+		return nil
+	}
 	req.Data["from"] = req.From
 	b.server.Bus.RemoveTopic(req.Topic)
 	return nil
 }
 
 func (b *BusRPC) Poll(req *RPCRequest, resp *RPCResponse) error {
+	if err := b.authorizeRPC(req); err != nil {
+		return err
+	}
 	rpcConn, ok := b.server.idConnRPC.Get(req.From)
 	if !ok {
-		return fmt.Errorf("client not registered")
+		return ErrNotRegistered
+	}
+
+	if req.Wait <= 0 {
+		select {
+		case msg := <-rpcConn.msgChan:
+			resp.Data = msg
+			return nil
+		default:
+			resp.Data = nil
+			return nil
+		}
 	}
 
+	// block until the first message, then take what is already queued without waiting
+	rpcConn.polling.Add(1)
+	defer func() {
+		rpcConn.touch()
+		rpcConn.polling.Add(-1)
+	}()
+	wait := min(req.Wait, MaxPollWait)
+	limit := req.Max
+	if limit <= 0 {
+		limit = DefaultPollBatch
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 	select {
 	case msg := <-rpcConn.msgChan:
-		resp.Data = msg
-		return nil
-	default:
-		resp.Data = nil
+		resp.Batch = append(resp.Batch, msg)
+	case <-timer.C:
 		return nil
 	}
+	for len(resp.Batch) < limit {
+		select {
+		case msg := <-rpcConn.msgChan:
+			resp.Batch = append(resp.Batch, msg)
+		default:
+			resp.Batch = b.unexpired(req.From, resp.Batch)
+			return nil
+		}
+	}
+	resp.Batch = b.unexpired(req.From, resp.Batch)
+	return nil
+}
+
+// unexpired drop the messages whose ttl passed while queued for the RPC client id
+func (b *BusRPC) unexpired(id string, msgs []map[string]any) []map[string]any {
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		if expired(msg) {
+			topic, _ := msg["topic"].(string)
+			b.server.Bus.drop(DropExpired, topic, id, msg, 1, nil)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept
 }
 
 func (s *Server) SetRPCMaxQueueSize(size int) {
@@ -0,0 +1,99 @@
+package ksbus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kamalshkeir/ksmux"
+	"github.com/kamalshkeir/ksmux/ws"
+)
+
+// newTestServer start a server on a random port, its address is returned
+func newTestServer(t *testing.T, opts ServerOpts) (*Server, string) {
+	t.Helper()
+	if opts.WithOtherRouter == nil {
+		opts.WithOtherRouter = ksmux.New()
+	}
+	s := NewServer(opts)
+	ts := httptest.NewServer(s.App)
+	t.Cleanup(func() {
+		ts.Close()
+		_ = s.Close()
+	})
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	s.Address = addr
+	return s, addr
+}
+
+// newTestClient connect a websocket client to addr
+func newTestClient(t *testing.T, addr string, opts ...ClientConnectOptions) *Client {
+	t.Helper()
+	var o ClientConnectOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	o.Address = addr
+	c, err := NewClient(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// dialRaw open a websocket on the server at addr without the Go client
+func dialRaw(t *testing.T, addr string, header ...http.Header) *ws.Conn {
+	t.Helper()
+	var h http.Header
+	if len(header) > 0 {
+		h = header[0]
+	}
+	conn, _, err := ws.DefaultDialer.Dial("ws://"+addr+"/ws/bus", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// receive wait for a message on ch
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received")
+	}
+	var zero T
+	return zero
+}
+
+// eventually retry cond until it return true
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServerPublishToClient(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{})
+	c := newTestClient(t, addr)
+	got := make(chan map[string]any, 1)
+	c.Subscribe("news", func(data map[string]any, _ ClientSubscriber) {
+		got <- data
+	})
+	eventually(t, func() bool { return s.Bus.hasSubscribers("news") })
+	s.Publish("news", map[string]any{"title": "hello"})
+	if data := receive(t, got); data["title"] != "hello" {
+		t.Fatalf("got %v", data)
+	}
+}
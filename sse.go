@@ -0,0 +1,177 @@
+package ksbus
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kamalshkeir/ksmux"
+)
+
+// DefaultSSEPath is the path of the Server-Sent Events endpoint
+var DefaultSSEPath = "/sse/bus"
+
+// SSEKeepAlive is the interval of the comments sent to keep idle streams open through proxies
+var SSEKeepAlive = 15 * time.Second
+
+func (server *Server) handleSSE() {
+	handler := handlerBusSSE(server)
+	for _, h := range server.busMidws {
+		handler = h(handler)
+	}
+	server.App.Get(server.ssePath, handler)
+}
+
+// handlerBusSSE stream messages of the topics query param, ex: GET /sse/bus?topics=a,b
+//
+// Event ids are the durable log sequences, a client sending Last-Event-ID (header or last_event_id query param) get the missed messages first
+func handlerBusSSE(server *Server) ksmux.Handler {
+	return func(c *ksmux.Context) {
+		principal, err := server.authenticate(credentialsFromRequest(c.Request, server.authCookie))
+		if err != nil {
+			c.Status(http.StatusUnauthorized).Error(err.Error())
+			return
+		}
+		var topics []string
+		for _, t := range strings.Split(c.QueryParam("topics"), ",") {
+			if t = strings.TrimSpace(t); t != "" && !slices.Contains(topics, t) {
+				topics = append(topics, t)
+			}
+		}
+		if len(topics) == 0 {
+			c.Status(http.StatusBadRequest).Error("topics missing")
+			return
+		}
+		for _, t := range topics {
+			if err := server.authorize(principal, principalID(principal), ActionSubscribe, t); err != nil {
+				c.Status(http.StatusForbidden).Json(accessErrorMessage(err))
+				return
+			}
+		}
+		if _, ok := c.ResponseWriter.(http.Flusher); !ok {
+			c.Status(http.StatusInternalServerError).Error("streaming not supported")
+			return
+		}
+		id := c.QueryParam("id")
+		if principal != nil {
+			id = principal.ID
+		} else if id == "" {
+			id = GenerateUUID()
+		}
+		lastID := c.Request.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.QueryParam("last_event_id")
+		}
+		var from Replay
+		if lastID != "" {
+			seq, err := strconv.ParseUint(lastID, 10, 64)
+			if err != nil {
+				c.Status(http.StatusBadRequest).Error("bad Last-Event-ID")
+				return
+			}
+			from.Seq = seq + 1
+		}
+
+		ch := make(chan map[string]any, server.Bus.queueSize())
+		for _, t := range topics {
+			server.Bus.addSubscriber(Subscriber{
+				bus:   server.Bus,
+				Id:    id,
+				Topic: t,
+				Ch:    ch,
+			})
+		}
+		defer server.removeSSEFromAllTopics(ch)
+
+		c.AddSSEHeaders()
+		c.ResponseWriter.WriteHeader(http.StatusOK)
+		c.Flush()
+
+		// messages already sent by the replay are skipped when they also come from the subscription
+		var replayed uint64
+		if !from.isZero() && server.Bus.log != nil {
+			var recs []LogRecord
+			for _, t := range topics {
+				_ = server.Replay(t, from, func(rec LogRecord) bool {
+					recs = append(recs, rec)
+					return true
+				})
+			}
+			slices.SortFunc(recs, func(a, b LogRecord) int {
+				return cmp.Compare(a.Seq, b.Seq)
+			})
+			for i, rec := range recs {
+				if i > 0 && rec.Seq == recs[i-1].Seq {
+					continue
+				}
+				if writeSSE(c, rec.Data) != nil {
+					return
+				}
+				replayed = rec.Seq
+			}
+		} else if from.isZero() {
+			for _, t := range topics {
+				for _, msg := range server.Bus.retainedFor(t) {
+					if writeSSE(c, msg) != nil {
+						return
+					}
+				}
+			}
+		}
+
+		keepAlive := time.NewTicker(SSEKeepAlive)
+		defer keepAlive.Stop()
+		done := c.Request.Context().Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-keepAlive.C:
+				if _, err := c.ResponseWriter.Write([]byte(": ping\n\n")); err != nil {
+					return
+				}
+				c.Flush()
+			case msg := <-ch:
+				if seq, ok := toUint64(msg[SeqKey]); ok && seq <= replayed {
+					continue
+				}
+				if writeSSE(c, msg) != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeSSE write msg as an event, its durable log sequence is used as event id
+func writeSSE(c *ksmux.Context, msg map[string]any) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	if seq, ok := toUint64(msg[SeqKey]); ok {
+		sb.WriteString("id: ")
+		sb.WriteString(strconv.FormatUint(seq, 10))
+		sb.WriteByte('\n')
+	}
+	sb.WriteString("data: ")
+	sb.Write(b)
+	sb.WriteString("\n\n")
+	if _, err := c.ResponseWriter.Write([]byte(sb.String())); err != nil {
+		return err
+	}
+	c.Flush()
+	return nil
+}
+
+// removeSSEFromAllTopics remove the subscriptions of a SSE stream
+func (s *Server) removeSSEFromAllTopics(ch chan map[string]any) {
+	if ids := s.Bus.removeSubscribers(func(sub Subscriber) bool { return sub.Ch == ch }); len(ids) > 0 && s.onWsClose != nil {
+		s.onWsClose(ids[0])
+	}
+}
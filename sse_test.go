@@ -0,0 +1,96 @@
+package ksbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sseEvent is an event read from a SSE stream
+type sseEvent struct {
+	id   string
+	data map[string]any
+}
+
+// openSSE open a SSE stream on addr and return its events
+func openSSE(t *testing.T, ctx context.Context, url string, header http.Header) (*http.Response, <-chan sseEvent) {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data)
+			case line == "" && ev.data != nil:
+				events <- ev
+				ev = sseEvent{}
+			}
+		}
+	}()
+	return resp, events
+}
+
+func TestSSEStream(t *testing.T) {
+	s, addr := newTestServer(t, ServerOpts{WithDurableLog: &LogOpts{Dir: t.TempDir()}})
+	s.Publish("news.1", map[string]any{"n": 1})
+	s.Publish("news.2", map[string]any{"n": 2})
+
+	// channel subscribers modify their message while the stream encode it
+	s.Subscribe("news.*", func(data map[string]any, _ Unsub) {
+		delete(data, "n")
+		data["seen"] = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	header := http.Header{"Last-Event-ID": []string{"1"}}
+	resp, events := openSSE(t, ctx, "http://"+addr+DefaultSSEPath+"?topics=news.*", header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	ev := receive(t, events)
+	if ev.id != "2" || ev.data["n"] != float64(2) {
+		t.Fatalf("replayed event %v, want seq 2", ev)
+	}
+	s.Publish("news.3", map[string]any{"n": 3})
+	ev = receive(t, events)
+	if ev.id != "3" || ev.data["n"] != float64(3) {
+		t.Fatalf("live event %v, want seq 3", ev)
+	}
+
+	cancel()
+	eventually(t, func() bool { return len(s.Bus.subscribersFor("news.x")) == 1 })
+}
+
+func TestSSEForbidden(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{{Subscribe: []string{"public.>"}}}}
+	_, addr := newTestServer(t, ServerOpts{Authorizer: acl.Authorize})
+	for topic, want := range map[string]int{
+		"public.x":     http.StatusOK,
+		"private.x":    http.StatusForbidden,
+		"_INBOX.bob.x": http.StatusForbidden,
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		resp, _ := openSSE(t, ctx, "http://"+addr+DefaultSSEPath+"?topics="+topic, nil)
+		if resp.StatusCode != want {
+			t.Errorf("%s: status %d, want %d", topic, resp.StatusCode, want)
+		}
+		cancel()
+	}
+}
@@ -6,22 +6,32 @@ type Unsub interface {
 	Unsubscribe()
 }
 
+// Acker is implemented by the unsub given to the handlers of ack subscriptions, assert it to ack messages
+type Acker interface {
+	Ack()  // acknowledge the message received by an ack subscription
+	Nack() // reject the message received by an ack subscription, it is redelivered now
+}
+
 type Subscriber struct {
 	bus   *Bus
 	Id    string
 	Topic string
+	Queue string // queue group, empty if the subscriber receive every message
 	Ch    chan map[string]any
 	Conn  *ws.Conn
+	ack   bool   // at-least-once subscription, messages are redelivered until acked
+	ackID string // ack_id of the message given to the handler
+	gate  *replayGate
 }
 
 func (subs Subscriber) Unsubscribe() {
-	if allSubs, ok := subs.bus.topicSubscribers.Get(subs.Topic); ok {
+	if allSubs, ok := subs.bus.topicSubscribers.Get(normalizeTopic(subs.Topic)); ok {
 		for i := len(allSubs) - 1; i >= 0; i-- {
 			if (subs.Conn != nil && subs.Conn == allSubs[i].Conn) || (subs.Ch != nil && subs.Ch == allSubs[i].Ch) {
 				allSubs = append(allSubs[:i], allSubs[i+1:]...)
 				break
 			}
 		}
-		subs.bus.topicSubscribers.Set(subs.Topic, allSubs)
+		subs.bus.setSubscribers(subs.Topic, allSubs)
 	}
 }
@@ -0,0 +1,219 @@
+package ksbus
+
+import (
+	"strings"
+	"sync"
+)
+
+// Topics are hierarchical, levels are separated by '.' or '/', '/' is replaced by '.' on publish and subscribe.
+//
+// Wildcards supported in subscriptions:
+//   - '*' or '+' match exactly one level: orders.*.created, orders/+/created
+//   - '>' match one or more trailing levels: orders.>
+//   - '#' match zero or more trailing levels: orders/#
+//
+// '>' and '#' are only valid as the last level, a pattern using them elsewhere match nothing.
+const (
+	wildcardOne     = "*"
+	wildcardOneMQTT = "+"
+	wildcardTail    = ">"
+	wildcardAll     = "#"
+)
+
+// IsWildcardTopic return true if topic contains a wildcard level
+func IsWildcardTopic(topic string) bool {
+	for _, lvl := range splitTopic(topic) {
+		switch lvl {
+		case wildcardOne, wildcardOneMQTT, wildcardTail, wildcardAll:
+			return true
+		}
+	}
+	return false
+}
+
+// ValidTopic return false if a '>' or '#' wildcard of topic is not its last level
+func ValidTopic(topic string) bool {
+	return validLevels(splitTopic(topic))
+}
+
+func validLevels(levels []string) bool {
+	for i, lvl := range levels {
+		if (lvl == wildcardTail || lvl == wildcardAll) && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+var topicLevelEscaper = strings.NewReplacer(
+	"%", "%25",
+	".", "%2E",
+	"/", "%2F",
+	"*", "%2A",
+	"+", "%2B",
+	">", "%3E",
+	"#", "%23",
+)
+
+// EscapeTopicLevel escape the separators and wildcards of s, so it can be used as one level of a topic, ex: an id in users.{id}
+func EscapeTopicLevel(s string) string {
+	return topicLevelEscaper.Replace(s)
+}
+
+// normalizeTopic replace the '/' separators of topic by '.', so a topic published or subscribed with either separator use the same subscribers
+func normalizeTopic(topic string) string {
+	return strings.ReplaceAll(topic, "/", ".")
+}
+
+// MatchTopic return true if topic is matched by pattern
+func MatchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	return matchLevels(splitTopic(pattern), splitTopic(topic))
+}
+
+func matchLevels(pattern, topic []string) bool {
+	if !validLevels(pattern) {
+		return false
+	}
+	if len(topic) > 0 && topic[0]+"." == inboxPrefix && (len(pattern) == 0 || pattern[0]+"." != inboxPrefix) {
+		// replies are only received by their requester
+		return false
+	}
+	for i, lvl := range pattern {
+		switch lvl {
+		case wildcardAll:
+			return true
+		case wildcardTail:
+			return len(topic) > i
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if lvl != wildcardOne && lvl != wildcardOneMQTT && lvl != topic[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+func splitTopic(topic string) []string {
+	return strings.FieldsFunc(topic, func(r rune) bool {
+		return r == '.' || r == '/'
+	})
+}
+
+// topicTrie index wildcard patterns by level, so a publish only walks the levels of its topic
+type topicTrie struct {
+	root *topicNode
+	mu   sync.RWMutex
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	patterns map[string]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: map[string]*topicNode{},
+		patterns: map[string]struct{}{},
+	}
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTopicNode()}
+}
+
+func (t *topicTrie) add(pattern string) {
+	if !ValidTopic(pattern) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	for _, lvl := range splitTopic(pattern) {
+		if lvl == wildcardOneMQTT {
+			lvl = wildcardOne
+		}
+		child, ok := n.children[lvl]
+		if !ok {
+			child = newTopicNode()
+			n.children[lvl] = child
+		}
+		n = child
+	}
+	n.patterns[pattern] = struct{}{}
+}
+
+func (t *topicTrie) remove(pattern string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	levels := splitTopic(pattern)
+	path := make([]*topicNode, 0, len(levels)+1)
+	n := t.root
+	path = append(path, n)
+	for i, lvl := range levels {
+		if lvl == wildcardOneMQTT {
+			lvl = wildcardOne
+			levels[i] = lvl
+		}
+		child, ok := n.children[lvl]
+		if !ok {
+			return
+		}
+		n = child
+		path = append(path, n)
+	}
+	delete(n.patterns, pattern)
+	// prune empty branches
+	for i := len(levels) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if len(node.patterns) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// match return all patterns matching topic, inbox topics are only matched by patterns starting with the inbox prefix
+func (t *topicTrie) match(topic string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var res []string
+	levels := splitTopic(topic)
+	if strings.HasPrefix(topic, inboxPrefix) {
+		if child, ok := t.root.children[levels[0]]; ok {
+			child.collect(levels[1:], &res)
+		}
+		return res
+	}
+	t.root.collect(levels, &res)
+	return res
+}
+
+func (n *topicNode) collect(levels []string, res *[]string) {
+	if child, ok := n.children[wildcardAll]; ok {
+		for p := range child.patterns {
+			*res = append(*res, p)
+		}
+	}
+	if len(levels) == 0 {
+		for p := range n.patterns {
+			*res = append(*res, p)
+		}
+		return
+	}
+	if child, ok := n.children[wildcardTail]; ok {
+		for p := range child.patterns {
+			*res = append(*res, p)
+		}
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.collect(levels[1:], res)
+	}
+	if child, ok := n.children[wildcardOne]; ok {
+		child.collect(levels[1:], res)
+	}
+}
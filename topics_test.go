@@ -0,0 +1,107 @@
+package ksbus
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.*.created", "orders.42.created", true},
+		{"orders.+.created", "orders.42.created", true},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*", "orders.42.created", false},
+		{"orders.>", "orders.42", true},
+		{"orders.>", "orders.42.created", true},
+		{"orders.>", "orders", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.42.created", true},
+		{"#", "orders.42", true},
+		{"orders/+/created", "orders/42/created", true},
+		{"orders/+/created", "orders.42.created", true},
+		{"orders.*", "orders/created", true},
+		{"orders.#.created", "orders.42.created", false},
+		{"orders.#.created", "orders.created", false},
+		{"orders.>.created", "orders.42.created", false},
+		{"#.created", "orders.created", false},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+		trie := newTopicTrie()
+		trie.add(tt.pattern)
+		got := slices.Contains(trie.match(tt.topic), tt.pattern)
+		if tt.pattern == tt.topic {
+			// exact topics are not wildcards, the trie only index patterns
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("trie match of %q on %q = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"orders", true},
+		{"orders.*.created", true},
+		{"orders.>", true},
+		{"orders/#", true},
+		{"#", true},
+		{"orders.#.created", false},
+		{"orders.>.created", false},
+		{"#/created", false},
+	}
+	for _, tt := range tests {
+		if got := ValidTopic(tt.topic); got != tt.want {
+			t.Errorf("ValidTopic(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicSeparatorNormalized(t *testing.T) {
+	tests := []struct {
+		sub, pub string
+	}{
+		{"orders.created", "orders/created"},
+		{"orders/created", "orders.created"},
+		{"orders/created", "orders/created"},
+		{"orders/*", "orders.created"},
+	}
+	for _, tt := range tests {
+		bus := New()
+		got := make(chan map[string]any, 1)
+		bus.Subscribe(tt.sub, func(data map[string]any, _ Unsub) {
+			got <- data
+		})
+		bus.Publish(tt.pub, map[string]any{"n": 1})
+		select {
+		case data := <-got:
+			if data["topic"] != "orders.created" {
+				t.Errorf("sub %q pub %q: topic = %v, want orders.created", tt.sub, tt.pub, data["topic"])
+			}
+		case <-time.After(time.Second):
+			t.Errorf("sub %q did not receive pub %q", tt.sub, tt.pub)
+		}
+	}
+}
+
+func TestDecodeFrameBadTopic(t *testing.T) {
+	_, perr := decodeFrame(map[string]any{"action": "sub", "topic": "orders.#.created", "from": "a"})
+	if perr == nil || perr.Code != CodeBadTopic {
+		t.Fatalf("decodeFrame = %v, want %s", perr, CodeBadTopic)
+	}
+	if _, perr := decodeFrame(map[string]any{"action": "sub", "topic": "orders.#", "from": "a"}); perr != nil {
+		t.Fatalf("decodeFrame = %v, want nil", perr)
+	}
+}
@@ -0,0 +1,152 @@
+package ksbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+
+	"github.com/kamalshkeir/lg"
+)
+
+// typedValueKey hold typed values that are not json objects, ex: PublishTyped[int]
+const typedValueKey = "value"
+
+// routingKeys are the fields set on messages by the bus, they are removed before decoding typed values
+var routingKeys = []string{"topic", "from", SeqKey, "to_id", "via_server", "ack_id", "attempt", "expires_at", "msg_id", "reply_to", "event_id"}
+
+// PubSub is implemented by Bus, Server, Client and RPCClient, it is used by SubscribeTyped and PublishTyped
+type PubSub interface {
+	subscribeMap(topic string, fn func(data map[string]any, unsub Unsub)) Unsub
+	publishMap(ctx context.Context, topic string, data map[string]any, retain bool) error
+}
+
+func (b *Bus) subscribeMap(topic string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return b.Subscribe(topic, fn)
+}
+
+func (b *Bus) publishMap(ctx context.Context, topic string, data map[string]any, retain bool) error {
+	return b.PublishCtx(ctx, topic, data, retain)
+}
+
+func (s *Server) subscribeMap(topic string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return s.Subscribe(topic, fn)
+}
+
+func (s *Server) publishMap(ctx context.Context, topic string, data map[string]any, retain bool) error {
+	return s.PublishCtx(ctx, topic, data, retain)
+}
+
+func (client *Client) subscribeMap(topic string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return client.Subscribe(topic, func(data map[string]any, unsub ClientSubscriber) {
+		fn(data, unsub)
+	})
+}
+
+func (client *Client) publishMap(ctx context.Context, topic string, data map[string]any, retain bool) error {
+	return client.PublishCtx(ctx, topic, data, retain)
+}
+
+func (c *RPCClient) subscribeMap(topic string, fn func(data map[string]any, unsub Unsub)) Unsub {
+	return c.Subscribe(topic, func(data map[string]any, unsub RPCSubscriber) {
+		fn(data, unsub)
+	})
+}
+
+func (c *RPCClient) publishMap(ctx context.Context, topic string, data map[string]any, retain bool) error {
+	return c.PublishCtx(ctx, topic, data, retain)
+}
+
+// SubscribeTyped subscribe to topic on bus and decode each message into T using its json tags
+//
+// a message that cannot be decoded is given to onErr, with an error wrapping ErrDecode, or logged if onErr is not set
+func SubscribeTyped[T any](bus PubSub, topic string, fn func(value T, unsub Unsub), onErr ...func(topic string, err error, data map[string]any)) Unsub {
+	return bus.subscribeMap(topic, func(data map[string]any, unsub Unsub) {
+		v, err := decodeTyped[T](data)
+		if err != nil {
+			err = fmt.Errorf("%w %T on %q: %w", ErrDecode, v, topic, err)
+			if len(onErr) > 0 && onErr[0] != nil {
+				onErr[0](topic, err, data)
+			} else {
+				lg.Error("error decoding message", "topic", topic, "err", err)
+			}
+			return
+		}
+		fn(v, unsub)
+	})
+}
+
+// PublishTyped publish value on topic, structs and maps are sent as the message fields, other values in its value field
+func PublishTyped[T any](bus PubSub, topic string, value T, retain ...bool) error {
+	return PublishTypedCtx(context.Background(), bus, topic, value, retain...)
+}
+
+// PublishTypedCtx is like PublishTyped but use ctx for the publish
+func PublishTypedCtx[T any](ctx context.Context, bus PubSub, topic string, value T, retain ...bool) error {
+	data, err := encodeTyped(value)
+	if err != nil {
+		return fmt.Errorf("encoding %T on %q: %w", value, topic, err)
+	}
+	return bus.publishMap(ctx, topic, data, len(retain) > 0 && retain[0])
+}
+
+// typedObject report if values of t are sent as the message fields, types with their own json encoding, like time.Time, are not
+func typedObject(t reflect.Type) bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Implements(jsonMarshaler) || reflect.PointerTo(t).Implements(jsonMarshaler) {
+		return false
+	}
+	return t.Kind() == reflect.Struct || t.Kind() == reflect.Map
+}
+
+var jsonMarshaler = reflect.TypeFor[json.Marshaler]()
+
+// encodeTyped convert value to a message, it only hold json types so it survive gob encoding of RPC clients, numbers are json.Number to keep int64 precision
+func encodeTyped[T any](value T) (map[string]any, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if !typedObject(reflect.TypeFor[T]()) {
+		return map[string]any{typedValueKey: v}, nil
+	}
+	data, _ := v.(map[string]any)
+	if data == nil {
+		// nil pointer
+		data = map[string]any{}
+	}
+	return data, nil
+}
+
+// decodeTyped convert a message to T without its routing fields, numbers may be float64 from json, json.Number or ints from gob
+func decodeTyped[T any](data map[string]any) (T, error) {
+	var v T
+	data = maps.Clone(data)
+	for _, k := range routingKeys {
+		delete(data, k)
+	}
+	if m, ok := any(&v).(*map[string]any); ok {
+		*m = data
+		return v, nil
+	}
+	var src any = data
+	if !typedObject(reflect.TypeFor[T]()) {
+		src = data[typedValueKey]
+	}
+	b, err := json.Marshal(src)
+	if err != nil {
+		return v, err
+	}
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
@@ -0,0 +1,119 @@
+package ksbus
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type typedOrder struct {
+	ID    int64    `json:"id"`
+	Items []string `json:"items"`
+}
+
+func TestDecodeTypedStripRouting(t *testing.T) {
+	data := map[string]any{
+		"id": float64(7), "items": []any{"book"},
+		"topic": "orders", "from": "alice", SeqKey: uint64(3), "to_id": "bob", "via_server": "s1",
+		"ack_id": "x", "attempt": 1, "expires_at": int64(1), "msg_id": "m", "reply_to": "_INBOX.a.b", "event_id": "e",
+	}
+	order, err := decodeTyped[typedOrder](data)
+	if err != nil || !reflect.DeepEqual(order, typedOrder{ID: 7, Items: []string{"book"}}) {
+		t.Fatalf("got %+v, %v", order, err)
+	}
+	tests := []struct {
+		name string
+		got  func() (map[string]any, error)
+	}{
+		{"map any", func() (map[string]any, error) { return decodeTyped[map[string]any](data) }},
+		{"map string", func() (map[string]any, error) {
+			m, err := decodeTyped[map[string]json.RawMessage](data)
+			res := map[string]any{}
+			for k, v := range m {
+				res[k] = v
+			}
+			return res, err
+		}},
+	}
+	for _, tt := range tests {
+		m, err := tt.got()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(m) != 2 || m["id"] == nil || m["items"] == nil {
+			t.Errorf("%s: got %v, want id and items only", tt.name, m)
+		}
+	}
+	if _, ok := data["topic"]; !ok {
+		t.Fatal("routing fields removed from the message")
+	}
+}
+
+func TestTypedInt64Precision(t *testing.T) {
+	const big = int64(1<<62 + 1)
+	tests := []struct {
+		name      string
+		roundTrip func() (int64, error)
+	}{
+		{"struct", func() (int64, error) {
+			data, err := encodeTyped(typedOrder{ID: big})
+			if err != nil {
+				return 0, err
+			}
+			v, err := decodeTyped[typedOrder](data)
+			return v.ID, err
+		}},
+		{"value", func() (int64, error) {
+			data, err := encodeTyped(big)
+			if err != nil {
+				return 0, err
+			}
+			return decodeTyped[int64](data)
+		}},
+	}
+	for _, tt := range tests {
+		if got, err := tt.roundTrip(); err != nil || got != big {
+			t.Errorf("%s: got %d, %v, want %d", tt.name, got, err, big)
+		}
+	}
+}
+
+func TestTypedGob(t *testing.T) {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(json.Number(""))
+	const big = int64(1<<62 + 1)
+	data, err := encodeTyped(typedOrder{ID: big, Items: []string{"book"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(RPCResponse{Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	var resp RPCResponse
+	if err := gob.NewDecoder(&buf).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	order, err := decodeTyped[typedOrder](resp.Data)
+	if err != nil || order.ID != big || len(order.Items) != 1 {
+		t.Fatalf("got %+v, %v", order, err)
+	}
+}
+
+func TestTypedBus(t *testing.T) {
+	bus := New()
+	got := make(chan typedOrder, 1)
+	SubscribeTyped(bus, "orders", func(o typedOrder, _ Unsub) {
+		got <- o
+	})
+	want := typedOrder{ID: 1<<62 + 1, Items: []string{"book"}}
+	if err := PublishTyped(bus, "orders", want); err != nil {
+		t.Fatal(err)
+	}
+	if o := receive(t, got); !reflect.DeepEqual(o, want) {
+		t.Fatalf("got %+v, want %+v", o, want)
+	}
+}